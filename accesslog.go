@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// accessEntry is what the access log records of a request, filled in as
+// it is served
+type accessEntry struct {
+	principal string
+
+	// Containers acted on by requests naming none in their path, such as
+	// batches
+	containers []string
+}
+
+type accessEntryKey struct{}
+
+func accessEntryFromContext(ctx context.Context) *accessEntry {
+	e, _ := ctx.Value(accessEntryKey{}).(*accessEntry)
+	return e
+}
+
+// setContainers records the containers the request of ctx acts on, for the
+// audit log to tell them
+func setContainers(ctx context.Context, names []string) {
+	if entry := accessEntryFromContext(ctx); entry != nil {
+		entry.containers = names
+	}
+}
+
+// statusWriter records the status and size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// withAccessLog logs every request once served, with its route template
+// and the principal authenticate found for it
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		entry := &accessEntry{}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry)))
+
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+
+		vars := mux.Vars(r)
+		container := vars["name"]
+		if container == "" {
+			container = vars["container"]
+		}
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		logger.Info("request",
+			"method", r.Method,
+			"route", route,
+			"path", r.URL.Path,
+			"container", container,
+			"status", status,
+			"bytes", sw.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"principal", entry.principal,
+			"remote", r.RemoteAddr,
+			"request_id", requestIDFromContext(r.Context()))
+	})
+}
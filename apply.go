@@ -0,0 +1,557 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Actions of apply plans
+const (
+	actionCreate         = "create"
+	actionConfigure      = "configure"
+	actionStart          = "start"
+	actionStop           = "stop"
+	actionDeleteSnapshot = "delete_snapshots"
+	actionDestroy        = "destroy"
+)
+
+// Statuses of plan actions
+const (
+	actionPlanned = "planned"
+	actionDone    = "done"
+	actionFailed  = "failed"
+	actionSkipped = "skipped"
+)
+
+// yamlMediaTypes are the content types manifests may be sent as, besides
+// JSON
+var yamlMediaTypes = map[string]bool{
+	"application/yaml":   true,
+	"application/x-yaml": true,
+	"text/yaml":          true,
+}
+
+// Manifest model
+// swagger:model Manifest
+type Manifest struct {
+	// Containers wanted in the storage root
+	// required: true
+	Containers []ManifestContainer `json:"containers"`
+
+	// Destroy the containers of the storage root the principal can access
+	// and the manifest does not list, with these options. None are
+	// destroyed when empty.
+	Prune *DestroyOptions `json:"prune,omitempty"`
+}
+
+// ManifestContainer model
+// swagger:model ManifestContainer
+type ManifestContainer struct {
+	// Creation parameters, started telling whether the container should
+	// run. The template and devices only apply on creation.
+	ContainerTemplate
+
+	// Configuration items, set after the ones of the profiles
+	Config []ConfigEntry `json:"config"`
+
+	// Number of latest snapshots kept, older ones are destroyed. All are
+	// kept when 0.
+	// minimum: 0
+	// example: 3
+	Snapshots int `json:"snapshots"`
+}
+
+// UnmarshalJSON decodes c, its creation parameters recording the fields
+// they were given
+func (c *ManifestContainer) UnmarshalJSON(data []byte) error {
+	if err := c.ContainerTemplate.UnmarshalJSON(data); err != nil {
+		return err
+	}
+
+	var rest struct {
+		Config    []ConfigEntry `json:"config"`
+		Snapshots int           `json:"snapshots"`
+	}
+	if err := json.Unmarshal(data, &rest); err != nil {
+		return err
+	}
+	c.Config, c.Snapshots = rest.Config, rest.Snapshots
+
+	return nil
+}
+
+// PlanAction model
+// swagger:model PlanAction
+type PlanAction struct {
+	// Container acted on
+	// example: web-1
+	Container string `json:"container"`
+
+	// enum: create,configure,start,stop,delete_snapshots,destroy
+	// example: configure
+	Action string `json:"action"`
+
+	// Configuration items, limits or snapshots changed
+	// example: ["lxc.start.auto: 0 -> 1", "limits.cpus: 1 -> 2"]
+	Changes []string `json:"changes,omitempty"`
+
+	// Whether the action ran. Actions following a failed one on the same
+	// container are skipped.
+	// enum: planned,done,failed,skipped
+	// example: done
+	Status string `json:"status"`
+
+	// Error of a failed action
+	Error string `json:"error,omitempty"`
+
+	// Machine-readable code of the error
+	// example: quota_exceeded
+	Code string `json:"code,omitempty"`
+}
+
+// Plan model
+// swagger:model Plan
+type Plan struct {
+	// Actions were only planned
+	// example: false
+	DryRun bool `json:"dry_run"`
+
+	// Actions in the order they run, none when the containers are as
+	// described
+	Actions []PlanAction `json:"actions"`
+}
+
+// planStep is a plan action along with what runs it
+type planStep struct {
+	PlanAction
+	run func() *apiError
+}
+
+// isYAML reports whether the body of r is YAML
+func isYAML(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return yamlMediaTypes[mediaType]
+}
+
+// yamlToJSON converts a YAML document to JSON, for it to be decoded and
+// validated like JSON bodies
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jsonValue(doc))
+}
+
+// jsonValue returns v with the maps yaml.v2 decodes turned into maps
+// keyed by strings
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonValue(value)
+		}
+	}
+	return v
+}
+
+// decodeManifest decodes data, the JSON or YAML manifest of the body of r
+func decodeManifest(r *http.Request, data []byte) (*Manifest, error) {
+	var err error
+	if isYAML(r) {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, err
+		}
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, c := range m.Containers {
+		if c.Name == "" {
+			return nil, errors.New("no container name passed")
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("container %s is listed twice", c.Name)
+		}
+		names[c.Name] = true
+
+		if c.Snapshots < 0 {
+			return nil, fmt.Errorf("container %s: snapshots must not be negative", c.Name)
+		}
+		if err := validateConfig(c.Config); err != nil {
+			return nil, fmt.Errorf("container %s: %w", c.Name, err)
+		}
+	}
+
+	return &m, nil
+}
+
+// plan returns the steps bringing the containers of lxcpath to what m
+// describes, on behalf of the principal of r
+func plan(r *http.Request, lxcpath string, m *Manifest) ([]*planStep, *apiError) {
+	p := principalFromContext(r.Context())
+
+	var steps []*planStep
+	for _, c := range m.Containers {
+		s, e := planContainer(r, lxcpath, c)
+		if e != nil {
+			return nil, e
+		}
+		steps = append(steps, s...)
+	}
+
+	if m.Prune != nil {
+		names, err := driver.List(lxcpath)
+		if err != nil {
+			return nil, driverError(err)
+		}
+
+		listed := make(map[string]bool)
+		for _, c := range m.Containers {
+			listed[c.Name] = true
+		}
+
+		force := m.Prune.Force
+		for _, name := range policy.Filter(p, lxcpath, names) {
+			if listed[name] {
+				continue
+			}
+			name := name
+			steps = append(steps, &planStep{
+				PlanAction: PlanAction{Container: name, Action: actionDestroy},
+				run:        func() *apiError { return destroyContainer(r, lxcpath, name, force) },
+			})
+		}
+	}
+
+	for _, s := range steps {
+		if s.Action == actionDeleteSnapshot && !p.HasScope(scopeSnapshots) {
+			err := fmt.Errorf("%s scope required to delete snapshots", scopeSnapshots)
+			return nil, &apiError{err, err.Error(), http.StatusForbidden}
+		}
+	}
+
+	return steps, nil
+}
+
+// planContainer returns the steps bringing container c of lxcpath to what
+// it describes
+func planContainer(r *http.Request, lxcpath string, c ManifestContainer) ([]*planStep, *apiError) {
+	opts, profile, err := mergeProfiles(c.ContainerTemplate)
+	if err != nil {
+		return nil, &apiError{err, err.Error(), 400}
+	}
+	items := mergeConfig(profile.Config, c.Config)
+	name := c.Name
+
+	var steps []*planStep
+	add := func(action string, changes []string, run func() *apiError) {
+		steps = append(steps, &planStep{
+			PlanAction: PlanAction{Container: name, Action: action, Changes: changes},
+			run:        run,
+		})
+	}
+
+	// Containers the principal cannot access are planned as missing, for
+	// their creation to fail as when they are not listed
+	state, err := driver.State(lxcpath, name)
+	if err == nil && !policy.CanAccess(principalFromContext(r.Context()), lxcpath, name) {
+		err = fmt.Errorf("%w: %q", errNotDefined, name)
+	}
+
+	if errors.Is(err, errNotDefined) {
+		create := opts
+		create.Started = false
+		steps = append(steps, &planStep{
+			PlanAction: PlanAction{Container: name, Action: actionCreate},
+			run:        func() *apiError { return createContainer(r, lxcpath, create) },
+		})
+
+		// The items of the profiles are set on creation
+		if len(c.Config) > 0 {
+			add(actionConfigure, configChanges(c.Config, nil), func() *apiError {
+				return setConfig(r, lxcpath, name, c.Config)
+			})
+		}
+
+		if opts.Started {
+			add(actionStart, nil, func() *apiError { return lockedRun(r, "start", lxcpath, name, driver.Start) })
+		}
+		return steps, nil
+	}
+	if err != nil {
+		return nil, driverError(err)
+	}
+
+	current := func(key string) []string {
+		values, _ := driver.ConfigItem(lxcpath, name, key)
+		return values
+	}
+	changes := configChanges(items, current)
+
+	limits, err := containerLimits(lxcpath, name)
+	if err != nil {
+		return nil, driverError(err)
+	}
+	changes = append(changes, limitChanges(limits, opts.Limits)...)
+
+	md, err := readMetadata(lxcpath, name)
+	if err != nil {
+		return nil, &apiError{err, err.Error(), 500}
+	}
+	patch := &ContainerPatch{Labels: valueChanges(md.Labels, opts.Labels), Annotations: valueChanges(md.Annotations, opts.Annotations)}
+	var metadataChanges []string
+	for key := range patch.Labels {
+		metadataChanges = append(metadataChanges, fmt.Sprintf("labels.%s: %s -> %s", key, md.Labels[key], opts.Labels[key]))
+	}
+	for key := range patch.Annotations {
+		metadataChanges = append(metadataChanges, fmt.Sprintf("annotations.%s: %s -> %s", key, md.Annotations[key], opts.Annotations[key]))
+	}
+	sort.Strings(metadataChanges)
+	changes = append(changes, metadataChanges...)
+
+	if len(changes) > 0 {
+		steps = append(steps, &planStep{
+			PlanAction: PlanAction{Container: name, Action: actionConfigure, Changes: changes},
+			run: func() *apiError {
+				if e := setConfig(r, lxcpath, name, items); e != nil {
+					return e
+				}
+				if len(patch.Labels) > 0 || len(patch.Annotations) > 0 {
+					if e := patchMetadata(r, lxcpath, name, patch); e != nil {
+						return e
+					}
+				}
+				if limits == opts.Limits {
+					return nil
+				}
+				return changeLimits(r, lxcpath, name, opts.Limits)
+			},
+		})
+	}
+
+	running := state == "RUNNING" || state == "FROZEN"
+	switch {
+	case opts.Started && !running:
+		add(actionStart, nil, func() *apiError { return lockedRun(r, "start", lxcpath, name, driver.Start) })
+	case !opts.Started && running:
+		add(actionStop, nil, func() *apiError { return lockedRun(r, "stop", lxcpath, name, driver.Stop) })
+	}
+
+	if c.Snapshots > 0 {
+		snapshots, err := driver.Snapshots(lxcpath, name)
+		if err != nil {
+			return nil, driverError(err)
+		}
+
+		if extra := len(snapshots) - c.Snapshots; extra > 0 {
+			sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].Timestamp < snapshots[j].Timestamp })
+
+			var old []string
+			for _, s := range snapshots[:extra] {
+				old = append(old, s.Name)
+			}
+			add(actionDeleteSnapshot, old, func() *apiError {
+				return lockedRun(r, "destroy snapshot", lxcpath, name, func(lxcpath string, name string) error {
+					for _, snapshot := range old {
+						if err := driver.DestroySnapshot(lxcpath, name, snapshot); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+			})
+		}
+	}
+
+	return steps, nil
+}
+
+// configChanges returns the changes setting entries makes, current
+// returning the values of a key. Items of list keys are added, the others
+// replace the value of their key.
+func configChanges(entries []ConfigEntry, current func(key string) []string) []string {
+	var changes []string
+	for _, entry := range entries {
+		var values []string
+		if current != nil {
+			values = current(entry.Key)
+		}
+
+		if listKeys[entry.Key] {
+			if !containsString(values, entry.Value) {
+				changes = append(changes, fmt.Sprintf("%s: + %s", entry.Key, entry.Value))
+			}
+			continue
+		}
+
+		old := ""
+		if len(values) > 0 {
+			old = values[len(values)-1]
+		}
+		if old != entry.Value {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", entry.Key, old, entry.Value))
+		}
+	}
+	return changes
+}
+
+// limitChanges returns the changes from limits current to wanted
+func limitChanges(current ContainerLimits, wanted ContainerLimits) []string {
+	var changes []string
+	for _, l := range []struct {
+		name     string
+		from, to float64
+	}{
+		{"memory_bytes", float64(current.MemoryBytes), float64(wanted.MemoryBytes)},
+		{"cpus", current.CPUs, wanted.CPUs},
+		{"disk_bytes", float64(current.DiskBytes), float64(wanted.DiskBytes)},
+	} {
+		if l.from != l.to {
+			changes = append(changes, fmt.Sprintf("limits.%s: %s -> %s", l.name, formatAmount(l.from), formatAmount(l.to)))
+		}
+	}
+	return changes
+}
+
+// valueChanges returns the entries of wanted that current does not have,
+// as a patch of current. Entries wanted does not list are left as they
+// are.
+func valueChanges(current map[string]string, wanted map[string]string) map[string]*string {
+	changes := make(map[string]*string)
+	for key, value := range wanted {
+		if old, ok := current[key]; !ok || old != value {
+			value := value
+			changes[key] = &value
+		}
+	}
+	return changes
+}
+
+// setConfig sets the configuration items of entries on container name of
+// lxcpath which it does not have yet
+func setConfig(r *http.Request, lxcpath string, name string, entries []ConfigEntry) *apiError {
+	return lockedRun(r, "configure", lxcpath, name, func(lxcpath string, name string) error {
+		for _, entry := range entries {
+			values, err := driver.ConfigItem(lxcpath, name, entry.Key)
+			if err != nil {
+				return err
+			}
+			if len(configChanges([]ConfigEntry{entry}, func(string) []string { return values })) == 0 {
+				continue
+			}
+
+			// Keys holding a value are cleared, not to add up
+			if !listKeys[entry.Key] {
+				if err := driver.SetConfigItem(lxcpath, name, entry.Key, ""); err != nil {
+					return fmt.Errorf("%s: %w", entry.Key, err)
+				}
+			}
+			if err := driver.SetConfigItem(lxcpath, name, entry.Key, entry.Value); err != nil {
+				return fmt.Errorf("%s: %w", entry.Key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// lockedRun runs fn on container name of lxcpath under its lock, failing
+// as the lock does when it cannot be taken
+func lockedRun(r *http.Request, op string, lxcpath string, name string, fn func(lxcpath string, name string) error) *apiError {
+	unlock, e := locks.lock(r.Context(), op, lxcpath, name)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	if err := fn(lxcpath, name); err != nil {
+		return driverError(err)
+	}
+	return nil
+}
+
+// PostApply brings the containers of a storage root to what the manifest
+// of the request describes, or only plans it when dry_run is set, and
+// replies with the actions
+func PostApply(w http.ResponseWriter, r *http.Request) *apiError {
+	dryRun := false
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			err := errors.New("invalid dry_run parameter " + value)
+			return &apiError{err, err.Error(), 400}
+		}
+	}
+
+	// Bodies are bounded here too, for when validation is disabled
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		return &apiError{err, err.Error(), http.StatusRequestEntityTooLarge}
+	}
+
+	m, err := decodeManifest(r, data)
+	if errors.Is(err, errConfigNotAllowed) {
+		return driverError(err)
+	} else if err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	lxcpath, e := requestRoot(r)
+	if e != nil {
+		return e
+	}
+
+	steps, e := plan(r, lxcpath, m)
+	if e != nil {
+		return e
+	}
+
+	var names []string
+	for _, s := range steps {
+		if !containsString(names, s.Container) {
+			names = append(names, s.Container)
+		}
+	}
+	setContainers(r.Context(), names)
+
+	result := &Plan{DryRun: dryRun, Actions: []PlanAction{}}
+	failed := make(map[string]bool)
+
+	for _, s := range steps {
+		switch {
+		case dryRun:
+			s.Status = actionPlanned
+		case failed[s.Container]:
+			s.Status = actionSkipped
+		default:
+			if e := s.run(); e != nil {
+				s.Status, s.Error, s.Code = actionFailed, e.Message, errorCode(e)
+				failed[s.Container] = true
+			} else {
+				s.Status = actionDone
+			}
+		}
+		result.Actions = append(result.Actions, s.PlanAction)
+	}
+
+	return writeJSON(w, http.StatusOK, result)
+}
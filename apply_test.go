@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// planSummary returns the container, action and status of each action of
+// p
+func planSummary(p Plan) [][3]string {
+	summary := [][3]string{}
+	for _, a := range p.Actions {
+		summary = append(summary, [3]string{a.Container, a.Action, a.Status})
+	}
+	return summary
+}
+
+func TestApply(t *testing.T) {
+	api := newTestAPI(t)
+	ci := api.token(t, "ci", []string{scopeContainersRead, scopeContainersWrite, scopeSnapshots}, nil)
+
+	for _, name := range []string{"old", "db"} {
+		status, body := api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: name, Started: true})
+		expectStatus(t, status, 201, body)
+	}
+	status, body := api.do(t, "POST", "/v1/containers/db/stop", ci, nil)
+	expectStatus(t, status, 200, body)
+	for i := 0; i < 3; i++ {
+		status, body = api.do(t, "POST", "/v1/containers/db/snapshots", ci, nil)
+		expectStatus(t, status, 201, body)
+	}
+
+	manifest := `
+containers:
+  - name: web
+    started: true
+    template: {Distro: alpine}
+    limits: {cpus: 1}
+    config:
+      - {key: lxc.start.auto, value: "1"}
+  - name: db
+    started: true
+    snapshots: 1
+    config:
+      - {key: lxc.start.auto, value: "1"}
+prune: {force: true}
+`
+
+	req := api.request(t, "POST", "/v1/apply?dry_run=true", ci, manifest)
+	req.Header.Set("Content-Type", "application/yaml")
+	resp, body := api.roundTrip(t, req)
+	expectStatus(t, resp.StatusCode, 200, body)
+
+	var p Plan
+	decode(t, body, &p)
+
+	want := [][3]string{
+		{"web", actionCreate, actionPlanned},
+		{"web", actionConfigure, actionPlanned},
+		{"web", actionStart, actionPlanned},
+		{"db", actionConfigure, actionPlanned},
+		{"db", actionStart, actionPlanned},
+		{"db", actionDeleteSnapshot, actionPlanned},
+		{"old", actionDestroy, actionPlanned},
+	}
+	if got := planSummary(p); !p.DryRun || !reflect.DeepEqual(got, want) {
+		t.Fatalf("plan %v, want %v", got, want)
+	}
+	if changes := p.Actions[5].Changes; !reflect.DeepEqual(changes, []string{"snap0", "snap1"}) {
+		t.Errorf("snapshots deleted %v", changes)
+	}
+
+	// Nothing changed on a dry run
+	status, body = api.do(t, "GET", "/v1/containers/web", ci, nil)
+	expectError(t, status, 404, body, "not_defined")
+
+	req = api.request(t, "POST", "/v1/apply", ci, manifest)
+	req.Header.Set("Content-Type", "application/yaml")
+	resp, body = api.roundTrip(t, req)
+	expectStatus(t, resp.StatusCode, 200, body)
+
+	p = Plan{}
+	decode(t, body, &p)
+	for i := range want {
+		want[i][2] = actionDone
+	}
+	if got := planSummary(p); p.DryRun || !reflect.DeepEqual(got, want) {
+		t.Fatalf("results %v, want %v", got, want)
+	}
+
+	var c Container
+	status, body = api.do(t, "GET", "/v1/containers/web", ci, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &c)
+	if c.State != "RUNNING" {
+		t.Errorf("web is %s", c.State)
+	}
+	if values, _ := driver.ConfigItem(config.LXCPath, "web", "lxc.start.auto"); !reflect.DeepEqual(values, []string{"1"}) {
+		t.Errorf("lxc.start.auto %q", values)
+	}
+
+	var snapshots Snapshots
+	status, body = api.do(t, "GET", "/v1/containers/db/snapshots", ci, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &snapshots)
+	if len(snapshots.Snapshots) != 1 || snapshots.Snapshots[0].Name != "snap2" {
+		t.Errorf("snapshots kept %s", body)
+	}
+
+	status, body = api.do(t, "GET", "/v1/containers/old", ci, nil)
+	expectError(t, status, 404, body, "not_defined")
+
+	// Applying again has nothing left to do
+	req = api.request(t, "POST", "/v1/apply", ci, manifest)
+	req.Header.Set("Content-Type", "application/yaml")
+	resp, body = api.roundTrip(t, req)
+	expectStatus(t, resp.StatusCode, 200, body)
+
+	p = Plan{}
+	decode(t, body, &p)
+	if len(p.Actions) != 0 {
+		t.Errorf("actions on the second apply %v", planSummary(p))
+	}
+}
+
+func TestApplyFailures(t *testing.T) {
+	api := newTestAPI(t)
+	ci := api.token(t, "ci", []string{scopeContainersRead, scopeContainersWrite}, nil)
+
+	config.Quotas = map[string]Quota{"team-a": {Containers: 1}}
+	status, body := api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "a-1"})
+	expectStatus(t, status, 201, body)
+
+	// Actions following a failed one on the same container are skipped,
+	// the others run
+	m := `{"containers": [{"name": "a-2", "started": true}, {"name": "b-1"}]}`
+	status, body = api.do(t, "POST", "/v1/apply", ci, m)
+	expectStatus(t, status, 200, body)
+
+	var p Plan
+	decode(t, body, &p)
+	want := [][3]string{
+		{"a-2", actionCreate, actionFailed},
+		{"a-2", actionStart, actionSkipped},
+		{"b-1", actionCreate, actionDone},
+	}
+	if got := planSummary(p); !reflect.DeepEqual(got, want) {
+		t.Fatalf("results %v, want %v", got, want)
+	}
+	if p.Actions[0].Code != "quota_exceeded" || p.Actions[0].Error == "" {
+		t.Errorf("unexpected failure %+v", p.Actions[0])
+	}
+
+	// Snapshots are only deleted with the snapshots scope
+	m = `{"containers": [{"name": "b-1", "snapshots": 1}]}`
+	status, body = api.do(t, "POST", "/v1/containers/b-1/snapshots", api.admin, nil)
+	expectStatus(t, status, 201, body)
+	status, body = api.do(t, "POST", "/v1/containers/b-1/snapshots", api.admin, nil)
+	expectStatus(t, status, 201, body)
+
+	status, body = api.do(t, "POST", "/v1/apply?dry_run=true", ci, m)
+	expectError(t, status, 403, body, "forbidden")
+
+	m = `{"containers": [{"name": "b-1"}, {"name": "b-1"}]}`
+	status, body = api.do(t, "POST", "/v1/apply", ci, m)
+	expectError(t, status, 400, body, "bad_request")
+
+	req := api.request(t, "POST", "/v1/apply", ci, "containers: [")
+	req.Header.Set("Content-Type", "application/yaml")
+	resp, body := api.roundTrip(t, req)
+	expectError(t, resp.StatusCode, 400, body, "bad_request")
+
+	// Actions on locked containers fail as busy
+	locks.timeout = 0
+	unlock, e := locks.lock(context.Background(), "snapshot", config.LXCPath, "b-1")
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+	status, body = api.do(t, "POST", "/v1/apply", ci, `{"containers": [{"name": "b-1", "started": true}]}`)
+	unlock()
+	expectStatus(t, status, 200, body)
+
+	p = Plan{}
+	decode(t, body, &p)
+	if len(p.Actions) != 1 || p.Actions[0].Status != actionFailed || p.Actions[0].Code != "container_busy" {
+		t.Errorf("unexpected plan %s", body)
+	}
+
+	// Manifests are bounded without validation, nor audit, as well
+	validator = nil
+	defer func(l *auditLog) { audit = l }(audit)
+	audit = nil
+	api.router = newRouter()
+	api.server.Config.Handler = api.router
+
+	status, body = api.do(t, "POST", "/v1/apply", ci, `{"containers": [], "padding": "`+strings.Repeat("x", maxBodySize)+`"}`)
+	expectError(t, status, 413, body, "too_large")
+
+	status, body = api.do(t, "POST", "/v1/apply?dry_run=maybe", ci, `{"containers": []}`)
+	expectError(t, status, 400, body, "bad_request")
+}
+
+func TestApplyConfigNotAllowed(t *testing.T) {
+	api := newTestAPI(t)
+	ci := api.token(t, "ci", []string{scopeContainersRead, scopeContainersWrite}, nil)
+
+	manifests := []string{
+		`{"containers": [{"name": "c1", "config": [{"key": "lxc.hook.pre-start", "value": "/tmp/run"}]}]}`,
+		`{"containers": [{"name": "c1", "config": [{"key": "lxc.mount.entry", "value": "/ host none rbind 0 0"}]}]}`,
+	}
+	for _, m := range manifests {
+		status, body := api.do(t, "POST", "/v1/apply", ci, m)
+		expectError(t, status, 422, body, "config_not_allowed")
+	}
+
+	if _, err := driver.State(config.LXCPath, "c1"); err == nil {
+		t.Error("c1 created")
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// auditFile, in the state directory, is the default audit log
+const auditFile = "audit.log"
+
+// Number of records GET /v1/audit returns by default, and at most
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// redacted replaces the secrets of the recorded parameters
+const redacted = "[REDACTED]"
+
+// auditedMethods are the methods of mutating requests
+var auditedMethods = map[string]bool{
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// secretKeys are parts of the names of parameters redacted from the audit
+// log
+var secretKeys = []string{"secret", "password", "passphrase", "token", "key"}
+
+// audit records the mutating requests, nil when auditing is disabled
+var audit *auditLog
+
+// AuditRecord model
+// swagger:model AuditRecord
+type AuditRecord struct {
+	// Position of the record in the log, from 1
+	// example: 42
+	Seq uint64 `json:"seq"`
+
+	// When the request was served
+	// example: 2021-03-04T10:00:00Z
+	Time time.Time `json:"time"`
+
+	// Request ID, as in the X-Request-ID response header
+	// example: 4f9d2c1be07a53d8e1c4a0b9d6f2e817
+	RequestID string `json:"request_id"`
+
+	// Authenticated principal, empty for anonymous requests
+	// example: ci
+	Principal string `json:"principal"`
+
+	// Client IP address, or unix and the user ID of socket clients
+	// example: 192.0.2.10
+	Source string `json:"source"`
+
+	// example: POST
+	Method string `json:"method"`
+
+	// Route template, empty when no route matched
+	// example: /v1/containers/{name}/exec
+	Route string `json:"route"`
+
+	// example: /v1/containers/web/exec
+	Path string `json:"path"`
+
+	// Storage root of the container, empty for the default one
+	// example: fast
+	Root string `json:"root,omitempty"`
+
+	// Container the request is about
+	// example: web
+	Container string `json:"container,omitempty"`
+
+	// Containers acted on by batches and applies
+	// example: ["web-1", "web-2"]
+	Containers []string `json:"containers,omitempty"`
+
+	// Query parameters
+	Query map[string]string `json:"query,omitempty"`
+
+	// Request body, secrets redacted
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+
+	// Response status
+	// example: 200
+	Status int `json:"status"`
+
+	// success or failure
+	// enum: success,failure
+	// example: success
+	Outcome string `json:"outcome"`
+
+	// Error code of failures
+	// example: already_running
+	Code string `json:"code,omitempty"`
+
+	// Response replayed for a retry having the same Idempotency-Key
+	Replayed bool `json:"replayed,omitempty"`
+
+	// Hash of the previous record, empty for the first one
+	// example: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+	PrevHash string `json:"prev_hash"`
+
+	// SHA-256 of the record, without this field
+	// example: 60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752
+	Hash string `json:"hash,omitempty"`
+}
+
+// AuditRecords model
+// swagger:model AuditRecords
+type AuditRecords struct {
+	// Matching records, oldest first
+	Records []AuditRecord `json:"records"`
+
+	// More records matched than returned, the most recent ones are
+	Truncated bool `json:"truncated"`
+}
+
+// auditLog appends hash-chained records to a file, one JSON object per
+// line. Each record holds the hash of the previous one, so changing,
+// inserting or removing a record breaks the chain from there on.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	seq  uint64
+	hash string
+	size int64 // bytes written, up to the end of the last record
+}
+
+// openAuditLog opens the audit log at path for appending, creating it
+// when needed. The chain goes on from the last record.
+func openAuditLog(path string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	l := &auditLog{path: path}
+
+	err := readAuditLog(path, func(line int, data []byte) error {
+		var rec AuditRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("%s: line %d: %v, check it with -verify-audit", path, line, err)
+		}
+		l.seq, l.hash = rec.Seq, rec.Hash
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := l.file.Stat()
+	if err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	l.size = info.Size()
+
+	return l, nil
+}
+
+func (l *auditLog) Close() error {
+	return l.file.Close()
+}
+
+// append chains rec to the log and writes it
+func (l *auditLog) append(rec *AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec.Seq = l.seq + 1
+	rec.PrevHash = l.hash
+	rec.Hash = ""
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	rec.Hash = auditHash(data)
+
+	// The hash is the last field, added to the object it was computed over
+	line := append(data[:len(data)-1], `,"hash":"`+rec.Hash+`"}`+"\n"...)
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.seq, l.hash = rec.Seq, rec.Hash
+	return nil
+}
+
+func auditHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditFilter selects the records returned by GET /v1/audit
+type auditFilter struct {
+	since     time.Time
+	until     time.Time
+	container string
+	principal string
+	limit     int
+}
+
+func (f *auditFilter) match(rec *AuditRecord) bool {
+	return (f.since.IsZero() || !rec.Time.Before(f.since)) &&
+		(f.until.IsZero() || rec.Time.Before(f.until)) &&
+		(f.container == "" || rec.Container == f.container || containsString(rec.Containers, f.container)) &&
+		(f.principal == "" || rec.Principal == f.principal)
+}
+
+// records returns the most recent records matching f, and whether older
+// ones were left out
+func (l *auditLog) records(f *auditFilter) ([]AuditRecord, bool, error) {
+	// Records appended meanwhile are left out rather than read
+	// half-written, without holding up the requests appending them
+	l.mu.Lock()
+	size := l.size
+	l.mu.Unlock()
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	records := []AuditRecord{}
+	truncated := false
+
+	err = scanAuditLog(io.LimitReader(file, size), func(line int, data []byte) error {
+		var rec AuditRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+
+		if f.match(&rec) {
+			if len(records) == f.limit {
+				records = append(records[:0], records[1:]...)
+				truncated = true
+			}
+			records = append(records, rec)
+		}
+		return nil
+	})
+
+	return records, truncated, err
+}
+
+// readAuditLog calls fn with each line of the audit log at path
+func readAuditLog(path string, fn func(line int, data []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return scanAuditLog(f, fn)
+}
+
+// scanAuditLog calls fn with each line read from rd
+func scanAuditLog(rd io.Reader, fn func(line int, data []byte) error) error {
+	r := bufio.NewReader(rd)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if len(data) > 0 {
+			if err := fn(line, bytes.TrimSuffix(data, []byte("\n"))); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// verifyAuditLog checks the hash chain of the audit log at path, and
+// returns its number of records. The error tells the first record breaking
+// the chain. Records removed from the end of the log go unnoticed.
+func verifyAuditLog(path string) (uint64, error) {
+	var seq uint64
+	var hash string
+
+	err := readAuditLog(path, func(line int, data []byte) error {
+		var rec AuditRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+
+		suffix := `,"hash":"` + rec.Hash + `"}`
+		if !bytes.HasSuffix(data, []byte(suffix)) {
+			return fmt.Errorf("line %d: hash is not the last field", line)
+		}
+		payload := append(data[:len(data)-len(suffix):len(data)-len(suffix)], '}')
+
+		switch {
+		case rec.Seq != seq+1:
+			return fmt.Errorf("line %d: record %d follows record %d", line, rec.Seq, seq)
+		case rec.PrevHash != hash:
+			return fmt.Errorf("line %d: record %d does not chain to record %d", line, rec.Seq, seq)
+		case auditHash(payload) != rec.Hash:
+			return fmt.Errorf("line %d: record %d was modified", line, rec.Seq)
+		}
+
+		seq, hash = rec.Seq, rec.Hash
+		return nil
+	})
+
+	return seq, err
+}
+
+// withAudit records the mutating requests, once served, in the audit log.
+// It runs before authenticate, for rejected credentials to be recorded too.
+func (l *auditLog) withAudit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auditedMethods[r.Method] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			writeError(w, r, &apiError{err, err.Error(), http.StatusRequestEntityTooLarge})
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		record := auditRecord(r, data, rec)
+		if err := l.append(record); err != nil {
+			logger.Error("audit record not written", "error", err,
+				"method", record.Method, "path", record.Path, "principal", record.Principal,
+				"status", record.Status, "request_id", record.RequestID)
+		}
+	})
+}
+
+// auditRecord returns the record of r, having body, and its response
+func auditRecord(r *http.Request, body []byte, resp *responseRecorder) *AuditRecord {
+	rec := &AuditRecord{
+		Time:      time.Now().UTC(),
+		RequestID: requestIDFromContext(r.Context()),
+		Source:    requestSource(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Root:      r.URL.Query().Get("root"),
+		Status:    resp.status,
+		Outcome:   "success",
+		Replayed:  resp.Header().Get(idempotentReplayedHeader) == "true",
+	}
+
+	if entry := accessEntryFromContext(r.Context()); entry != nil {
+		rec.Principal = entry.principal
+		rec.Containers = entry.containers
+	}
+
+	if current := mux.CurrentRoute(r); current != nil {
+		rec.Route, _ = current.GetPathTemplate()
+	}
+
+	if query := r.URL.Query(); len(query) > 0 {
+		rec.Query = make(map[string]string, len(query))
+		for name := range query {
+			rec.Query[name] = query.Get(name)
+		}
+	}
+
+	// Bodies which are not JSON objects are rejected, there is nothing
+	// to record of them. YAML ones are recorded as JSON.
+	if isYAML(r) {
+		body, _ = yamlToJSON(body)
+	}
+	var params map[string]interface{}
+	if json.Unmarshal(body, &params) == nil && len(params) > 0 {
+		rec.Parameters = redactParameters(params).(map[string]interface{})
+	}
+
+	vars := mux.Vars(r)
+	rec.Container = vars["name"]
+	if rec.Container == "" {
+		rec.Container = vars["container"]
+	}
+	if rec.Container == "" && (rec.Route == "/v1/containers" || rec.Route == "/create") {
+		rec.Container, _ = params["name"].(string)
+	}
+
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+	if rec.Status >= 400 {
+		rec.Outcome = "failure"
+
+		var problem Problem
+		if json.Unmarshal(resp.body.Bytes(), &problem) == nil {
+			rec.Code = problem.Code
+		}
+	}
+
+	return rec
+}
+
+// requestSource returns the client IP address of r, or unix and the user
+// ID of unix socket clients
+func requestSource(r *http.Request) string {
+	if cred := peerCredFromContext(r.Context()); cred != nil {
+		return "unix:uid=" + strconv.Itoa(cred.UID)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// redactParameters returns v, with the values of secret-looking keys and
+// of environment variables replaced
+func redactParameters(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			switch {
+			case isSecretKey(key):
+				v[key] = redacted
+			case key == "env":
+				v[key] = redactEnv(value)
+			default:
+				v[key] = redactParameters(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactParameters(value)
+		}
+	}
+	return v
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactEnv keeps the names of KEY=value environment variables only
+func redactEnv(v interface{}) interface{} {
+	list, ok := v.([]interface{})
+	if !ok {
+		return redacted
+	}
+
+	for i, value := range list {
+		s, _ := value.(string)
+		name := strings.SplitN(s, "=", 2)[0]
+		list[i] = name + "=" + redacted
+	}
+	return list
+}
+
+// GetAudit returns the audit records matching the since, until, container
+// and principal query parameters
+func GetAudit(w http.ResponseWriter, r *http.Request) *apiError {
+	if audit == nil {
+		err := errors.New("audit log disabled")
+		return &apiError{err, err.Error(), http.StatusNotFound}
+	}
+
+	query := r.URL.Query()
+	f := &auditFilter{
+		container: query.Get("container"),
+		principal: query.Get("principal"),
+		limit:     defaultAuditLimit,
+	}
+
+	for name, t := range map[string]*time.Time{"since": &f.since, "until": &f.until} {
+		if value := query.Get(name); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				err := fmt.Errorf("invalid %s parameter %s, want an RFC 3339 time", name, value)
+				return &apiError{err, err.Error(), 400}
+			}
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			err := fmt.Errorf("invalid limit parameter %s, want 1 to %d", value, maxAuditLimit)
+			return &apiError{err, err.Error(), 400}
+		}
+		f.limit = limit
+	}
+
+	records, truncated, err := audit.records(f)
+	if err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	return writeJSON(w, http.StatusOK, &AuditRecords{Records: records, Truncated: truncated})
+}
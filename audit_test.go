@@ -0,0 +1,251 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// auditRecords returns the records GET /v1/audit?query returns
+func (api *testAPI) auditRecords(t *testing.T, query string) AuditRecords {
+	t.Helper()
+
+	status, body := api.do(t, "GET", "/v1/audit?"+query, api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	var records AuditRecords
+	decode(t, body, &records)
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	api := newTestAPI(t)
+
+	resp, body := api.send(t, "POST", "/v1/containers?root=fast", api.admin, ContainerTemplate{Name: "c1", Started: true})
+	expectStatus(t, resp.StatusCode, 201, body)
+
+	status, body := api.do(t, "POST", "/v1/containers/c1/exec?root=fast", api.admin,
+		ExecCommand{Args: []string{"env"}, Env: []string{"DB_PASSWORD=hunter2"}})
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/start?root=fast", api.admin, nil)
+	expectError(t, status, 409, body, "already_running")
+
+	status, body = api.do(t, "DELETE", "/v1/containers/c1", "", nil)
+	expectError(t, status, 401, body, "unauthorized")
+
+	status, body = api.do(t, "PUT", "/v1/admin/log-level", api.admin, map[string]string{"level": "info", "api_key": "s3cr3t"})
+	expectError(t, status, 422, body, "validation_failed")
+
+	// Reads are not recorded
+	api.do(t, "GET", "/v1/containers/c1?root=fast", api.admin, nil)
+
+	records := api.auditRecords(t, "").Records
+	if len(records) != 5 {
+		t.Fatalf("%d records, want 5: %+v", len(records), records)
+	}
+
+	create := records[0]
+	if create.Seq != 1 || create.PrevHash != "" || create.Principal != "admin" || create.Source != "127.0.0.1" ||
+		create.Method != "POST" || create.Route != "/v1/containers" || create.Container != "c1" || create.Root != "fast" ||
+		create.Status != 201 || create.Outcome != "success" || create.Code != "" ||
+		create.RequestID != resp.Header.Get(requestIDHeader) || create.Parameters["started"] != true {
+		t.Errorf("unexpected create record %+v", create)
+	}
+
+	exec := records[1]
+	env, _ := exec.Parameters["env"].([]interface{})
+	if exec.Container != "c1" || len(env) != 1 || env[0] != "DB_PASSWORD="+redacted {
+		t.Errorf("environment not redacted: %+v", exec)
+	}
+
+	if start := records[2]; start.Outcome != "failure" || start.Status != 409 || start.Code != "already_running" {
+		t.Errorf("unexpected start record %+v", start)
+	}
+
+	if destroy := records[3]; destroy.Principal != "" || destroy.Code != "unauthorized" || destroy.Route != "/v1/containers/{name}" {
+		t.Errorf("unexpected anonymous destroy record %+v", destroy)
+	}
+
+	if level := records[4]; level.Parameters["api_key"] != redacted || level.Parameters["level"] != "info" {
+		t.Errorf("parameters not redacted: %+v", level.Parameters)
+	}
+
+	for i := 1; i < len(records); i++ {
+		if records[i].PrevHash != records[i-1].Hash {
+			t.Errorf("record %d does not chain to record %d", records[i].Seq, records[i-1].Seq)
+		}
+	}
+
+	n, err := verifyAuditLog(filepath.Join(config.StateDir, auditFile))
+	if err != nil || n != 5 {
+		t.Errorf("verify: %d records, %v", n, err)
+	}
+}
+
+func TestAuditFilters(t *testing.T) {
+	api := newTestAPI(t)
+	ci := api.token(t, "ci", []string{scopeContainersWrite}, nil)
+	auditor := api.token(t, "auditor", []string{scopeAudit}, nil)
+
+	for _, name := range []string{"c1", "c2", "c3"} {
+		status, body := api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: name})
+		expectStatus(t, status, 201, body)
+	}
+	status, body := api.do(t, "DELETE", "/v1/containers/c1", api.admin, nil)
+	expectStatus(t, status, 204, body)
+
+	if records := api.auditRecords(t, "container=c1").Records; len(records) != 2 ||
+		records[0].Method != "POST" || records[1].Method != "DELETE" {
+		t.Errorf("unexpected c1 records %+v", records)
+	}
+
+	if records := api.auditRecords(t, "principal=admin").Records; len(records) != 1 || records[0].Container != "c1" {
+		t.Errorf("unexpected admin records %+v", records)
+	}
+
+	records := api.auditRecords(t, "limit=2")
+	if len(records.Records) != 2 || !records.Truncated || records.Records[0].Container != "c3" {
+		t.Errorf("unexpected most recent records %+v", records)
+	}
+
+	all := api.auditRecords(t, "").Records
+	since := url.QueryEscape(all[1].Time.Format(time.RFC3339Nano))
+	until := url.QueryEscape(all[3].Time.Format(time.RFC3339Nano))
+	if records := api.auditRecords(t, "since="+since+"&until="+until).Records; len(records) != 2 ||
+		records[0].Seq != all[1].Seq || records[1].Seq != all[2].Seq {
+		t.Errorf("unexpected time range records %+v", records)
+	}
+
+	if records := api.auditRecords(t, "until=2000-01-01T00:00:00Z").Records; len(records) != 0 {
+		t.Errorf("records before 2000: %+v", records)
+	}
+
+	status, body = api.do(t, "GET", "/v1/audit?since=yesterday", api.admin, nil)
+	expectError(t, status, 400, body, "bad_request")
+
+	status, body = api.do(t, "GET", "/v1/audit", ci, nil)
+	expectError(t, status, 403, body, "forbidden")
+
+	status, body = api.do(t, "GET", "/v1/audit?container=c2", auditor, nil)
+	expectStatus(t, status, 200, body)
+
+	// Batches record the containers their selector resolved to
+	status, body = api.do(t, "POST", "/v1/containers:batch", ci, `{"action": "destroy", "selector": {"name": "c*"}}`)
+	expectStatus(t, status, 200, body)
+
+	records = api.auditRecords(t, "container=c3")
+	batch := records.Records[len(records.Records)-1]
+	if batch.Route != "/v1/containers:batch" || batch.Container != "" ||
+		!reflect.DeepEqual(batch.Containers, []string{"c2", "c3"}) {
+		t.Errorf("unexpected batch record %+v", batch)
+	}
+}
+
+func TestAuditVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxc-go-http-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, auditFile)
+
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"c1", "c2"} {
+		if err := l.append(&AuditRecord{Method: "POST", Container: name, Status: 201, Outcome: "success"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	// The chain goes on across restarts
+	l, err = openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.append(&AuditRecord{Method: "DELETE", Container: "c1", Status: 204, Outcome: "success"}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	if n, err := verifyAuditLog(path); n != 3 || err != nil {
+		t.Fatalf("verify: %d records, %v", n, err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"modified", []string{lines[0], strings.Replace(lines[1], `"c2"`, `"c9"`, 1), lines[2]}, "line 2: record 2 was modified"},
+		{"removed", []string{lines[0], lines[2]}, "line 2: record 3 follows record 1"},
+		{"reordered", []string{lines[1], lines[0], lines[2]}, "line 1: record 2 follows record 0"},
+		{"truncated", []string{lines[0], lines[1][:40]}, "line 2:"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tampered := filepath.Join(dir, test.name)
+			if err := ioutil.WriteFile(tampered, []byte(strings.Join(test.lines, "")), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := verifyAuditLog(tampered)
+			if err == nil || !strings.HasPrefix(err.Error(), test.want) {
+				t.Errorf("verify: %v, want %s", err, test.want)
+			}
+		})
+	}
+
+	// Renumbering records does not help, hashes chain them
+	renumbered := strings.Replace(lines[2], `"seq":3`, `"seq":2`, 1)
+	if err := ioutil.WriteFile(path, []byte(lines[0]+renumbered), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAuditLog(path); err == nil || !strings.Contains(err.Error(), "does not chain") {
+		t.Errorf("verify: %v, want a broken chain", err)
+	}
+}
+
+func TestAuditRecordsInFlight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxc-go-http-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	l, err := openAuditLog(filepath.Join(dir, auditFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, name := range []string{"c1", "c2"} {
+		if err := l.append(&AuditRecord{Method: "POST", Container: name, Status: 201, Outcome: "success"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A record being appended is past the end records reads up to
+	if _, err := l.file.Write([]byte(`{"seq":3,"method":"DEL`)); err != nil {
+		t.Fatal(err)
+	}
+
+	records, truncated, err := l.records(&auditFilter{limit: 10})
+	if err != nil || truncated || len(records) != 2 || records[1].Container != "c2" {
+		t.Errorf("records: %+v, %v, %v", records, truncated, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Scopes that can be granted to an API principal
+const (
+	scopeAdmin           = "admin"
+	scopeAudit           = "audit"
+	scopeContainersRead  = "containers:read"
+	scopeContainersWrite = "containers:write"
+	scopeExec            = "exec"
+	scopeProfiles        = "profiles"
+	scopeSnapshots       = "snapshots"
+	scopeTokens          = "tokens"
+)
+
+// knownScopes lists every scope accepted when a token is created
+var knownScopes = []string{
+	scopeAdmin,
+	scopeAudit,
+	scopeContainersRead,
+	scopeContainersWrite,
+	scopeExec,
+	scopeProfiles,
+	scopeSnapshots,
+	scopeTokens,
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	// ID identifies the principal whatever authenticated it: containers
+	// and operations are owned by it
+	ID string
+
+	Name   string
+	Groups []string
+	Scopes []string
+}
+
+// Prefixes of principal IDs, telling apart principals of the same name
+// authenticated differently
+const (
+	tokenPrincipal = "token:"
+	certPrincipal  = "cert:"
+	unixPrincipal  = "unix:"
+)
+
+// HasScope reports whether the principal was granted scope. The admin
+// scope implies every other one.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// InGroup reports whether the principal belongs to group. Admins belong
+// to every group.
+func (p *Principal) InGroup(group string) bool {
+	if p.HasScope(scopeAdmin) {
+		return true
+	}
+	for _, g := range p.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	if entry := accessEntryFromContext(ctx); entry != nil {
+		entry.principal = p.Name
+	}
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+func isKnownScope(scope string) bool {
+	for _, s := range knownScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate resolves the bearer token, the verified client
+// certificate or the unix socket peer credentials of the request, if any,
+// and stores the matching principal in the request context. Routes decide
+// through requireScope whether a principal is needed at all.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+			p := policy.Principal(certPrincipal+cn, cn, policy.Certificates[cn])
+			if p == nil {
+				unauthorized(w, r, errors.New("client certificate not authorized"))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+			return
+		}
+
+		if cred := peerCredFromContext(r.Context()); header == "" && cred != nil {
+			p := policy.peerPrincipal(cred)
+			if p == nil {
+				unauthorized(w, r, errors.New("unix socket client not authorized"))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+			return
+		}
+
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !strings.HasPrefix(header, "Bearer ") {
+			unauthorized(w, r, errors.New("unsupported authorization scheme"))
+			return
+		}
+
+		p, err := tokens.Authenticate(strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			unauthorized(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="lxc-go-http-api"`)
+	writeError(w, r, &apiError{err, err.Error(), http.StatusUnauthorized})
+}
+
+// requireScope wraps fn so that it is only called for principals holding
+// scope
+func requireScope(scope string, fn apiHandler) apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) *apiError {
+		p := principalFromContext(r.Context())
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lxc-go-http-api"`)
+			err := errors.New("authentication required")
+			return &apiError{err, err.Error(), http.StatusUnauthorized}
+		}
+
+		if !p.HasScope(scope) {
+			err := errors.New("missing scope " + scope)
+			return &apiError{err, err.Error(), http.StatusForbidden}
+		}
+
+		return fn(w, r)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+// Actions of batches
+const (
+	batchStart    = "start"
+	batchStop     = "stop"
+	batchFreeze   = "freeze"
+	batchSnapshot = "snapshot"
+	batchDestroy  = "destroy"
+)
+
+// Error policies of batches
+const (
+	onErrorContinue = "continue"
+	onErrorFailFast = "fail_fast"
+)
+
+// batchPending is the status of the containers of an operation whose
+// action did not run yet
+const batchPending = "pending"
+
+const (
+	// defaultBatchParallelism is the number of containers acted on at once
+	// when batches do not tell
+	defaultBatchParallelism = 4
+
+	maxBatchParallelism = 32
+
+	// maxBatchNames is the number of containers batches may name
+	maxBatchNames = 500
+
+	// batchAsyncThreshold is the number of containers from which batches
+	// run as operations, replied to before they are done
+	batchAsyncThreshold = 20
+)
+
+// BatchSelector model
+// swagger:model BatchSelector
+type BatchSelector struct {
+	// Pattern of container names, as in the access policy
+	// example: web-*
+	Name string `json:"name"`
+
+	// State of the containers
+	// enum: STOPPED,RUNNING,FROZEN
+	// example: RUNNING
+	State string `json:"state"`
+
+	// Group of the containers, set with lxc.group
+	// example: onboot
+	Group string `json:"group"`
+
+	// Label selector of the containers
+	// example: env=prod,team!=ml
+	Labels string `json:"labels"`
+}
+
+// Batch model
+// swagger:model Batch
+type Batch struct {
+	// required: true
+	// enum: start,stop,freeze,snapshot,destroy
+	// example: stop
+	Action string `json:"action"`
+
+	// Containers acted on, unless selector is set
+	// max items: 500
+	// items.minLength: 1
+	// example: ["web-1", "web-2"]
+	Names []string `json:"names"`
+
+	// Containers acted on, those the principal can access matching all its
+	// fields, unless names is set
+	Selector *BatchSelector `json:"selector,omitempty"`
+
+	// Stop running containers before destroying them
+	// example: false
+	Force bool `json:"force"`
+
+	// Number of containers acted on at once, 4 when 0
+	// minimum: 0
+	// maximum: 32
+	// example: 8
+	Parallelism int `json:"parallelism"`
+
+	// Whether to go on with the other containers after a failure, or skip
+	// those not acted on yet. continue when empty.
+	// enum: continue,fail_fast
+	// example: fail_fast
+	OnError string `json:"on_error"`
+}
+
+// BatchResult model
+// swagger:model BatchResult
+type BatchResult struct {
+	// Container acted on
+	// example: web-1
+	Container string `json:"container"`
+
+	// Whether the action ran. Containers are skipped after a failure when
+	// failing fast.
+	// enum: pending,done,failed,skipped
+	// example: done
+	Status string `json:"status"`
+
+	// Error of a failed action
+	Error string `json:"error,omitempty"`
+
+	// Machine-readable code of the error
+	// example: not_running
+	Code string `json:"code,omitempty"`
+}
+
+// BatchResults model
+// swagger:model BatchResults
+type BatchResults struct {
+	// Action run
+	// example: stop
+	Action string `json:"action"`
+
+	// Result for each container, in the order they were given or listed
+	Results []BatchResult `json:"results"`
+}
+
+// validate checks the fields of b, and sets the defaults of those left
+// empty
+func (b *Batch) validate() error {
+	switch b.Action {
+	case batchStart, batchStop, batchFreeze, batchSnapshot, batchDestroy:
+	default:
+		return fmt.Errorf("unknown action %q", b.Action)
+	}
+
+	if (len(b.Names) > 0) == (b.Selector != nil) {
+		return errors.New("either names or selector must be set")
+	}
+	if len(b.Names) > maxBatchNames {
+		return fmt.Errorf("at most %d containers may be named", maxBatchNames)
+	}
+	seen := make(map[string]bool)
+	for _, name := range b.Names {
+		if name == "" {
+			return errors.New("container names must not be empty")
+		}
+		if seen[name] {
+			return fmt.Errorf("container %s is listed twice", name)
+		}
+		seen[name] = true
+	}
+	if b.Selector != nil {
+		if _, err := path.Match(b.Selector.Name, ""); err != nil {
+			return fmt.Errorf("selector name: %v", err)
+		}
+		if _, err := parseLabelSelector(b.Selector.Labels); err != nil {
+			return fmt.Errorf("selector labels: %v", err)
+		}
+	}
+
+	if b.Parallelism < 0 || b.Parallelism > maxBatchParallelism {
+		return fmt.Errorf("parallelism must be between 0 and %d", maxBatchParallelism)
+	}
+	if b.Parallelism == 0 {
+		b.Parallelism = defaultBatchParallelism
+	}
+
+	switch b.OnError {
+	case "":
+		b.OnError = onErrorContinue
+	case onErrorContinue, onErrorFailFast:
+	default:
+		return fmt.Errorf("unknown error policy %q", b.OnError)
+	}
+
+	return nil
+}
+
+// selectContainers returns the names of the containers of lxcpath the
+// principal of r can access and s matches
+func selectContainers(r *http.Request, lxcpath string, s *BatchSelector) ([]string, error) {
+	names, err := driver.List(lxcpath)
+	if err != nil {
+		return nil, err
+	}
+
+	sel, err := parseLabelSelector(s.Labels)
+	if err != nil {
+		return nil, err
+	}
+	names, err = filterLabels(lxcpath, policy.Filter(principalFromContext(r.Context()), lxcpath, names), sel)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := []string{}
+	for _, name := range names {
+		if s.Name != "" {
+			if ok, _ := path.Match(s.Name, name); !ok {
+				continue
+			}
+		}
+		if s.State != "" {
+			state, err := driver.State(lxcpath, name)
+			if err != nil {
+				return nil, err
+			}
+			if state != s.State {
+				continue
+			}
+		}
+		if s.Group != "" {
+			groups, err := driver.ConfigItem(lxcpath, name, "lxc.group")
+			if err != nil {
+				return nil, err
+			}
+			if !containsString(groups, s.Group) {
+				continue
+			}
+		}
+		selected = append(selected, name)
+	}
+
+	return selected, nil
+}
+
+// runBatchAction runs the action of b on container name of lxcpath
+func runBatchAction(r *http.Request, lxcpath string, b *Batch, name string) *apiError {
+	if b.Action == batchDestroy {
+		return destroyContainer(r, lxcpath, name, b.Force)
+	}
+
+	if e := checkAccess(r, lxcpath, name); e != nil {
+		return e
+	}
+
+	switch b.Action {
+	case batchStart:
+		return lockedRun(r, "start", lxcpath, name, driver.Start)
+	case batchStop:
+		return lockedRun(r, "stop", lxcpath, name, driver.Stop)
+	case batchFreeze:
+		return lockedRun(r, "freeze", lxcpath, name, driver.Freeze)
+	case batchSnapshot:
+		return lockedRun(r, "snapshot", lxcpath, name, func(lxcpath string, name string) error {
+			_, err := driver.CreateSnapshot(lxcpath, name)
+			return err
+		})
+	}
+	return nil
+}
+
+// runBatch runs the action of b on containers names of lxcpath, at most
+// b.Parallelism at once, and passes record the result of each, by index
+func runBatch(r *http.Request, lxcpath string, b *Batch, names []string, record func(i int, result BatchResult)) {
+	var (
+		wg     sync.WaitGroup
+		failed int32
+	)
+	slots := make(chan struct{}, b.Parallelism)
+
+	for i, name := range names {
+		slots <- struct{}{}
+
+		if b.OnError == onErrorFailFast && atomic.LoadInt32(&failed) != 0 {
+			<-slots
+			record(i, BatchResult{Container: name, Status: actionSkipped})
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			result := BatchResult{Container: name, Status: actionDone}
+			if e := runBatchAction(r, lxcpath, b, name); e != nil {
+				result.Status, result.Error, result.Code = actionFailed, e.Message, errorCode(e)
+				atomic.StoreInt32(&failed, 1)
+			}
+			record(i, result)
+		}(i, name)
+	}
+
+	wg.Wait()
+}
+
+// PostContainersBatch runs an action on several containers. Small batches
+// are replied to with their results, larger ones with the operation
+// running them.
+func PostContainersBatch(w http.ResponseWriter, r *http.Request) *apiError {
+	var b Batch
+
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+	if err := b.validate(); err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	p := principalFromContext(r.Context())
+	if b.Action == batchSnapshot && !p.HasScope(scopeSnapshots) {
+		err := fmt.Errorf("%s scope required to snapshot containers", scopeSnapshots)
+		return &apiError{err, err.Error(), http.StatusForbidden}
+	}
+
+	lxcpath, e := requestRoot(r)
+	if e != nil {
+		return e
+	}
+
+	names := b.Names
+	if b.Selector != nil {
+		var err error
+		if names, err = selectContainers(r, lxcpath, b.Selector); err != nil {
+			return driverError(err)
+		}
+	}
+
+	setContainers(r.Context(), names)
+
+	if len(names) < batchAsyncThreshold {
+		results := &BatchResults{Action: b.Action, Results: make([]BatchResult, len(names))}
+		runBatch(r, lxcpath, &b, names, func(i int, result BatchResult) { results.Results[i] = result })
+		return writeJSON(w, http.StatusOK, results)
+	}
+
+	op, err := operations.start(p.ID, b.Action, names)
+	if err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	// The operation goes on once the request is replied to, counted
+	// against the concurrency cap of the principal until it is done
+	detached := r.WithContext(detachedContext{r.Context()})
+	release := keepConcurrencySlot(r.Context())
+	go func() {
+		runBatch(detached, lxcpath, &b, names, func(i int, result BatchResult) { operations.setResult(op, i, result) })
+		release()
+		operations.finish(op)
+	}()
+
+	started, _ := operations.get(p, op.ID)
+	w.Header().Set("Location", operationLocation(op.ID))
+	return writeJSON(w, http.StatusAccepted, started)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// batchSummary returns the container, status and error code of each
+// result
+func batchSummary(results []BatchResult) [][3]string {
+	summary := [][3]string{}
+	for _, r := range results {
+		summary = append(summary, [3]string{r.Container, r.Status, r.Code})
+	}
+	return summary
+}
+
+func TestContainersBatch(t *testing.T) {
+	api := newTestAPI(t)
+	ci := api.token(t, "ci", []string{scopeContainersRead, scopeContainersWrite}, nil)
+
+	for _, name := range []string{"c1", "c2", "c3"} {
+		status, body := api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: name, Started: true})
+		expectStatus(t, status, 201, body)
+	}
+	for _, name := range []string{"c1", "c2"} {
+		if err := driver.SetConfigItem(config.LXCPath, name, "lxc.group", "onboot"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var results BatchResults
+	status, body := api.do(t, "POST", "/v1/containers:batch", ci,
+		`{"action": "freeze", "selector": {"group": "onboot", "state": "RUNNING"}}`)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &results)
+	want := [][3]string{{"c1", actionDone, ""}, {"c2", actionDone, ""}}
+	if got := batchSummary(results.Results); results.Action != batchFreeze || !reflect.DeepEqual(got, want) {
+		t.Fatalf("results %v, want %v", got, want)
+	}
+	if state, _ := driver.State(config.LXCPath, "c2"); state != "FROZEN" {
+		t.Errorf("c2 is %s", state)
+	}
+
+	// Failures do not stop the other containers by default
+	results = BatchResults{}
+	status, body = api.do(t, "POST", "/v1/containers:batch", ci, `{"action": "stop", "names": ["c1", "missing", "c3"]}`)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &results)
+	want = [][3]string{{"c1", actionDone, ""}, {"missing", actionFailed, "not_defined"}, {"c3", actionDone, ""}}
+	if got := batchSummary(results.Results); !reflect.DeepEqual(got, want) {
+		t.Fatalf("results %v, want %v", got, want)
+	}
+
+	results = BatchResults{}
+	status, body = api.do(t, "POST", "/v1/containers:batch", ci,
+		`{"action": "stop", "names": ["c1", "c2"], "parallelism": 1, "on_error": "fail_fast"}`)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &results)
+	want = [][3]string{{"c1", actionFailed, "not_running"}, {"c2", actionSkipped, ""}}
+	if got := batchSummary(results.Results); !reflect.DeepEqual(got, want) {
+		t.Fatalf("results %v, want %v", got, want)
+	}
+
+	status, body = api.do(t, "POST", "/v1/containers:batch", ci, `{"action": "snapshot", "names": ["c1"]}`)
+	expectError(t, status, 403, body, "forbidden")
+
+	for _, batch := range []string{
+		`{"action": "stop", "names": ["c1"], "selector": {"name": "c*"}}`,
+		`{"action": "stop"}`,
+		`{"action": "stop", "names": ["c1", "c1"]}`,
+		`{"action": "stop", "selector": {"name": "["}}`,
+	} {
+		status, body = api.do(t, "POST", "/v1/containers:batch", ci, batch)
+		expectError(t, status, 400, body, "bad_request")
+	}
+
+	// Empty names, and too many names, fail validation
+	many := make([]string, maxBatchNames+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("c%d", i)
+	}
+	for _, batch := range []Batch{
+		{Action: batchStop, Names: []string{"c1", ""}},
+		{Action: batchStop, Names: many},
+	} {
+		status, body = api.do(t, "POST", "/v1/containers:batch", ci, batch)
+		expectError(t, status, 422, body, "validation_failed")
+	}
+}
+
+func TestContainersBatchOperation(t *testing.T) {
+	api := newTestAPI(t)
+	ci := api.token(t, "ci", []string{scopeContainersRead, scopeContainersWrite}, nil)
+	other := api.token(t, "other", []string{scopeContainersRead}, nil)
+
+	var names []string
+	for i := 0; i < batchAsyncThreshold; i++ {
+		name := fmt.Sprintf("big-%02d", i)
+		status, body := api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: name, Started: true})
+		expectStatus(t, status, 201, body)
+		names = append(names, name)
+	}
+
+	// The operation waits for a container, counting against the
+	// concurrency cap of the principal meanwhile
+	limiter.SetLimits(LimitsConfig{ConcurrentCreates: 1})
+	locks.timeout = time.Minute
+	unlock, e := locks.lock(context.Background(), "snapshot", config.LXCPath, names[0])
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+
+	resp, body := api.send(t, "POST", "/v1/containers:batch", ci,
+		`{"action": "destroy", "selector": {"name": "big-*"}, "force": true}`)
+	expectStatus(t, resp.StatusCode, 202, body)
+
+	var op Operation
+	decode(t, body, &op)
+	location := resp.Header.Get("Location")
+	if location != "/v1/operations/"+op.ID || op.Action != batchDestroy || len(op.Results) != len(names) {
+		t.Fatalf("unexpected operation at %q: %s", location, body)
+	}
+
+	status, body := api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: "extra"})
+	expectError(t, status, 429, body, "concurrency_limited")
+	unlock()
+
+	status, body = api.do(t, "GET", location, other, nil)
+	expectError(t, status, 404, body, "not_found")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for op.Status != operationDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("operation still running: %+v", op)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		status, body = api.do(t, "GET", location, ci, nil)
+		expectStatus(t, status, 200, body)
+		op = Operation{}
+		decode(t, body, &op)
+	}
+
+	if op.FinishedAt == nil {
+		t.Error("finished operation without end date")
+	}
+	for i, r := range op.Results {
+		if r.Container != names[i] || r.Status != actionDone {
+			t.Errorf("result %d: %+v", i, r)
+		}
+	}
+	if left, _ := driver.List(config.LXCPath); len(left) != 0 {
+		t.Errorf("containers left %v", left)
+	}
+	if len(limiter.running) != 0 {
+		t.Errorf("operations still counted: %v", limiter.running)
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultConfigFile is read when neither -config nor LXC_API_CONFIG is set,
+// it may not exist
+const defaultConfigFile = "/etc/lxc-go-http-api/config.yml"
+
+// config holds the settings of the running server
+var config = defaultConfig()
+
+// Config holds the server settings, read from the configuration file and
+// overridden by environment variables and command line flags
+type Config struct {
+	// Address of the TCP listener, empty to disable it
+	Listen string `yaml:"listen"`
+
+	// Container backend, lxc or fake
+	Driver string `yaml:"driver"`
+
+	// LXC containers directory, served as the default storage root
+	LXCPath string `yaml:"lxcpath"`
+
+	// Additional storage roots, by name
+	Roots map[string]string `yaml:"roots"`
+
+	// API own persistent data directory
+	StateDir string `yaml:"state_dir"`
+
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	// How long responses are replayed for retries having the same
+	// Idempotency-Key
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl"`
+
+	// How long operations wait for another one on the same container,
+	// before failing with container_busy
+	LockTimeout time.Duration `yaml:"lock_timeout"`
+
+	// How long in-flight requests are drained for on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	Socket SocketConfig `yaml:"socket"`
+	TLS    TLSConfig    `yaml:"tls"`
+	Auth   AuthConfig   `yaml:"auth"`
+	Log    LogConfig    `yaml:"log"`
+	Audit  AuditConfig  `yaml:"audit"`
+	Limits LimitsConfig `yaml:"limits"`
+
+	// Resources of the containers of each tenant, by policy group
+	Quotas map[string]Quota `yaml:"quotas"`
+
+	// API documentation, requests are validated against
+	SpecFile string `yaml:"spec_file"`
+
+	// Debug mode, also validating responses
+	Debug bool `yaml:"debug"`
+
+	Features FeaturesConfig `yaml:"features"`
+}
+
+// SocketConfig holds the unix socket listener settings
+type SocketConfig struct {
+	// Socket path, empty to disable the listener
+	Path  string `yaml:"path"`
+	Mode  string `yaml:"mode"`
+	Group string `yaml:"group"`
+}
+
+// TLSConfig holds the TCP listener TLS settings
+type TLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Certificate and key, a self-signed pair is generated in the state
+	// directory when both are empty
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+
+	// CA bundle used to verify client certificates
+	ClientCA          string `yaml:"client_ca"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+}
+
+// AuthConfig holds the authentication and access control settings
+type AuthConfig struct {
+	// API tokens store, defaults to tokens.json in the state directory
+	TokensFile string `yaml:"tokens_file"`
+
+	Policy Policy `yaml:"policy"`
+}
+
+// LogConfig holds the logging settings
+type LogConfig struct {
+	// Log file, standard error when empty
+	File string `yaml:"file"`
+
+	// Lowest level logged: debug, info, warn or error
+	Level string `yaml:"level"`
+
+	// Entries format: json or logfmt
+	Format string `yaml:"format"`
+}
+
+// AuditConfig holds the audit log settings
+type AuditConfig struct {
+	// Record mutating requests
+	Enabled bool `yaml:"enabled"`
+
+	// Audit log file, audit.log in the state directory when empty
+	File string `yaml:"file"`
+}
+
+// LimitsConfig holds the limits applied to each principal, reloaded on
+// SIGHUP
+type LimitsConfig struct {
+	Read   RateLimit `yaml:"read"`
+	Mutate RateLimit `yaml:"mutate"`
+	Exec   RateLimit `yaml:"exec"`
+
+	// Creations and clones running at once, unlimited when 0
+	ConcurrentCreates int `yaml:"concurrent_creates"`
+
+	// Exec sessions running at once, unlimited when 0
+	ConcurrentExecs int `yaml:"concurrent_execs"`
+}
+
+// RateLimit is the token bucket of a route class
+type RateLimit struct {
+	// Requests per second, unlimited when 0
+	Rate float64 `yaml:"rate"`
+
+	// Requests sent at once, above the rate
+	Burst int `yaml:"burst"`
+}
+
+// FeaturesConfig toggles optional features
+type FeaturesConfig struct {
+	// Serve API documentation on /docs and /swagger/
+	Docs bool `yaml:"docs"`
+
+	// Create an admin token on startup when none exists
+	TokenBootstrap bool `yaml:"token_bootstrap"`
+
+	// Reject requests which do not match the API documentation
+	Validation bool `yaml:"validation"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:          "0.0.0.0:8000",
+		Driver:          "lxc",
+		LXCPath:         "/var/lib/lxc",
+		StateDir:        "/var/lib/lxc-go-http-api",
+		ReadTimeout:     15 * time.Second,
+		WriteTimeout:    15 * time.Second,
+		IdempotencyTTL:  24 * time.Hour,
+		LockTimeout:     5 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		Socket: SocketConfig{
+			Mode: "0660",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Audit: AuditConfig{
+			Enabled: true,
+		},
+		SpecFile: "/usr/share/doc/lxc-go-http-api/swagger/swagger.json",
+		Features: FeaturesConfig{
+			Docs:           true,
+			TokenBootstrap: true,
+			Validation:     true,
+		},
+	}
+}
+
+// setting is a configuration item which can be overridden by a command
+// line flag and an environment variable
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	field func(c *Config) interface{}
+}
+
+var settings = []setting{
+	{"listen", "LXC_API_LISTEN", "Listen address, empty to disable TCP",
+		func(c *Config) interface{} { return &c.Listen }},
+	{"driver", "LXC_API_DRIVER", "Container backend, lxc or fake (in memory, for development)",
+		func(c *Config) interface{} { return &c.Driver }},
+	{"lxcpath", "LXC_API_LXCPATH", "LXC containers directory",
+		func(c *Config) interface{} { return &c.LXCPath }},
+	{"state-dir", "LXC_API_STATE_DIR", "API persistent data directory",
+		func(c *Config) interface{} { return &c.StateDir }},
+	{"read-timeout", "LXC_API_READ_TIMEOUT", "HTTP read timeout",
+		func(c *Config) interface{} { return &c.ReadTimeout }},
+	{"write-timeout", "LXC_API_WRITE_TIMEOUT", "HTTP write timeout",
+		func(c *Config) interface{} { return &c.WriteTimeout }},
+	{"idempotency-ttl", "LXC_API_IDEMPOTENCY_TTL", "How long responses are replayed for an Idempotency-Key",
+		func(c *Config) interface{} { return &c.IdempotencyTTL }},
+	{"lock-timeout", "LXC_API_LOCK_TIMEOUT", "How long operations wait for another one on the same container",
+		func(c *Config) interface{} { return &c.LockTimeout }},
+	{"shutdown-timeout", "LXC_API_SHUTDOWN_TIMEOUT", "How long in-flight requests are drained for on SIGTERM",
+		func(c *Config) interface{} { return &c.ShutdownTimeout }},
+	{"socket", "LXC_API_SOCKET", "Unix socket path, e.g. /run/lxc-go-http-api.sock",
+		func(c *Config) interface{} { return &c.Socket.Path }},
+	{"socket-mode", "LXC_API_SOCKET_MODE", "Unix socket permissions",
+		func(c *Config) interface{} { return &c.Socket.Mode }},
+	{"socket-group", "LXC_API_SOCKET_GROUP", "Unix socket group",
+		func(c *Config) interface{} { return &c.Socket.Group }},
+	{"tls", "LXC_API_TLS", "Serve HTTPS, with a self-signed certificate unless -tls-cert and -tls-key are set",
+		func(c *Config) interface{} { return &c.TLS.Enabled }},
+	{"tls-cert", "LXC_API_TLS_CERT", "TLS certificate file",
+		func(c *Config) interface{} { return &c.TLS.Cert }},
+	{"tls-key", "LXC_API_TLS_KEY", "TLS private key file",
+		func(c *Config) interface{} { return &c.TLS.Key }},
+	{"tls-client-ca", "LXC_API_TLS_CLIENT_CA", "CA bundle used to verify client certificates",
+		func(c *Config) interface{} { return &c.TLS.ClientCA }},
+	{"tls-require-client-cert", "LXC_API_TLS_REQUIRE_CLIENT_CERT", "Reject TLS clients without a valid certificate",
+		func(c *Config) interface{} { return &c.TLS.RequireClientCert }},
+	{"tokens-file", "LXC_API_TOKENS_FILE", "API tokens store",
+		func(c *Config) interface{} { return &c.Auth.TokensFile }},
+	{"log-file", "LXC_API_LOG_FILE", "Log file, standard error when empty",
+		func(c *Config) interface{} { return &c.Log.File }},
+	{"log-level", "LXC_API_LOG_LEVEL", "Lowest level logged: debug, info, warn or error",
+		func(c *Config) interface{} { return &c.Log.Level }},
+	{"log-format", "LXC_API_LOG_FORMAT", "Log entries format: json or logfmt",
+		func(c *Config) interface{} { return &c.Log.Format }},
+	{"audit", "LXC_API_AUDIT", "Record mutating requests in the audit log",
+		func(c *Config) interface{} { return &c.Audit.Enabled }},
+	{"audit-file", "LXC_API_AUDIT_FILE", "Audit log file",
+		func(c *Config) interface{} { return &c.Audit.File }},
+	{"docs", "LXC_API_DOCS", "Serve API documentation",
+		func(c *Config) interface{} { return &c.Features.Docs }},
+	{"token-bootstrap", "LXC_API_TOKEN_BOOTSTRAP", "Create an admin token when none exists",
+		func(c *Config) interface{} { return &c.Features.TokenBootstrap }},
+	{"validation", "LXC_API_VALIDATION", "Reject requests which do not match the API documentation",
+		func(c *Config) interface{} { return &c.Features.Validation }},
+	{"spec-file", "LXC_API_SPEC_FILE", "API documentation requests are validated against",
+		func(c *Config) interface{} { return &c.SpecFile }},
+	{"debug", "LXC_API_DEBUG", "Debug mode, logging responses which do not match the API documentation",
+		func(c *Config) interface{} { return &c.Debug }},
+}
+
+// set parses value into the configuration field of s
+func (s setting) set(c *Config, value string) error {
+	var err error
+
+	switch f := s.field(c).(type) {
+	case *string:
+		*f = value
+	case *bool:
+		*f, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*f, err = time.ParseDuration(value)
+	default:
+		err = fmt.Errorf("unsupported type %T", f)
+	}
+
+	return err
+}
+
+// Commands run instead of the server
+const (
+	commandPrintConfig = "print-config"
+	commandVerifyAudit = "verify-audit"
+)
+
+// flagValue records the raw value of a flag, applied to the configuration
+// once the configuration file is read
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *flagValue) String() string     { return v.value }
+func (v *flagValue) Set(s string) error { v.value = s; return nil }
+func (v *flagValue) IsBoolFlag() bool   { return v.isBool }
+
+// loadConfig builds the server configuration from, by increasing
+// precedence, defaults, the configuration file, environment variables and
+// command line flags. It returns the command asked for instead of serving,
+// if any.
+func loadConfig(args []string) (*Config, string, error) {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	configFile := fs.String("config", "", "Configuration file (default "+defaultConfigFile+", env LXC_API_CONFIG)")
+	printConfig := fs.Bool(commandPrintConfig, false, "Print the effective configuration and exit")
+	verifyAudit := fs.Bool(commandVerifyAudit, false, "Verify the hash chain of the audit log and exit")
+
+	values := make([]flagValue, len(settings))
+	for i, s := range settings {
+		_, isBool := s.field(&Config{}).(*bool)
+		values[i].isBool = isBool
+		fs.Var(&values[i], s.flag, s.usage+" (env "+s.env+")")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, "", err
+	}
+
+	c := defaultConfig()
+
+	file := *configFile
+	if file == "" {
+		file = os.Getenv("LXC_API_CONFIG")
+	}
+
+	explicit := file != ""
+	if !explicit {
+		file = defaultConfigFile
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil && (explicit || !os.IsNotExist(err)) {
+		return nil, "", err
+	}
+	if err == nil {
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, "", fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(c, value); err != nil {
+				return nil, "", fmt.Errorf("%s: %v", s.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for i, s := range settings {
+			if s.flag == f.Name && flagErr == nil {
+				if err := s.set(c, values[i].value); err != nil {
+					flagErr = fmt.Errorf("-%s: %v", s.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, "", flagErr
+	}
+
+	if c.Roots == nil {
+		c.Roots = make(map[string]string)
+	}
+	if path, ok := c.Roots[defaultRoot]; ok && path != c.LXCPath {
+		return nil, "", fmt.Errorf("roots: %s is the lxcpath setting", defaultRoot)
+	}
+	c.Roots[defaultRoot] = c.LXCPath
+
+	if c.Auth.TokensFile == "" {
+		c.Auth.TokensFile = filepath.Join(c.StateDir, "tokens.json")
+	}
+	if c.Audit.File == "" {
+		c.Audit.File = filepath.Join(c.StateDir, auditFile)
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, "", err
+	}
+
+	switch {
+	case *printConfig:
+		return c, commandPrintConfig, nil
+	case *verifyAudit:
+		return c, commandVerifyAudit, nil
+	}
+
+	return c, "", nil
+}
+
+// validate checks the configuration and reports every error found
+func (c *Config) validate() error {
+	var errs []string
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+
+	if c.Listen == "" && c.Socket.Path == "" {
+		fail("no listener configured, set listen or socket.path")
+	}
+
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			fail("listen: %v", err)
+		}
+	}
+
+	if _, ok := drivers[c.Driver]; !ok {
+		fail("driver: unknown driver %s, available: %v", c.Driver, driverNames())
+	}
+
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		fail("log.level: %v", err)
+	}
+	if err := checkLogFormat(c.Log.Format); err != nil {
+		fail("log.format: %v", err)
+	}
+
+	// The fake driver keeps containers in memory, roots are only names
+	for name, path := range c.Roots {
+		if c.Driver == "fake" {
+			break
+		}
+
+		setting := "roots." + name
+		if name == defaultRoot {
+			setting = "lxcpath"
+		}
+
+		if fi, err := os.Stat(path); err != nil {
+			fail("%s: %v", setting, err)
+		} else if !fi.IsDir() {
+			fail("%s: %s is not a directory", setting, path)
+		}
+	}
+
+	if !filepath.IsAbs(c.StateDir) {
+		fail("state_dir: %s is not an absolute path", c.StateDir)
+	}
+
+	if c.ReadTimeout <= 0 {
+		fail("read_timeout: must be positive")
+	}
+	if c.WriteTimeout <= 0 {
+		fail("write_timeout: must be positive")
+	}
+	if c.IdempotencyTTL <= 0 {
+		fail("idempotency_ttl: must be positive")
+	}
+	if c.LockTimeout < 0 {
+		fail("lock_timeout: must not be negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		fail("shutdown_timeout: must be positive")
+	}
+
+	for _, limit := range []struct {
+		name string
+		RateLimit
+	}{{"read", c.Limits.Read}, {"mutate", c.Limits.Mutate}, {"exec", c.Limits.Exec}} {
+		if limit.Rate < 0 {
+			fail("limits.%s.rate: must not be negative", limit.name)
+		}
+		if limit.Rate > 0 && limit.Burst < 1 {
+			fail("limits.%s.burst: must be at least 1", limit.name)
+		}
+	}
+	if c.Limits.ConcurrentCreates < 0 {
+		fail("limits.concurrent_creates: must not be negative")
+	}
+	if c.Limits.ConcurrentExecs < 0 {
+		fail("limits.concurrent_execs: must not be negative")
+	}
+
+	for tenant, quota := range c.Quotas {
+		if _, ok := c.Auth.Policy.Groups[tenant]; !ok {
+			fail("quotas.%s: not a group of auth.policy", tenant)
+		}
+		if quota.Containers < 0 || quota.MemoryBytes < 0 || quota.CPUs < 0 || quota.DiskBytes < 0 {
+			fail("quotas.%s: must not be negative", tenant)
+		}
+	}
+
+	if _, err := c.Socket.FileMode(); err != nil {
+		fail("socket.mode: %v", err)
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		fail("tls: cert and key must be set together")
+	}
+	if c.TLS.RequireClientCert && c.TLS.ClientCA == "" {
+		fail("tls: client certificates cannot be required without client_ca")
+	}
+
+	if err := c.Auth.Policy.validate(); err != nil {
+		fail("auth.policy: %v", err)
+	}
+
+	if c.Features.Validation || c.Debug {
+		if _, err := os.Stat(c.SpecFile); err != nil {
+			fail("spec_file: %v (install it with make install-docs, or disable features.validation)", err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration:\n  - " + strings.Join(errs, "\n  - "))
+	}
+
+	return nil
+}
+
+// FileMode parses the octal socket permissions
+func (s SocketConfig) FileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("%s is not a permission mode", s.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// validate checks the policy and resolves its unix users and groups
+func (pol *Policy) validate() error {
+	for group, patterns := range pol.Groups {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("group %s: bad pattern %q", group, pattern)
+			}
+		}
+	}
+
+	for name, role := range pol.Roles {
+		for _, scope := range role.Scopes {
+			if !isKnownScope(scope) {
+				return fmt.Errorf("role %s: unknown scope %s", name, scope)
+			}
+		}
+	}
+
+	for cn, role := range pol.Certificates {
+		if _, ok := pol.Roles[role]; !ok {
+			return fmt.Errorf("certificate %s: unknown role %s", cn, role)
+		}
+	}
+
+	for _, dir := range pol.Mounts {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("mounts: %q is not an absolute path", dir)
+		}
+	}
+	for _, dev := range pol.Devices {
+		if !filepath.IsAbs(dev) {
+			return fmt.Errorf("devices: %q is not an absolute path", dev)
+		}
+	}
+
+	return pol.resolveUnixIDs()
+}
+
+// Print writes the configuration as YAML
+func (c *Config) Print() error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(data)
+	return err
+}
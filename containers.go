@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Container model
+// swagger:model Container
+type Container struct {
+	// Container name
+	// example: dummy
+	Name string `json:"name"`
+
+	// Storage root of the container
+	// example: default
+	Root string `json:"root"`
+
+	// Container state
+	// example: RUNNING
+	State string `json:"state"`
+
+	// Principal which created the container, empty when it was not
+	// created through the API
+	// example: ci
+	Owner string `json:"owner,omitempty"`
+
+	// Creation date, when created through the API
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+
+	// Profiles the container was created with, in order
+	// example: ["base", "web"]
+	Profiles []string `json:"profiles,omitempty"`
+
+	// Labels, which containers are selected by
+	// example: {"env": "prod", "team": "web"}
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations, free-form
+	// example: {"contact": "ops@example.com"}
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// writeJSON replies v with status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) *apiError {
+	js, err := json.Marshal(v)
+
+	if err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+
+	return nil
+}
+
+// requestRootName returns the name of the storage root selected by the
+// root query parameter of r
+func requestRootName(r *http.Request) string {
+	if name := r.URL.Query().Get("root"); name != "" {
+		return name
+	}
+	return defaultRoot
+}
+
+// containerRequest returns the lxcpath and name of the container of the
+// path of r, once the principal of r is known to access it
+func containerRequest(r *http.Request) (string, string, *apiError) {
+	lxcpath, e := requestRoot(r)
+	if e != nil {
+		return "", "", e
+	}
+
+	name := mux.Vars(r)["name"]
+	if e := checkAccess(r, lxcpath, name); e != nil {
+		return "", "", e
+	}
+
+	return lxcpath, name, nil
+}
+
+// containerLocation returns the URL of container name of root
+func containerLocation(root string, name string) string {
+	location := "/v1/containers/" + url.PathEscape(name)
+	if root != defaultRoot {
+		location += "?root=" + url.QueryEscape(root)
+	}
+	return location
+}
+
+// writeContainer replies container name of root with status, along with
+// its location when it was created
+func writeContainer(w http.ResponseWriter, status int, root string, lxcpath string, name string) *apiError {
+	state, err := driver.State(lxcpath, name)
+
+	if err != nil {
+		return driverError(err)
+	}
+
+	md, err := readMetadata(lxcpath, name)
+
+	if err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	c := &Container{
+		Name:        name,
+		Root:        root,
+		State:       state,
+		Owner:       md.Owner,
+		Profiles:    md.Profiles,
+		Labels:      md.Labels,
+		Annotations: md.Annotations}
+
+	if !md.CreatedAt.IsZero() {
+		c.CreatedAt = &md.CreatedAt
+	}
+
+	if status == http.StatusCreated {
+		w.Header().Set("Location", containerLocation(root, name))
+	}
+
+	return writeJSON(w, status, c)
+}
+
+// GetContainer returns a container
+func GetContainer(w http.ResponseWriter, r *http.Request) *apiError {
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	return writeContainer(w, http.StatusOK, requestRootName(r), lxcpath, name)
+}
+
+// PostContainer creates a container, replying 201 with it
+func PostContainer(w http.ResponseWriter, r *http.Request) *apiError {
+	var opts ContainerTemplate
+
+	err := json.NewDecoder(r.Body).Decode(&opts)
+
+	if err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	lxcpath, e := requestRoot(r)
+	if e != nil {
+		return e
+	}
+
+	if e := createContainer(r, lxcpath, opts); e != nil {
+		return e
+	}
+
+	return writeContainer(w, http.StatusCreated, requestRootName(r), lxcpath, opts.Name)
+}
+
+// DeleteContainer destroys a container, stopping it first when the force
+// query parameter is set, and replies 204
+func DeleteContainer(w http.ResponseWriter, r *http.Request) *apiError {
+	force := false
+	if value := r.URL.Query().Get("force"); value != "" {
+		var err error
+		if force, err = strconv.ParseBool(value); err != nil {
+			err := errors.New("invalid force parameter " + value)
+			return &apiError{err, err.Error(), 400}
+		}
+	}
+
+	lxcpath, e := requestRoot(r)
+	if e != nil {
+		return e
+	}
+
+	if e := destroyContainer(r, lxcpath, mux.Vars(r)["name"], force); e != nil {
+		return e
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// StartContainer starts a container and replies with it
+func StartContainer(w http.ResponseWriter, r *http.Request) *apiError {
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	unlock, e := locks.lock(r.Context(), "start", lxcpath, name)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	if err := driver.Start(lxcpath, name); err != nil {
+		return driverError(err)
+	}
+
+	return writeContainer(w, http.StatusOK, requestRootName(r), lxcpath, name)
+}
+
+// StopContainer stops a container and replies with it
+func StopContainer(w http.ResponseWriter, r *http.Request) *apiError {
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	unlock, e := locks.lock(r.Context(), "stop", lxcpath, name)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	if err := driver.Stop(lxcpath, name); err != nil {
+		return driverError(err)
+	}
+
+	return writeContainer(w, http.StatusOK, requestRootName(r), lxcpath, name)
+}
+
+// PostContainerClone clones a container, replying 201 with the clone
+func PostContainerClone(w http.ResponseWriter, r *http.Request) *apiError {
+	var opts CloneOptions
+
+	err := json.NewDecoder(r.Body).Decode(&opts)
+
+	if err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	lxcpath, e := requestRoot(r)
+	if e != nil {
+		return e
+	}
+
+	target, e := cloneContainer(r, lxcpath, mux.Vars(r)["name"], opts)
+	if e != nil {
+		return e
+	}
+
+	root := opts.Root
+	if root == "" {
+		root = requestRootName(r)
+	}
+
+	return writeContainer(w, http.StatusCreated, root, target, opts.Name)
+}
+
+// ExecContainer runs a command in a running container and replies with
+// its result
+func ExecContainer(w http.ResponseWriter, r *http.Request) *apiError {
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	var cmd ExecCommand
+
+	err := json.NewDecoder(r.Body).Decode(&cmd)
+
+	if err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	if len(cmd.Args) == 0 {
+		err := errors.New("no command passed")
+		return &apiError{err, err.Error(), 400}
+	}
+
+	unlock, e := locks.lock(r.Context(), "exec", lxcpath, name)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	result, err := driver.Exec(lxcpath, name, cmd)
+
+	if err != nil {
+		return driverError(err)
+	}
+
+	return writeJSON(w, http.StatusOK, result)
+}
+
+// GetContainerMetrics returns the resource usage of a running container
+func GetContainerMetrics(w http.ResponseWriter, r *http.Request) *apiError {
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	metrics, err := driver.Metrics(lxcpath, name)
+
+	if err != nil {
+		return driverError(err)
+	}
+
+	return writeJSON(w, http.StatusOK, metrics)
+}
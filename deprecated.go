@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Routes predating /v1 are deprecated since legacyDeprecation, and go away
+// at legacySunset
+var (
+	legacyDeprecation = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	legacySunset      = time.Date(2027, time.April, 19, 0, 0, 0, 0, time.UTC)
+)
+
+// deprecated wraps the handler of a legacy route so that its responses
+// announce the deprecation, as in RFC 9745 and RFC 8594, and link to
+// successor. Variables of the legacy route, such as {container}, are
+// expanded in successor.
+func deprecated(successor string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		link := successor
+		for name, value := range mux.Vars(r) {
+			link = strings.Replace(link, "{"+name+"}", url.PathEscape(value), -1)
+		}
+
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecation.Unix(), 10))
+		w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, link))
+
+		h.ServeHTTP(w, r)
+	})
+}
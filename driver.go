@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Errors returned by drivers, whatever their backend
+var (
+	errNotDefined         = errors.New("container is not defined")
+	errAlreadyDefined     = errors.New("container already defined")
+	errAlreadyRunning     = errors.New("container is already running")
+	errNotRunning         = errors.New("container is not running")
+	errAlreadyFrozen      = errors.New("container is already frozen")
+	errNotFrozen          = errors.New("container is not frozen")
+	errNoSnapshot         = errors.New("container has no snapshot")
+	errTemplateNotAllowed = errors.New("unprivileged users only allowed to use \"download\" template")
+	errNotSupported       = errors.New("method is not supported by this LXC version")
+)
+
+// driver is the container backend of the running server
+var driver Driver
+
+// drivers lists the available backends by name, each registering itself
+// from its own file
+var drivers = map[string]func() Driver{}
+
+// Driver is the container backend the API handlers work with. Containers
+// are identified by the lxcpath of their storage root and their name.
+type Driver interface {
+	// Version returns the backend version
+	Version() string
+
+	// List returns the names of the containers of lxcpath
+	List(lxcpath string) ([]string, error)
+
+	// State returns the state of a container, such as RUNNING or STOPPED
+	State(lxcpath string, name string) (string, error)
+
+	Create(lxcpath string, name string, opts TemplateOptions) error
+	Start(lxcpath string, name string) error
+	Stop(lxcpath string, name string) error
+
+	// Freeze suspends the processes of a running container
+	Freeze(lxcpath string, name string) error
+	Destroy(lxcpath string, name string) error
+
+	// Clone copies a stopped container into targetPath
+	Clone(lxcpath string, name string, targetPath string, opts CloneOptions) error
+
+	Snapshots(lxcpath string, name string) ([]Snapshot, error)
+	CreateSnapshot(lxcpath string, name string) (*Snapshot, error)
+	RestoreSnapshot(lxcpath string, name string, snapshot string, newName string) error
+	DestroySnapshot(lxcpath string, name string, snapshot string) error
+
+	// ConfigItem returns the values of a container configuration key
+	ConfigItem(lxcpath string, name string, key string) ([]string, error)
+
+	// SetConfigItem sets and saves a container configuration key
+	SetConfigItem(lxcpath string, name string, key string, value string) error
+
+	// Exec runs a command in a running container and waits for it
+	Exec(lxcpath string, name string, cmd ExecCommand) (*ExecResult, error)
+
+	// Metrics returns the resource usage of a running container
+	Metrics(lxcpath string, name string) (*Metrics, error)
+
+	// Metadata returns what the API stored about a container, nil when
+	// nothing was
+	Metadata(lxcpath string, name string) ([]byte, error)
+	SetMetadata(lxcpath string, name string, data []byte) error
+
+	// LXCInfo returns the version, extensions and global configuration of
+	// liblxc
+	LXCInfo() *LXCInfo
+
+	// Checks returns the readiness checks of the backend, for the storage
+	// roots of roots
+	Checks(roots map[string]string) []readinessCheck
+}
+
+// newDriver returns the backend called name
+func newDriver(name string) (Driver, error) {
+	factory, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown driver %s, available: %v", name, driverNames())
+	}
+	return factory(), nil
+}
+
+func driverNames() []string {
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BackendStore specifies possible backend types, numbered as in go-lxc
+type BackendStore int
+
+// Backend store types
+const (
+	Btrfs BackendStore = iota + 1
+	Directory
+	LVM
+	ZFS
+	Aufs
+	Overlayfs
+	Loopback
+	Best
+)
+
+// TemplateOptions type is used for defining various template options.
+type TemplateOptions struct {
+
+	// Template specifies the name of the template.
+	Template string
+
+	// Backend specifies the type of the backend.
+	Backend BackendStore
+
+	// Distro specifies the name of the distribution.
+	Distro string
+
+	// Release specifies the name/version of the distribution.
+	Release string
+
+	// Arch specified the architecture of the container.
+	Arch string
+
+	// Variant specifies the variant of the image (default: "default").
+	Variant string
+
+	// Image server (default: "images.linuxcontainers.org").
+	Server string
+
+	// GPG keyid (default: 0x...).
+	KeyID string
+
+	// GPG keyserver to use.
+	KeyServer string
+
+	// Disable GPG validation (not recommended).
+	DisableGPGValidation bool
+
+	// Flush the local copy (if present).
+	FlushCache bool
+
+	// Force the use of the local copy even if expired.
+	ForceCache bool
+
+	// ExtraArgs provides a way to specify template specific args.
+	ExtraArgs []string
+}
+
+// Snapshot model
+// swagger:model Snapshot
+type Snapshot struct {
+	// Snapshot name
+	// example: snap0
+	Name string `json:"name"`
+
+	// Snapshot date
+	// example: 2020:06:18 10:12:05
+	Timestamp string `json:"timestamp"`
+}
+
+// ExecCommand model
+// swagger:model ExecCommand
+type ExecCommand struct {
+	// Command and its arguments
+	// required: true
+	// example: ["uname", "-a"]
+	Args []string `json:"args"`
+
+	// Environment variables, as KEY=value
+	// example: ["LANG=C"]
+	Env []string `json:"env"`
+
+	// Working directory
+	// example: /
+	Cwd string `json:"cwd"`
+}
+
+// ExecResult model
+// swagger:model ExecResult
+type ExecResult struct {
+	// Command exit code
+	// example: 0
+	ExitCode int `json:"exit_code"`
+
+	// Command standard output
+	Stdout string `json:"stdout"`
+
+	// Command standard error
+	Stderr string `json:"stderr"`
+}
+
+// Metrics model
+// swagger:model Metrics
+type Metrics struct {
+	// Memory usage in bytes
+	MemoryUsage int64 `json:"memory_usage"`
+
+	// Memory limit in bytes, 0 when unlimited
+	MemoryLimit int64 `json:"memory_limit"`
+
+	// CPU time consumed in nanoseconds
+	CPUTime time.Duration `json:"cpu_time"`
+
+	// Block I/O in bytes
+	BlkioUsage int64 `json:"blkio_usage"`
+}
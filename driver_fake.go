@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	drivers["fake"] = func() Driver { return newFakeDriver() }
+}
+
+// fakeDriver keeps containers in memory. It needs neither root nor liblxc,
+// to run the API on a laptop or in tests.
+type fakeDriver struct {
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+
+	// unready fails the readiness check of the driver, when set
+	unready error
+}
+
+type fakeContainer struct {
+	state     string
+	config    map[string][]string
+	snapshots []Snapshot
+	metadata  []byte
+	started   time.Time
+}
+
+func newFakeDriver() *fakeDriver {
+	return &fakeDriver{containers: make(map[string]*fakeContainer)}
+}
+
+func fakeKey(lxcpath string, name string) string {
+	return lxcpath + "/" + name
+}
+
+// get returns a defined container, callers must hold d.mu
+func (d *fakeDriver) get(lxcpath string, name string) (*fakeContainer, error) {
+	c, ok := d.containers[fakeKey(lxcpath, name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errNotDefined, name)
+	}
+	return c, nil
+}
+
+func (d *fakeDriver) Version() string {
+	return "fake"
+}
+
+func (d *fakeDriver) List(lxcpath string) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	names := []string{}
+	for key := range d.containers {
+		if strings.HasPrefix(key, lxcpath+"/") {
+			names = append(names, strings.TrimPrefix(key, lxcpath+"/"))
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (d *fakeDriver) State(lxcpath string, name string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return "", err
+	}
+	return c.state, nil
+}
+
+func (d *fakeDriver) Create(lxcpath string, name string, opts TemplateOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.get(lxcpath, name); err == nil {
+		return fmt.Errorf("%w: %q", errAlreadyDefined, name)
+	}
+
+	d.containers[fakeKey(lxcpath, name)] = &fakeContainer{
+		state: "STOPPED",
+		config: map[string][]string{
+			"lxc.uts.name":    {name},
+			"lxc.rootfs.path": {"dir:" + lxcpath + "/" + name + "/rootfs"},
+		},
+	}
+
+	return nil
+}
+
+func (d *fakeDriver) Start(lxcpath string, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return err
+	}
+	if c.state != "STOPPED" {
+		return fmt.Errorf("%w: %q", errAlreadyRunning, name)
+	}
+
+	c.state = "RUNNING"
+	c.started = time.Now()
+	return nil
+}
+
+func (d *fakeDriver) Stop(lxcpath string, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return err
+	}
+	if c.state == "STOPPED" {
+		return fmt.Errorf("%w: %q", errNotRunning, name)
+	}
+
+	c.state = "STOPPED"
+	return nil
+}
+
+func (d *fakeDriver) Freeze(lxcpath string, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return err
+	}
+	switch c.state {
+	case "STOPPED":
+		return fmt.Errorf("%w: %q", errNotRunning, name)
+	case "FROZEN":
+		return fmt.Errorf("%w: %q", errAlreadyFrozen, name)
+	}
+
+	c.state = "FROZEN"
+	return nil
+}
+
+func (d *fakeDriver) Destroy(lxcpath string, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return err
+	}
+	if c.state != "STOPPED" {
+		return fmt.Errorf("%w: %q", errAlreadyRunning, name)
+	}
+
+	delete(d.containers, fakeKey(lxcpath, name))
+	return nil
+}
+
+func (d *fakeDriver) Clone(lxcpath string, name string, targetPath string, opts CloneOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return err
+	}
+	if c.state != "STOPPED" {
+		return fmt.Errorf("%w: %q", errAlreadyRunning, name)
+	}
+	if _, err := d.get(targetPath, opts.Name); err == nil {
+		return fmt.Errorf("%w: %q", errAlreadyDefined, opts.Name)
+	}
+
+	clone := &fakeContainer{state: "STOPPED", config: make(map[string][]string)}
+	for key, values := range c.config {
+		clone.config[key] = append([]string(nil), values...)
+	}
+	if !opts.KeepName {
+		clone.config["lxc.uts.name"] = []string{opts.Name}
+	}
+	clone.config["lxc.rootfs.path"] = []string{"dir:" + targetPath + "/" + opts.Name + "/rootfs"}
+
+	d.containers[fakeKey(targetPath, opts.Name)] = clone
+	return nil
+}
+
+func (d *fakeDriver) Snapshots(lxcpath string, name string) ([]Snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return nil, err
+	}
+	return append([]Snapshot(nil), c.snapshots...), nil
+}
+
+func (d *fakeDriver) CreateSnapshot(lxcpath string, name string) (*Snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return nil, err
+	}
+	if c.state != "STOPPED" {
+		return nil, fmt.Errorf("%w: %q", errAlreadyRunning, name)
+	}
+
+	// Snapshots are numbered like LXC does, after the last one
+	next := 0
+	for _, s := range c.snapshots {
+		if n, err := strconv.Atoi(strings.TrimPrefix(s.Name, "snap")); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+
+	s := Snapshot{
+		Name:      "snap" + strconv.Itoa(next),
+		Timestamp: time.Now().Format("2006:01:02 15:04:05"),
+	}
+	c.snapshots = append(c.snapshots, s)
+
+	return &s, nil
+}
+
+func (d *fakeDriver) RestoreSnapshot(lxcpath string, name string, snapshot string, newName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return err
+	}
+	if !c.hasSnapshot(snapshot) {
+		return errNoSnapshot
+	}
+	if newName == name {
+		return nil
+	}
+	if _, err := d.get(lxcpath, newName); err == nil {
+		return fmt.Errorf("%w: %q", errAlreadyDefined, newName)
+	}
+
+	restored := &fakeContainer{state: "STOPPED", config: make(map[string][]string)}
+	for key, values := range c.config {
+		restored.config[key] = append([]string(nil), values...)
+	}
+	restored.config["lxc.uts.name"] = []string{newName}
+
+	d.containers[fakeKey(lxcpath, newName)] = restored
+	return nil
+}
+
+func (d *fakeDriver) DestroySnapshot(lxcpath string, name string, snapshot string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return err
+	}
+
+	for i, s := range c.snapshots {
+		if s.Name == snapshot {
+			c.snapshots = append(c.snapshots[:i], c.snapshots[i+1:]...)
+			return nil
+		}
+	}
+	return errNoSnapshot
+}
+
+func (c *fakeContainer) hasSnapshot(snapshot string) bool {
+	for _, s := range c.snapshots {
+		if s.Name == snapshot {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *fakeDriver) ConfigItem(lxcpath string, name string, key string) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), c.config[key]...), nil
+}
+
+func (d *fakeDriver) SetConfigItem(lxcpath string, name string, key string, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return err
+	}
+
+	// As in LXC config files, an empty value clears the key
+	if value == "" {
+		delete(c.config, key)
+	} else {
+		c.config[key] = append(c.config[key], value)
+	}
+	return nil
+}
+
+// Exec understands echo, true and false, and succeeds silently with any
+// other command
+func (d *fakeDriver) Exec(lxcpath string, name string, cmd ExecCommand) (*ExecResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return nil, err
+	}
+	if c.state != "RUNNING" {
+		return nil, fmt.Errorf("%w: %q", errNotRunning, name)
+	}
+	if len(cmd.Args) == 0 {
+		return nil, fmt.Errorf("no command passed")
+	}
+
+	result := &ExecResult{}
+	switch cmd.Args[0] {
+	case "echo":
+		result.Stdout = strings.Join(cmd.Args[1:], " ") + "\n"
+	case "false":
+		result.ExitCode = 1
+	}
+
+	return result, nil
+}
+
+func (d *fakeDriver) Metrics(lxcpath string, name string) (*Metrics, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return nil, err
+	}
+	if c.state != "RUNNING" {
+		return nil, fmt.Errorf("%w: %q", errNotRunning, name)
+	}
+
+	return &Metrics{
+		MemoryUsage: 32 << 20,
+		CPUTime:     time.Since(c.started) / 100,
+	}, nil
+}
+
+func (d *fakeDriver) Metadata(lxcpath string, name string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.containers[fakeKey(lxcpath, name)]
+	if !ok {
+		return nil, nil
+	}
+	return c.metadata, nil
+}
+
+func (d *fakeDriver) SetMetadata(lxcpath string, name string, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.get(lxcpath, name)
+	if err != nil {
+		return err
+	}
+	c.metadata = append([]byte(nil), data...)
+	return nil
+}
+
+// LXCInfo reports no extension, and the default global configuration
+func (d *fakeDriver) LXCInfo() *LXCInfo {
+	return &LXCInfo{
+		Version:    d.Version(),
+		Extensions: []string{},
+		Config: map[string]string{
+			"lxc.lxcpath":       "/var/lib/lxc",
+			"lxc.bdev.lvm.vg":   "lxc",
+			"lxc.bdev.zfs.root": "lxc",
+		},
+	}
+}
+
+// Checks has a single check, failing when d.unready is set
+func (d *fakeDriver) Checks(roots map[string]string) []readinessCheck {
+	return []readinessCheck{
+		{"fake", func(context.Context) (string, error) {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+
+			return fmt.Sprintf("%d containers", len(d.containers)), d.unready
+		}},
+	}
+}
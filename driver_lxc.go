@@ -0,0 +1,426 @@
+//go:build linux && cgo
+// +build linux,cgo
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	lxc "gopkg.in/lxc/go-lxc.v2"
+)
+
+func init() {
+	drivers["lxc"] = func() Driver { return lxcDriver{} }
+}
+
+// lxcErrors maps go-lxc errors to driver errors
+var lxcErrors = map[error]error{
+	lxc.ErrNotDefined:         errNotDefined,
+	lxc.ErrAlreadyDefined:     errAlreadyDefined,
+	lxc.ErrAlreadyRunning:     errAlreadyRunning,
+	lxc.ErrNotRunning:         errNotRunning,
+	lxc.ErrAlreadyFrozen:      errAlreadyFrozen,
+	lxc.ErrNotFrozen:          errNotFrozen,
+	lxc.ErrNoSnapshot:         errNoSnapshot,
+	lxc.ErrTemplateNotAllowed: errTemplateNotAllowed,
+	lxc.ErrNotSupported:       errNotSupported,
+}
+
+// lxcDriver runs containers with liblxc
+type lxcDriver struct{}
+
+// translate turns go-lxc errors into driver errors. go-lxc prefixes the
+// container name to some of its errors, so they are matched by prefix.
+func (lxcDriver) translate(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	for lxcErr, driverErr := range lxcErrors {
+		if err == lxcErr {
+			return driverErr
+		}
+		if msg := lxcErr.Error(); strings.HasPrefix(err.Error(), msg+":") {
+			return fmt.Errorf("%w%s", driverErr, strings.TrimPrefix(err.Error(), msg))
+		}
+	}
+
+	return err
+}
+
+// container returns the go-lxc handle of a container, to be released by
+// the caller
+func (d lxcDriver) container(lxcpath string, name string) (*lxc.Container, error) {
+	c, err := lxc.NewContainer(name, lxcpath)
+	return c, d.translate(err)
+}
+
+// with calls fn with the go-lxc handle of a container
+func (d lxcDriver) with(lxcpath string, name string, fn func(c *lxc.Container) error) error {
+	c, err := d.container(lxcpath, name)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+
+	return d.translate(fn(c))
+}
+
+func (lxcDriver) Version() string {
+	return lxc.Version()
+}
+
+func (lxcDriver) List(lxcpath string) ([]string, error) {
+	return lxc.ContainerNames(lxcpath), nil
+}
+
+func (d lxcDriver) State(lxcpath string, name string) (string, error) {
+	var state string
+	err := d.with(lxcpath, name, func(c *lxc.Container) error {
+		if !c.Defined() {
+			return lxc.ErrNotDefined
+		}
+		state = c.State().String()
+		return nil
+	})
+	return state, err
+}
+
+func (d lxcDriver) Create(lxcpath string, name string, opts TemplateOptions) error {
+	return d.with(lxcpath, name, func(c *lxc.Container) error {
+		return c.Create(lxc.TemplateOptions{
+			Template:             opts.Template,
+			Backend:              lxc.BackendStore(opts.Backend),
+			Distro:               opts.Distro,
+			Release:              opts.Release,
+			Arch:                 opts.Arch,
+			Variant:              opts.Variant,
+			Server:               opts.Server,
+			KeyID:                opts.KeyID,
+			KeyServer:            opts.KeyServer,
+			DisableGPGValidation: opts.DisableGPGValidation,
+			FlushCache:           opts.FlushCache,
+			ForceCache:           opts.ForceCache,
+			ExtraArgs:            opts.ExtraArgs,
+		})
+	})
+}
+
+func (d lxcDriver) Start(lxcpath string, name string) error {
+	return d.with(lxcpath, name, func(c *lxc.Container) error {
+		return c.Start()
+	})
+}
+
+func (d lxcDriver) Stop(lxcpath string, name string) error {
+	return d.with(lxcpath, name, func(c *lxc.Container) error {
+		return c.Stop()
+	})
+}
+
+func (d lxcDriver) Freeze(lxcpath string, name string) error {
+	return d.with(lxcpath, name, func(c *lxc.Container) error {
+		return c.Freeze()
+	})
+}
+
+func (d lxcDriver) Destroy(lxcpath string, name string) error {
+	return d.with(lxcpath, name, func(c *lxc.Container) error {
+		return c.Destroy()
+	})
+}
+
+func (d lxcDriver) Clone(lxcpath string, name string, targetPath string, opts CloneOptions) error {
+	return d.with(lxcpath, name, func(c *lxc.Container) error {
+		return c.Clone(opts.Name, lxc.CloneOptions{
+			ConfigPath: targetPath,
+			KeepName:   opts.KeepName,
+			KeepMAC:    opts.KeepMAC,
+			Snapshot:   opts.Snapshot,
+		})
+	})
+}
+
+func (d lxcDriver) Snapshots(lxcpath string, name string) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	err := d.with(lxcpath, name, func(c *lxc.Container) error {
+		list, err := c.Snapshots()
+		if err == lxc.ErrNoSnapshot {
+			return nil
+		}
+		for _, s := range list {
+			snapshots = append(snapshots, Snapshot{Name: s.Name, Timestamp: s.Timestamp})
+		}
+		return err
+	})
+	return snapshots, err
+}
+
+func (d lxcDriver) CreateSnapshot(lxcpath string, name string) (*Snapshot, error) {
+	var snapshot *Snapshot
+	err := d.with(lxcpath, name, func(c *lxc.Container) error {
+		s, err := c.CreateSnapshot()
+		if err != nil {
+			return err
+		}
+		snapshot = &Snapshot{Name: s.Name, Timestamp: s.Timestamp}
+		return nil
+	})
+	return snapshot, err
+}
+
+func (d lxcDriver) RestoreSnapshot(lxcpath string, name string, snapshot string, newName string) error {
+	return d.with(lxcpath, name, func(c *lxc.Container) error {
+		return c.RestoreSnapshot(lxc.Snapshot{Name: snapshot}, newName)
+	})
+}
+
+func (d lxcDriver) DestroySnapshot(lxcpath string, name string, snapshot string) error {
+	return d.with(lxcpath, name, func(c *lxc.Container) error {
+		return c.DestroySnapshot(lxc.Snapshot{Name: snapshot})
+	})
+}
+
+func (d lxcDriver) ConfigItem(lxcpath string, name string, key string) ([]string, error) {
+	var values []string
+	err := d.with(lxcpath, name, func(c *lxc.Container) error {
+		if !c.Defined() {
+			return lxc.ErrNotDefined
+		}
+		values = c.ConfigItem(key)
+		return nil
+	})
+	return values, err
+}
+
+func (d lxcDriver) SetConfigItem(lxcpath string, name string, key string, value string) error {
+	return d.with(lxcpath, name, func(c *lxc.Container) error {
+		if !c.Defined() {
+			return lxc.ErrNotDefined
+		}
+		if err := c.SetConfigItem(key, value); err != nil {
+			return err
+		}
+		return c.SaveConfigFile(c.ConfigFileName())
+	})
+}
+
+func (d lxcDriver) Exec(lxcpath string, name string, cmd ExecCommand) (*ExecResult, error) {
+	result := &ExecResult{}
+
+	err := d.with(lxcpath, name, func(c *lxc.Container) error {
+		stdin, err := os.Open(os.DevNull)
+		if err != nil {
+			return err
+		}
+		defer stdin.Close()
+
+		stdoutR, stdoutW, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer stdoutR.Close()
+
+		stderrR, stderrW, err := os.Pipe()
+		if err != nil {
+			stdoutW.Close()
+			return err
+		}
+		defer stderrR.Close()
+
+		var stdout, stderr bytes.Buffer
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { io.Copy(&stdout, stdoutR); wg.Done() }()
+		go func() { io.Copy(&stderr, stderrR); wg.Done() }()
+
+		opts := lxc.DefaultAttachOptions
+		opts.Env = cmd.Env
+		if cmd.Cwd != "" {
+			opts.Cwd = cmd.Cwd
+		}
+		opts.StdinFd = stdin.Fd()
+		opts.StdoutFd = stdoutW.Fd()
+		opts.StderrFd = stderrW.Fd()
+
+		result.ExitCode, err = c.RunCommandStatus(cmd.Args, opts)
+
+		stdoutW.Close()
+		stderrW.Close()
+		wg.Wait()
+
+		result.Stdout = stdout.String()
+		result.Stderr = stderr.String()
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (d lxcDriver) Metrics(lxcpath string, name string) (*Metrics, error) {
+	metrics := &Metrics{}
+
+	err := d.with(lxcpath, name, func(c *lxc.Container) error {
+		usage, err := c.MemoryUsage()
+		if err != nil {
+			return err
+		}
+		metrics.MemoryUsage = int64(usage)
+
+		// The memory controller reports a huge value when unlimited
+		if limit, err := c.MemoryLimit(); err == nil && limit < lxc.EB {
+			metrics.MemoryLimit = int64(limit)
+		}
+
+		if metrics.CPUTime, err = c.CPUTime(); err != nil {
+			return err
+		}
+
+		blkio, err := c.BlkioUsage()
+		if err != nil {
+			return err
+		}
+		metrics.BlkioUsage = int64(blkio)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// Metadata is stored in a file of the container directory, so that it goes
+// away with the container
+func (lxcDriver) Metadata(lxcpath string, name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(lxcpath, name, metadataFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (lxcDriver) SetMetadata(lxcpath string, name string, data []byte) error {
+	return ioutil.WriteFile(filepath.Join(lxcpath, name, metadataFile), data, 0600)
+}
+
+func (lxcDriver) LXCInfo() *LXCInfo {
+	info := &LXCInfo{
+		Version:    lxc.Version(),
+		Extensions: []string{},
+		Config:     make(map[string]string, len(lxcGlobalConfigItems)),
+	}
+	info.Major, info.Minor = lxc.VersionNumber()
+
+	for _, extension := range lxcExtensions {
+		if lxc.HasApiExtension(extension) {
+			info.Extensions = append(info.Extensions, extension)
+		}
+	}
+
+	for _, key := range lxcGlobalConfigItems {
+		info.Config[key] = lxc.GlobalConfigItem(key)
+	}
+
+	return info
+}
+
+// lxcGlobalConfig is the system-wide LXC configuration, setting storage
+// backends
+const lxcGlobalConfig = "/etc/lxc/lxc.conf"
+
+// Checks verifies the storage roots are writable, liblxc reports its
+// version and cgroups are mounted. The default LVM volume group and ZFS
+// root are checked when lxc.conf sets them, liblxc defaulting to them
+// whether they exist or not.
+func (lxcDriver) Checks(roots map[string]string) []readinessCheck {
+	checks := []readinessCheck{
+		{"liblxc", func(context.Context) (string, error) {
+			version := lxc.Version()
+			if version == "" {
+				return "", errors.New("liblxc reports no version")
+			}
+			return version, nil
+		}},
+		{"cgroups", func(context.Context) (string, error) {
+			return checkCgroups("/proc/self/mountinfo")
+		}},
+	}
+
+	names := make([]string, 0, len(roots))
+	for name := range roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := roots[name]
+		check := "roots." + name
+		if name == defaultRoot {
+			check = "lxcpath"
+		}
+
+		checks = append(checks, readinessCheck{check, func(context.Context) (string, error) {
+			return path, checkWritable(path)
+		}})
+	}
+
+	configured := lxcConfiguredKeys(lxcGlobalConfig)
+
+	if configured["lxc.bdev.lvm.vg"] || configured["lxc.lvm_vg"] {
+		vg := lxc.DefaultLvmVg()
+		checks = append(checks, readinessCheck{"lvm", func(ctx context.Context) (string, error) {
+			return vg, checkCommand(ctx, "vgs", "--noheadings", vg)
+		}})
+	}
+
+	if configured["lxc.bdev.zfs.root"] || configured["lxc.zfsroot"] {
+		root := lxc.DefaultZfsRoot()
+		checks = append(checks, readinessCheck{"zfs", func(ctx context.Context) (string, error) {
+			return root, checkCommand(ctx, "zfs", "list", "-H", "-o", "name", root)
+		}})
+	}
+
+	return checks
+}
+
+// lxcConfiguredKeys returns the keys set by the LXC configuration file at
+// path, none when it does not exist
+func lxcConfiguredKeys(path string) map[string]bool {
+	keys := make(map[string]bool)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return keys
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.Index(line, "="); i > 0 {
+			keys[strings.TrimSpace(line[:i])] = true
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// errorStatus gives the HTTP status and machine-readable code replied for
+// an error
+type errorStatus struct {
+	err    error
+	status int
+	code   string
+}
+
+// errorStatuses maps driver errors, and other errors clients must tell
+// apart, to responses. Codes are part of the API: clients branch on them,
+// so they must not change.
+var errorStatuses = []errorStatus{
+	{errNotDefined, http.StatusNotFound, "not_defined"},
+	{errAlreadyDefined, http.StatusConflict, "already_defined"},
+	{errAlreadyRunning, http.StatusConflict, "already_running"},
+	{errNotRunning, http.StatusConflict, "not_running"},
+	{errAlreadyFrozen, http.StatusConflict, "already_frozen"},
+	{errNotFrozen, http.StatusConflict, "not_frozen"},
+	{errNoSnapshot, http.StatusNotFound, "no_snapshot"},
+	{errTemplateNotAllowed, http.StatusForbidden, "template_not_allowed"},
+	{errNotSupported, http.StatusNotImplemented, "not_supported"},
+	{errContainerBusy, http.StatusConflict, "container_busy"},
+	{errIdempotencyKeyReused, http.StatusUnprocessableEntity, "idempotency_key_reused"},
+	{errIdempotencyKeyInProgress, http.StatusConflict, "idempotency_key_in_progress"},
+	{errRateLimited, http.StatusTooManyRequests, "rate_limited"},
+	{errConcurrencyLimited, http.StatusTooManyRequests, "concurrency_limited"},
+	{errQuotaExceeded, http.StatusForbidden, "quota_exceeded"},
+	{errNoProfile, http.StatusNotFound, "no_profile"},
+	{errProfileExists, http.StatusConflict, "profile_exists"},
+	{errConfigNotAllowed, http.StatusUnprocessableEntity, "config_not_allowed"},
+}
+
+// statusCodes are the codes of errors that are not in errorStatuses
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusNotImplemented:        "not_implemented",
+}
+
+// knownError returns the response of err when it is one of errorStatuses
+func knownError(err error) (errorStatus, bool) {
+	for _, s := range errorStatuses {
+		if errors.Is(err, s.err) {
+			return s, true
+		}
+	}
+	return errorStatus{}, false
+}
+
+// driverError returns the API error replied when a driver call fails
+func driverError(err error) *apiError {
+	status := http.StatusInternalServerError
+	if s, ok := knownError(err); ok {
+		status = s.status
+	}
+	return &apiError{err, err.Error(), status}
+}
+
+// errorCode returns the machine-readable code of e
+func errorCode(e *apiError) string {
+	if s, ok := knownError(e.Error); ok {
+		return s.code
+	}
+
+	if code, ok := statusCodes[e.Code]; ok {
+		return code
+	}
+	return "error"
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDriverError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{fmt.Errorf("%w: %q", errNotDefined, "c1"), 404, "not_defined"},
+		{fmt.Errorf("%w: %q", errAlreadyDefined, "c1"), 409, "already_defined"},
+		{fmt.Errorf("%w: %q", errAlreadyRunning, "c1"), 409, "already_running"},
+		{fmt.Errorf("%w: %q", errNotRunning, "c1"), 409, "not_running"},
+		{errNoSnapshot, 404, "no_snapshot"},
+		{errTemplateNotAllowed, 403, "template_not_allowed"},
+		{errNotSupported, 501, "not_supported"},
+		{errors.New("creating the container failed"), 500, "internal_error"},
+	}
+
+	for _, tt := range tests {
+		e := driverError(tt.err)
+		if e.Code != tt.status || errorCode(e) != tt.code {
+			t.Errorf("%v: status %d code %s, want %d %s", tt.err, e.Code, errorCode(e), tt.status, tt.code)
+		}
+		if e.Message != tt.err.Error() {
+			t.Errorf("%v: message %q", tt.err, e.Message)
+		}
+	}
+}
@@ -3,7 +3,13 @@ module github.com/lxc-go-http-api
 go 1.14
 
 require (
+	github.com/go-openapi/errors v0.19.6
+	github.com/go-openapi/loads v0.19.5
 	github.com/go-openapi/runtime v0.19.19
+	github.com/go-openapi/spec v0.19.8
+	github.com/go-openapi/strfmt v0.19.5
+	github.com/go-openapi/validate v0.19.10
 	github.com/gorilla/mux v1.7.4
 	gopkg.in/lxc/go-lxc.v2 v2.0.0-20200518152310-1ee44cc86c87
+	gopkg.in/yaml.v2 v2.3.0
 )
\ No newline at end of file
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// readinessTimeout bounds each readiness check
+	readinessTimeout = 5 * time.Second
+
+	// readinessCacheTTL is how long the outcome of the readiness checks is
+	// reused, for probes not to run them on every request
+	readinessCacheTTL = 5 * time.Second
+)
+
+// Outcomes of readiness checks
+const (
+	checkOK     = "ok"
+	checkFailed = "failed"
+)
+
+// readinessCheck is a self-check telling whether the server can serve. run
+// returns details worth reporting, such as a version, or why it failed.
+type readinessCheck struct {
+	name string
+	run  func(ctx context.Context) (string, error)
+}
+
+// Health model
+// swagger:model Health
+type Health struct {
+	// Always ok, the server answering at all
+	// example: ok
+	Status string `json:"status"`
+}
+
+// Readiness model
+// swagger:model Readiness
+type Readiness struct {
+	// ready when every check passed
+	// enum: ready,not_ready
+	// example: ready
+	Status string `json:"status"`
+
+	// Checks run, those of the server then those of the driver. Only
+	// reported to authenticated callers.
+	Checks []ReadinessCheck `json:"checks,omitempty"`
+}
+
+// ReadinessCheck model
+// swagger:model ReadinessCheck
+type ReadinessCheck struct {
+	// example: liblxc
+	Name string `json:"name"`
+
+	// enum: ok,failed
+	// example: ok
+	Status string `json:"status"`
+
+	// What the check found, such as a version
+	// example: 4.0.12
+	Detail string `json:"detail,omitempty"`
+
+	// Why the check failed
+	// example: /var/lib/lxc: read-only file system
+	Error string `json:"error,omitempty"`
+
+	// How long the check took
+	// example: 0.42
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// readinessCache keeps the latest outcome of the readiness checks
+type readinessCache struct {
+	mu      sync.Mutex
+	result  *Readiness
+	expires time.Time
+}
+
+// readinessProbe caches the readiness checks run for /readyz
+var readinessProbe = &readinessCache{}
+
+// get returns the outcome of the readiness checks, running them when the
+// last one is older than readinessCacheTTL. Concurrent callers wait for the
+// same run.
+func (c *readinessCache) get() *Readiness {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.result == nil || time.Now().After(c.expires) {
+		c.result = runChecks(context.Background(), readinessChecks())
+		c.expires = time.Now().Add(readinessCacheTTL)
+	}
+	return c.result
+}
+
+// readinessChecks returns the checks of the server: its own state
+// directory, then those of the driver
+func readinessChecks() []readinessCheck {
+	checks := []readinessCheck{
+		{"state_dir", func(context.Context) (string, error) {
+			return config.StateDir, checkWritable(config.StateDir)
+		}},
+	}
+
+	return append(checks, driver.Checks(config.Roots)...)
+}
+
+// runChecks runs checks concurrently, each for up to readinessTimeout
+func runChecks(ctx context.Context, checks []readinessCheck) *Readiness {
+	readiness := &Readiness{Status: "ready", Checks: make([]ReadinessCheck, len(checks))}
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(result *ReadinessCheck, check readinessCheck) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+			defer cancel()
+
+			start := time.Now()
+			detail, err := runCheck(ctx, check)
+
+			*result = ReadinessCheck{
+				Name:       check.name,
+				Status:     checkOK,
+				Detail:     detail,
+				DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = checkFailed
+				result.Error = err.Error()
+			}
+		}(&readiness.Checks[i], check)
+	}
+	wg.Wait()
+
+	for _, result := range readiness.Checks {
+		if result.Status != checkOK {
+			readiness.Status = "not_ready"
+		}
+	}
+
+	return readiness
+}
+
+// runCheck returns the outcome of check, or the context error when it
+// outlasts ctx
+func runCheck(ctx context.Context, check readinessCheck) (string, error) {
+	type outcome struct {
+		detail string
+		err    error
+	}
+
+	done := make(chan outcome, 1)
+	go func() {
+		detail, err := check.run(ctx)
+		done <- outcome{detail, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.detail, o.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("timed out after %s", readinessTimeout)
+	}
+}
+
+// checkWritable fails unless dir is a directory files can be created in
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".readyz-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// checkCgroups returns the cgroup hierarchies mounted, as listed by the
+// mountinfo file at path, and fails when there is none
+func checkCgroups(path string) (string, error) {
+	found, err := cgroupFilesystems(path)
+	if err != nil {
+		return "", err
+	}
+
+	if len(found) == 0 {
+		return "", errors.New("no cgroup hierarchy mounted")
+	}
+
+	return strings.Join(found, ", "), nil
+}
+
+// cgroupFilesystems returns the types of the cgroup hierarchies listed by
+// the mountinfo file at path, cgroup for v1 and cgroup2
+func cgroupFilesystems(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []string
+	seen := make(map[string]bool)
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		// The filesystem type follows the separator of optional fields
+		fields := strings.Fields(s.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) {
+				fstype := fields[i+1]
+				if (fstype == "cgroup" || fstype == "cgroup2") && !seen[fstype] {
+					seen[fstype] = true
+					found = append(found, fstype)
+				}
+				break
+			}
+		}
+	}
+
+	sort.Strings(found)
+	return found, nil
+}
+
+// checkCommand runs a command checking a storage backend, and fails with
+// its output
+func checkCommand(ctx context.Context, name string, args ...string) error {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %v: %s", name, err, msg)
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// GetHealth tells the server is alive
+func GetHealth(w http.ResponseWriter, r *http.Request) *apiError {
+	return writeJSON(w, http.StatusOK, &Health{Status: "ok"})
+}
+
+// GetReadiness runs the readiness checks, and replies 503 when one of
+// them fails. Anonymous callers only get the status, the checks reporting
+// host paths and errors.
+func GetReadiness(w http.ResponseWriter, r *http.Request) *apiError {
+	result := readinessProbe.get()
+
+	status := http.StatusOK
+	if result.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+
+	if principalFromContext(r.Context()) == nil {
+		return writeJSON(w, status, &Readiness{Status: result.Status})
+	}
+	return writeJSON(w, status, result)
+}
+
+// sdNotify sends state to the systemd notification socket, when the
+// server runs as a notify service
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Abstract sockets are written with a leading @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// readinessStatus summarizes the readiness checks for systemd
+func readinessStatus(readiness *Readiness) string {
+	var failed []string
+	for _, check := range readiness.Checks {
+		if check.Status != checkOK {
+			failed = append(failed, check.Name+": "+check.Error)
+		}
+	}
+
+	if len(failed) == 0 {
+		return "STATUS=ready"
+	}
+	return "STATUS=not ready, " + strings.Join(failed, "; ")
+}
+
+// notifyReady tells systemd the server is started, then pings its watchdog
+// while the readiness checks pass, until stop is closed. A server which
+// can no longer serve containers is then restarted.
+func notifyReady(stop <-chan struct{}) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	readiness := runChecks(context.Background(), readinessChecks())
+	if err := sdNotify("READY=1\n" + readinessStatus(readiness)); err != nil {
+		logger.Warn("systemd not notified", "error", err)
+		return
+	}
+
+	interval, err := watchdogInterval()
+	if err != nil || interval == 0 {
+		if err != nil {
+			logger.Warn("systemd watchdog ignored", "error", err)
+		}
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		readiness := runChecks(context.Background(), readinessChecks())
+		state := readinessStatus(readiness)
+		if readiness.Status == "ready" {
+			state = "WATCHDOG=1\n" + state
+		}
+
+		if err := sdNotify(state); err != nil {
+			logger.Warn("systemd not notified", "error", err)
+		}
+	}
+}
+
+// watchdogInterval returns the systemd watchdog interval, 0 when the
+// watchdog is disabled or meant for another process
+func watchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != fmt.Sprint(os.Getpid()) {
+		return 0, nil
+	}
+
+	var n int64
+	if _, err := fmt.Sscan(usec, &n); err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+
+	return time.Duration(n) * time.Microsecond, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	api := newTestAPI(t)
+
+	status, body := api.do(t, "GET", "/healthz", "", nil)
+	expectStatus(t, status, 200, body)
+
+	var health Health
+	decode(t, body, &health)
+	if health.Status != "ok" {
+		t.Errorf("status %q, want ok", health.Status)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	api := newTestAPI(t)
+
+	var readiness Readiness
+	status, body := api.do(t, "GET", "/readyz", api.admin, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &readiness)
+
+	if readiness.Status != "ready" || len(readiness.Checks) != 2 ||
+		readiness.Checks[0].Name != "state_dir" || readiness.Checks[1].Name != "fake" {
+		t.Fatalf("unexpected readiness %s", body)
+	}
+	for _, check := range readiness.Checks {
+		if check.Status != checkOK || check.Error != "" || check.Detail == "" {
+			t.Errorf("unexpected check %+v", check)
+		}
+	}
+
+	driver.(*fakeDriver).unready = errors.New("backend gone")
+	config.StateDir = filepath.Join(config.StateDir, "missing")
+
+	// The outcome of the checks is reused for a while
+	status, body = api.do(t, "GET", "/readyz", "", nil)
+	expectStatus(t, status, 200, body)
+
+	readiness = Readiness{}
+	readinessProbe = &readinessCache{}
+	status, body = api.do(t, "GET", "/readyz", api.admin, nil)
+	expectStatus(t, status, 503, body)
+	decode(t, body, &readiness)
+
+	if readiness.Status != "not_ready" {
+		t.Errorf("status %q, want not_ready", readiness.Status)
+	}
+	for _, check := range readiness.Checks {
+		if check.Status != checkFailed || check.Error == "" {
+			t.Errorf("check %s did not fail: %+v", check.Name, check)
+		}
+	}
+	if readiness.Checks[1].Error != "backend gone" {
+		t.Errorf("driver check error %q", readiness.Checks[1].Error)
+	}
+
+	// Anonymous callers only get the status
+	status, body = api.do(t, "GET", "/readyz", "", nil)
+	expectStatus(t, status, 503, body)
+	if strings.Contains(string(body), "checks") || !strings.Contains(string(body), "not_ready") {
+		t.Errorf("anonymous readiness %s", body)
+	}
+}
+
+func TestCheckCgroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxc-go-http-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	tests := []struct {
+		name      string
+		mountinfo string
+		want      string
+	}{
+		{"unified", "35 24 0:30 / /sys/fs/cgroup rw,nosuid shared:9 - cgroup2 cgroup2 rw\n", "cgroup2"},
+		{"hybrid", "" +
+			"25 24 0:22 / /sys/fs/cgroup ro shared:9 - tmpfs tmpfs ro,mode=755\n" +
+			"26 25 0:23 / /sys/fs/cgroup/unified rw shared:10 - cgroup2 cgroup2 rw\n" +
+			"27 25 0:24 / /sys/fs/cgroup/memory rw shared:11 - cgroup cgroup rw,memory\n" +
+			"28 25 0:25 / /sys/fs/cgroup/cpu rw - cgroup cgroup rw,cpu\n", "cgroup, cgroup2"},
+		{"none", "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.name)
+			if err := ioutil.WriteFile(path, []byte(test.mountinfo), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := checkCgroups(path)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("found %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("found %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+// setenv sets an environment variable until the end of the test
+func setenv(t *testing.T, key string, value string) {
+	previous, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+	os.Setenv(key, value)
+}
+
+func TestNotifyReady(t *testing.T) {
+	newTestAPI(t)
+
+	dir, err := ioutil.TempDir("", "lxc-go-http-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	setenv(t, "NOTIFY_SOCKET", path)
+	setenv(t, "WATCHDOG_USEC", "20000")
+	setenv(t, "WATCHDOG_PID", "")
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		notifyReady(stop)
+		close(done)
+	}()
+
+	read := func() string {
+		t.Helper()
+
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	if got := read(); got != "READY=1\nSTATUS=ready" {
+		t.Errorf("first notification %q", got)
+	}
+	if got := read(); got != "WATCHDOG=1\nSTATUS=ready" {
+		t.Errorf("watchdog notification %q", got)
+	}
+
+	// The watchdog is no longer pinged once a check fails
+	driver.(*fakeDriver).mu.Lock()
+	driver.(*fakeDriver).unready = errors.New("backend gone")
+	driver.(*fakeDriver).mu.Unlock()
+
+	got := read()
+	for strings.HasPrefix(got, "WATCHDOG=1\n") {
+		got = read()
+	}
+	if got != "STATUS=not ready, fake: backend gone" {
+		t.Errorf("unready notification %q", got)
+	}
+
+	close(stop)
+	<-done
+}
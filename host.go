@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Files of the host read by GET /v1/host
+const (
+	mountinfoFile      = "/proc/self/mountinfo"
+	meminfoFile        = "/proc/meminfo"
+	osreleaseFile      = "/proc/sys/kernel/osrelease"
+	filesystemsFile    = "/proc/filesystems"
+	seccompActionsFile = "/proc/sys/kernel/seccomp/actions_avail"
+)
+
+// lxcExtensions are the liblxc API extensions reported when supported
+var lxcExtensions = []string{
+	"lxc_log",
+	"lxc_config_item_is_supported",
+	"console_log",
+	"reboot2",
+	"mount_injection",
+	"cgroup_relative",
+	"mount_injection_file",
+	"seccomp_allow_nesting",
+	"seccomp_notify",
+	"network_veth_routes",
+	"network_ipvlan",
+	"network_l2proxy",
+	"network_gateway_device_route",
+	"network_phys_macvlan_mtu",
+	"network_veth_router",
+	"cgroup2_devices",
+	"cgroup2",
+	"pidfd",
+	"cgroup_advanced_isolation",
+	"network_bridge_vlan",
+	"time_namespace",
+	"seccomp_allow_deny_syntax",
+	"devpts_fd",
+	"seccomp_notify_fd_active",
+	"seccomp_proxy_send_notify_fd",
+	"idmapped_mounts",
+	"idmapped_mounts_v2",
+	"core_scheduling",
+}
+
+// lxcGlobalConfigItems are the global configuration items reported
+var lxcGlobalConfigItems = []string{
+	"lxc.lxcpath",
+	"lxc.bdev.lvm.vg",
+	"lxc.bdev.zfs.root",
+}
+
+// storageBackend is a container storage type, available when its command
+// is found and its filesystem known to the kernel
+type storageBackend struct {
+	name       string
+	command    string
+	filesystem string
+}
+
+var storageBackends = []storageBackend{
+	{name: "dir"},
+	{name: "btrfs", command: "btrfs", filesystem: "btrfs"},
+	{name: "lvm", command: "lvcreate"},
+	{name: "zfs", command: "zfs", filesystem: "zfs"},
+	{name: "overlay", filesystem: "overlay"},
+	{name: "loop", command: "losetup"},
+	{name: "rbd", command: "rbd"},
+}
+
+// Host model
+// swagger:model Host
+type Host struct {
+	// liblxc
+	LXC *LXCInfo `json:"lxc"`
+
+	// Storage backends containers can be created with
+	// example: ["dir", "btrfs", "overlay"]
+	StorageBackends []string `json:"storage_backends"`
+
+	// cgroup hierarchies mounted: 1, 2, hybrid for both, or none
+	// enum: 1,2,hybrid,none
+	// example: 2
+	CgroupVersion string `json:"cgroup_version"`
+
+	// Kernel release
+	// example: 5.15.0-91-generic
+	Kernel string `json:"kernel"`
+
+	// Number of CPUs
+	// example: 8
+	CPUs int `json:"cpus"`
+
+	// Total memory in bytes
+	// example: 16777216000
+	MemoryBytes uint64 `json:"memory_bytes"`
+
+	// CRIU is installed, for checkpoints and migrations
+	// example: false
+	CRIU bool `json:"criu"`
+
+	// Both the kernel and liblxc support seccomp notifications
+	// example: true
+	SeccompNotify bool `json:"seccomp_notify"`
+}
+
+// LXCInfo model
+// swagger:model LXCInfo
+type LXCInfo struct {
+	// example: 4.0.12
+	Version string `json:"version"`
+
+	// Version the API was built against
+	// example: 4
+	Major int `json:"major"`
+
+	// example: 0
+	Minor int `json:"minor"`
+
+	// Supported API extensions
+	// example: ["seccomp_notify", "cgroup2", "pidfd"]
+	Extensions []string `json:"extensions"`
+
+	// Global configuration items, by key
+	// example: {"lxc.lxcpath": "/var/lib/lxc", "lxc.bdev.lvm.vg": "lxc", "lxc.bdev.zfs.root": "lxc"}
+	Config map[string]string `json:"config"`
+}
+
+// HasExtension reports whether liblxc supports extension
+func (i *LXCInfo) HasExtension(extension string) bool {
+	for _, e := range i.Extensions {
+		if e == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// hostInfo returns what the host supports, with info about liblxc
+func hostInfo(info *LXCInfo) (*Host, error) {
+	host := &Host{
+		LXC:  info,
+		CPUs: runtime.NumCPU(),
+	}
+
+	cgroups, err := cgroupFilesystems(mountinfoFile)
+	if err != nil {
+		return nil, err
+	}
+	host.CgroupVersion = cgroupVersion(cgroups)
+
+	release, err := ioutil.ReadFile(osreleaseFile)
+	if err != nil {
+		return nil, err
+	}
+	host.Kernel = strings.TrimSpace(string(release))
+
+	if host.MemoryBytes, err = memTotal(meminfoFile); err != nil {
+		return nil, err
+	}
+
+	filesystems, err := kernelFilesystems(filesystemsFile)
+	if err != nil {
+		return nil, err
+	}
+	host.StorageBackends = availableBackends(filesystems, commandExists)
+
+	host.CRIU = commandExists("criu")
+
+	actions, err := ioutil.ReadFile(seccompActionsFile)
+	host.SeccompNotify = err == nil && info.HasExtension("seccomp_notify") &&
+		containsField(string(actions), "user_notif")
+
+	return host, nil
+}
+
+// cgroupVersion returns the version of the cgroup hierarchies of types
+func cgroupVersion(types []string) string {
+	switch strings.Join(types, ",") {
+	case "cgroup":
+		return "1"
+	case "cgroup2":
+		return "2"
+	case "cgroup,cgroup2":
+		return "hybrid"
+	}
+	return "none"
+}
+
+// memTotal returns the total memory of the host, in bytes, from the
+// meminfo file at path
+func memTotal(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var kb uint64
+		if _, err := fmt.Sscanf(s.Text(), "MemTotal: %d kB", &kb); err == nil {
+			return kb * 1024, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("%s: no MemTotal", path)
+}
+
+// kernelFilesystems returns the filesystem types the kernel knows, from
+// the filesystems file at path
+func kernelFilesystems(path string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	filesystems := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			filesystems[fields[len(fields)-1]] = true
+		}
+	}
+
+	return filesystems, nil
+}
+
+// availableBackends returns the storage backends whose command exists and
+// whose filesystem is known
+func availableBackends(filesystems map[string]bool, exists func(string) bool) []string {
+	available := []string{}
+	for _, b := range storageBackends {
+		if b.command != "" && !exists(b.command) {
+			continue
+		}
+		if b.filesystem != "" && !filesystems[b.filesystem] {
+			continue
+		}
+		available = append(available, b.name)
+	}
+	return available
+}
+
+func commandExists(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// containsField reports whether field is one of the whitespace separated
+// fields of s
+func containsField(s string, field string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// GetHost returns what the host supports, for clients to check before
+// submitting requests
+func GetHost(w http.ResponseWriter, r *http.Request) *apiError {
+	host, err := hostInfo(driver.LXCInfo())
+	if err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	return writeJSON(w, http.StatusOK, host)
+}
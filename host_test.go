@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHost(t *testing.T) {
+	api := newTestAPI(t)
+	reader := api.token(t, "reader", []string{scopeContainersRead}, nil)
+
+	status, body := api.do(t, "GET", "/v1/host", reader, nil)
+	expectStatus(t, status, 200, body)
+
+	var host Host
+	decode(t, body, &host)
+	if host.LXC == nil || host.LXC.Version != "fake" || host.LXC.Config["lxc.lxcpath"] == "" {
+		t.Errorf("unexpected liblxc info %s", body)
+	}
+	if host.Kernel == "" || host.CPUs < 1 || host.MemoryBytes == 0 || host.CgroupVersion == "" {
+		t.Errorf("unexpected host %s", body)
+	}
+	if len(host.StorageBackends) == 0 || host.StorageBackends[0] != "dir" {
+		t.Errorf("storage backends %v, want dir first", host.StorageBackends)
+	}
+	if host.SeccompNotify {
+		t.Error("seccomp notify without the liblxc extension")
+	}
+
+	status, body = api.do(t, "GET", "/v1/host", "", nil)
+	expectError(t, status, 401, body, "unauthorized")
+}
+
+func TestCgroupVersion(t *testing.T) {
+	tests := map[string][]string{
+		"1":      {"cgroup"},
+		"2":      {"cgroup2"},
+		"hybrid": {"cgroup", "cgroup2"},
+		"none":   nil,
+	}
+
+	for want, types := range tests {
+		if got := cgroupVersion(types); got != want {
+			t.Errorf("%v: %s, want %s", types, got, want)
+		}
+	}
+}
+
+func TestHostFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxc-go-http-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	meminfo := filepath.Join(dir, "meminfo")
+	data := "MemFree:         1024 kB\nMemTotal:       16384 kB\n"
+	if err := ioutil.WriteFile(meminfo, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := memTotal(meminfo); got != 16384*1024 || err != nil {
+		t.Errorf("memory %d, %v", got, err)
+	}
+
+	filesystems := filepath.Join(dir, "filesystems")
+	data = "nodev\tsysfs\nnodev\toverlay\n\tbtrfs\n\text4\n"
+	if err := ioutil.WriteFile(filesystems, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	known, err := kernelFilesystems(filesystems)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := map[string]bool{"btrfs": true, "zfs": true, "lvcreate": true}
+	got := availableBackends(known, func(name string) bool { return commands[name] })
+
+	// zfs is installed, but its module is not loaded
+	if want := []string{"dir", "btrfs", "lvm", "overlay"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backends %v, want %v", got, want)
+	}
+}
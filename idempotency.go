@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// idempotencyKeyHeader identifies the retries of a request
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotentReplayedHeader marks replayed responses
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	errIdempotencyKeyReused     = errors.New("idempotency key was used for another request")
+	errIdempotencyKeyInProgress = errors.New("request with this idempotency key is in progress")
+)
+
+// idempotentMethods are the methods whose requests an Idempotency-Key
+// applies to
+var idempotentMethods = map[string]bool{
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+}
+
+// idempotency keeps the responses of requests having an Idempotency-Key,
+// nil when they are not replayed
+var idempotency *idempotencyStore
+
+// idempotentResponse is the response to the first request of a key
+type idempotentResponse struct {
+	// Digest of the request, retries must have the same
+	fingerprint [sha256.Size]byte
+
+	// Whether the request was served, and its response recorded
+	done bool
+
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// idempotencyStore keeps responses in memory, by principal and key, for ttl
+// after they were sent
+type idempotencyStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	responses map[string]*idempotentResponse
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{ttl: ttl, responses: make(map[string]*idempotentResponse)}
+}
+
+// begin returns the response recorded for key, or reserves key for the
+// request of fingerprint when there is none
+func (s *idempotencyStore) begin(key string, fingerprint [sha256.Size]byte) (*idempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, resp := range s.responses {
+		if resp.done && now.After(resp.expires) {
+			delete(s.responses, k)
+		}
+	}
+
+	resp, ok := s.responses[key]
+	if !ok {
+		s.responses[key] = &idempotentResponse{fingerprint: fingerprint}
+		return nil, nil
+	}
+
+	if resp.fingerprint != fingerprint {
+		return nil, errIdempotencyKeyReused
+	}
+	if !resp.done {
+		return nil, errIdempotencyKeyInProgress
+	}
+
+	return resp, nil
+}
+
+// finish records the response to the request of key
+func (s *idempotencyStore) finish(key string, rec *responseRecorder) {
+	header := rec.Header().Clone()
+	header.Del(requestIDHeader)
+
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := s.responses[key]
+	resp.done = true
+	resp.status = status
+	resp.header = header
+	resp.body = rec.body.Bytes()
+	resp.expires = time.Now().Add(s.ttl)
+}
+
+// retryable reports whether the response of rec asks to retry the
+// request: those telling when, the rate limited ones, and server errors.
+// They are not replayed, for retries to be served.
+func retryable(rec *responseRecorder) bool {
+	return rec.Header().Get("Retry-After") != "" ||
+		rec.status == http.StatusTooManyRequests ||
+		rec.status >= http.StatusInternalServerError
+}
+
+// cancel forgets key, when its request was not served, or is to be retried
+func (s *idempotencyStore) cancel(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.responses, key)
+}
+
+// withIdempotency replays the recorded response to retries of requests
+// having an Idempotency-Key, and rejects the reuse of a key for another
+// request. Keys are scoped to the principal, so anonymous requests are
+// left to requireScope.
+func (s *idempotencyStore) withIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		p := principalFromContext(r.Context())
+		if key == "" || p == nil || !idempotentMethods[r.Method] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			err := fmt.Errorf("%s is longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+			writeError(w, r, &apiError{err, err.Error(), http.StatusBadRequest})
+			return
+		}
+
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			writeError(w, r, &apiError{err, err.Error(), http.StatusRequestEntityTooLarge})
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+		h := sha256.New()
+		fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+		h.Write(data)
+
+		var fingerprint [sha256.Size]byte
+		copy(fingerprint[:], h.Sum(nil))
+
+		key = p.ID + "\x00" + key
+		resp, err := s.begin(key, fingerprint)
+		if err != nil {
+			writeError(w, r, driverError(err))
+			return
+		}
+
+		if resp != nil {
+			for name, values := range resp.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+			return
+		}
+
+		// The key is released if the handler panics, for the request to be
+		// retried
+		served := false
+		defer func() {
+			if !served {
+				s.cancel(key)
+			}
+		}()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if retryable(rec) {
+			s.cancel(key)
+		} else {
+			s.finish(key, rec)
+		}
+		served = true
+	})
+}
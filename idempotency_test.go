@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendIdempotent is api.send with an Idempotency-Key
+func (api *testAPI) sendIdempotent(t *testing.T, method string, path string, token string, key string, body interface{}) (*http.Response, []byte) {
+	t.Helper()
+
+	req := api.request(t, method, path, token, body)
+	req.Header.Set(idempotencyKeyHeader, key)
+
+	return api.roundTrip(t, req)
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	api := newTestAPI(t)
+
+	first, body := api.sendIdempotent(t, "POST", "/v1/containers", api.admin, "k1", ContainerTemplate{Name: "c1"})
+	expectStatus(t, first.StatusCode, 201, body)
+
+	retry, replayed := api.sendIdempotent(t, "POST", "/v1/containers", api.admin, "k1", ContainerTemplate{Name: "c1"})
+	expectStatus(t, retry.StatusCode, 201, replayed)
+
+	if !bytes.Equal(body, replayed) {
+		t.Errorf("replayed %s, want %s", replayed, body)
+	}
+	if got := retry.Header.Get("Location"); got != first.Header.Get("Location") {
+		t.Errorf("replayed location %q, want %q", got, first.Header.Get("Location"))
+	}
+	if retry.Header.Get(idempotentReplayedHeader) != "true" || first.Header.Get(idempotentReplayedHeader) != "" {
+		t.Errorf("%s header not only on the replay", idempotentReplayedHeader)
+	}
+	if retry.Header.Get(requestIDHeader) == first.Header.Get(requestIDHeader) {
+		t.Error("request ID replayed")
+	}
+
+	// Without a key, the request is served again
+	status, body := api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c1"})
+	expectError(t, status, 409, body, "already_defined")
+}
+
+func TestIdempotentLegacyCreate(t *testing.T) {
+	api := newTestAPI(t)
+
+	for i := 0; i < 2; i++ {
+		resp, body := api.sendIdempotent(t, "POST", "/create", api.admin, "deploy-42", ContainerTemplate{Name: "c1", Started: true})
+		expectStatus(t, resp.StatusCode, 200, body)
+	}
+}
+
+func TestIdempotentRetryable(t *testing.T) {
+	api := newTestAPI(t)
+	locks.timeout = 0
+
+	status, body := api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c1"})
+	expectStatus(t, status, 201, body)
+
+	unlock, e := locks.lock(context.Background(), "snapshot", config.LXCPath, "c1")
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+
+	resp, body := api.sendIdempotent(t, "POST", "/v1/containers/c1/start", api.admin, "k1", nil)
+	expectError(t, resp.StatusCode, 409, body, "container_busy")
+
+	// Responses asking to retry are not replayed to the retries
+	unlock()
+
+	resp, body = api.sendIdempotent(t, "POST", "/v1/containers/c1/start", api.admin, "k1", nil)
+	expectStatus(t, resp.StatusCode, 200, body)
+	if resp.Header.Get(idempotentReplayedHeader) != "" {
+		t.Error("busy response replayed")
+	}
+
+	resp, body = api.sendIdempotent(t, "POST", "/v1/containers/c1/start", api.admin, "k1", nil)
+	expectStatus(t, resp.StatusCode, 200, body)
+	if resp.Header.Get(idempotentReplayedHeader) != "true" {
+		t.Error("successful response not replayed")
+	}
+}
+
+func TestIdempotencyKeyReused(t *testing.T) {
+	api := newTestAPI(t)
+	other := api.token(t, "other", []string{scopeContainersWrite}, nil)
+
+	resp, body := api.sendIdempotent(t, "POST", "/v1/containers", api.admin, "k1", ContainerTemplate{Name: "c1"})
+	expectStatus(t, resp.StatusCode, 201, body)
+
+	resp, body = api.sendIdempotent(t, "POST", "/v1/containers", api.admin, "k1", ContainerTemplate{Name: "c2"})
+	expectError(t, resp.StatusCode, 422, body, "idempotency_key_reused")
+
+	resp, body = api.sendIdempotent(t, "POST", "/v1/containers?root=fast", api.admin, "k1", ContainerTemplate{Name: "c1"})
+	expectError(t, resp.StatusCode, 422, body, "idempotency_key_reused")
+
+	// Keys are scoped to the principal
+	resp, body = api.sendIdempotent(t, "POST", "/v1/containers", other, "k1", ContainerTemplate{Name: "c2"})
+	expectStatus(t, resp.StatusCode, 201, body)
+
+	resp, body = api.sendIdempotent(t, "DELETE", "/v1/containers/c1", api.admin, strings.Repeat("k", maxIdempotencyKeyLength+1), nil)
+	expectError(t, resp.StatusCode, 400, body, "bad_request")
+}
+
+func TestIdempotencyKeyExpired(t *testing.T) {
+	api := newTestAPI(t)
+	idempotency.ttl = time.Millisecond
+
+	resp, body := api.sendIdempotent(t, "POST", "/v1/containers", api.admin, "k1", ContainerTemplate{Name: "c1"})
+	expectStatus(t, resp.StatusCode, 201, body)
+
+	time.Sleep(5 * time.Millisecond)
+
+	resp, body = api.sendIdempotent(t, "POST", "/v1/containers", api.admin, "k1", ContainerTemplate{Name: "c1"})
+	expectError(t, resp.StatusCode, 409, body, "already_defined")
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	s := newIdempotencyStore(time.Hour)
+	fingerprint := sha256.Sum256([]byte("POST /v1/containers"))
+
+	if resp, err := s.begin("k1", fingerprint); resp != nil || err != nil {
+		t.Fatalf("first request: %v, %v", resp, err)
+	}
+	if _, err := s.begin("k1", fingerprint); err != errIdempotencyKeyInProgress {
+		t.Errorf("concurrent retry: %v, want %v", err, errIdempotencyKeyInProgress)
+	}
+
+	s.cancel("k1")
+	if resp, err := s.begin("k1", fingerprint); resp != nil || err != nil {
+		t.Errorf("retry after cancel: %v, %v", resp, err)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// journalFile, in the state directory, lists the operations in progress
+const journalFile = "journal.json"
+
+// Operations recorded in the journal. Creations are the ones leaving a
+// container behind.
+const (
+	journalCreate  = "create"
+	journalClone   = "clone"
+	journalRestore = "restore"
+	journalDestroy = "destroy"
+)
+
+// journal records the creations and destructions of containers in
+// progress, to recover them when the server stopped before they were over
+var journal *operationJournal
+
+// journalEntry is an operation in progress
+type journalEntry struct {
+	ID      uint64 `json:"id"`
+	Op      string `json:"op"`
+	LXCPath string `json:"lxcpath"`
+	Name    string `json:"name"`
+
+	// Created container is to be started
+	Start bool `json:"start,omitempty"`
+
+	// Destroyed container is stopped first
+	Force bool `json:"force,omitempty"`
+
+	StartedAt time.Time `json:"started_at"`
+}
+
+// operationJournal keeps its entries in a file, rewritten as operations
+// begin and end
+type operationJournal struct {
+	mu      sync.Mutex
+	path    string
+	next    uint64
+	entries map[uint64]*journalEntry
+}
+
+// openJournal reads the journal at path, empty when the file does not
+// exist
+func openJournal(path string) (*operationJournal, error) {
+	j := &operationJournal{path: path, entries: make(map[uint64]*journalEntry)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*journalEntry
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	for _, e := range list {
+		j.entries[e.ID] = e
+		if e.ID >= j.next {
+			j.next = e.ID + 1
+		}
+	}
+
+	return j, nil
+}
+
+// save writes the journal, j.mu being held
+func (j *operationJournal) save() error {
+	list := j.list()
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, j.path)
+}
+
+// list returns the entries in the order operations began, j.mu being held
+func (j *operationJournal) list() []*journalEntry {
+	list := make([]*journalEntry, 0, len(j.entries))
+	for _, e := range j.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+
+	return list
+}
+
+// begin records e, and returns the function to call once its operation is
+// over
+func (j *operationJournal) begin(e journalEntry) (func(), *apiError) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e.ID = j.next
+	e.StartedAt = time.Now().UTC()
+	j.next++
+	j.entries[e.ID] = &e
+
+	if err := j.save(); err != nil {
+		delete(j.entries, e.ID)
+		return nil, &apiError{err, err.Error(), 500}
+	}
+
+	return func() { j.end(e.ID) }, nil
+}
+
+// end forgets the entry of id
+func (j *operationJournal) end(id uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.entries, id)
+
+	// The operation is recovered for nothing on the next start
+	if err := j.save(); err != nil {
+		logger.Warn("journal not saved", "error", err)
+	}
+}
+
+// recover completes or undoes the operations of a previous run which were
+// still in progress. Entries failing to be recovered are kept, for the
+// next start to retry.
+func (j *operationJournal) recover() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, e := range j.list() {
+		outcome, err := recoverOperation(e)
+		if err != nil {
+			logger.Warn("interrupted operation not recovered",
+				"op", e.Op, "container", e.Name, "lxcpath", e.LXCPath, "error", err)
+			continue
+		}
+
+		logger.Info("interrupted operation recovered",
+			"op", e.Op, "container", e.Name, "lxcpath", e.LXCPath, "outcome", outcome)
+		delete(j.entries, e.ID)
+	}
+
+	return j.save()
+}
+
+// recoverOperation completes or undoes the operation of e, and tells which
+func recoverOperation(e *journalEntry) (string, error) {
+	if _, err := driver.State(e.LXCPath, e.Name); errors.Is(err, errNotDefined) {
+		if e.Op == journalDestroy {
+			return "was over", nil
+		}
+		return "created nothing", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if e.Op == journalDestroy {
+		if err := stopAndDestroy(e.LXCPath, e.Name, e.Force); err != nil {
+			return "", err
+		}
+		return "completed", nil
+	}
+
+	// Metadata are written once the container is created
+	md, err := readMetadata(e.LXCPath, e.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if md.CreatedAt.IsZero() {
+		if err := stopAndDestroy(e.LXCPath, e.Name, true); err != nil {
+			return "", err
+		}
+		return "cleaned up", nil
+	}
+
+	if e.Start {
+		if err := driver.Start(e.LXCPath, e.Name); err != nil && !errors.Is(err, errAlreadyRunning) {
+			return "", err
+		}
+	}
+
+	return "completed", nil
+}
+
+// stopAndDestroy destroys a container, stopping it first when force is set
+func stopAndDestroy(lxcpath string, name string, force bool) error {
+	if force {
+		if err := driver.Stop(lxcpath, name); err != nil && !errors.Is(err, errNotRunning) {
+			return err
+		}
+	}
+
+	if err := driver.Destroy(lxcpath, name); err != nil {
+		return err
+	}
+
+	quotas.forget(lxcpath, name)
+	return nil
+}
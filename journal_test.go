@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalRecovery(t *testing.T) {
+	api := newTestAPI(t)
+	lxcpath := config.LXCPath
+
+	// Created, but interrupted before its metadata were written
+	if err := driver.Create(lxcpath, "half", TemplateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Created, but interrupted before being started
+	api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "unstarted"})
+
+	// Interrupted before being destroyed
+	api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "doomed", Started: true})
+
+	// Created by someone else while its creation failed
+	if err := driver.Create(lxcpath, "foreign", TemplateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []journalEntry{
+		{Op: journalCreate, LXCPath: lxcpath, Name: "half", Start: true},
+		{Op: journalCreate, LXCPath: lxcpath, Name: "unstarted", Start: true},
+		{Op: journalDestroy, LXCPath: lxcpath, Name: "doomed", Force: true},
+		{Op: journalClone, LXCPath: lxcpath, Name: "never"},
+	} {
+		if _, e := journal.begin(e); e != nil {
+			t.Fatal(e.Error)
+		}
+	}
+
+	// The next start reads the journal left behind
+	j, err := openJournal(journal.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"half": "", "unstarted": "RUNNING", "doomed": "", "foreign": "STOPPED"} {
+		state, err := driver.State(lxcpath, name)
+		if want == "" && !errors.Is(err, errNotDefined) {
+			t.Errorf("%s: state %s, want destroyed", name, state)
+		}
+		if want != "" && state != want {
+			t.Errorf("%s: state %s, %v, want %s", name, state, err, want)
+		}
+	}
+
+	if j, err = openJournal(journal.path); err != nil {
+		t.Fatal(err)
+	}
+	if len(j.entries) != 0 {
+		t.Errorf("entries left %+v", j.list())
+	}
+}
+
+func TestJournalKeepsFailedRecoveries(t *testing.T) {
+	newTestAPI(t)
+
+	// Not stopped first, a running container is not destroyed
+	driver.Create(config.LXCPath, "c1", TemplateOptions{})
+	driver.Start(config.LXCPath, "c1")
+	journal.begin(journalEntry{Op: journalDestroy, LXCPath: config.LXCPath, Name: "c1"})
+
+	if err := journal.recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := openJournal(journal.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := j.list(); len(list) != 1 || list[0].Name != "c1" {
+		t.Errorf("unexpected entries %+v", list)
+	}
+}
+
+func TestJournalEmptyAfterOperations(t *testing.T) {
+	api := newTestAPI(t)
+
+	api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c1", Started: true})
+	api.do(t, "POST", "/v1/containers/c1/stop", api.admin, nil)
+	api.do(t, "POST", "/v1/containers/c1/clone", api.admin, CloneOptions{Name: "c2"})
+	api.do(t, "DELETE", "/v1/containers/c1", api.admin, nil)
+
+	j, err := openJournal(filepath.Join(config.StateDir, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(j.entries) != 0 {
+		t.Errorf("entries left %+v", j.list())
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// maxAnnotationsSize bounds the total size of the annotations of a
+// container, kept in its metadata file
+const maxAnnotationsSize = 256 << 10
+
+var (
+	// labelKey is the pattern of label and annotation keys: a name,
+	// possibly prefixed by a DNS domain
+	labelKey = regexp.MustCompile(`^([a-z0-9]([a-z0-9.-]*[a-z0-9])?/)?[A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?$`)
+
+	// labelValue is the pattern of label values, which may be empty
+	labelValue = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?)?$`)
+)
+
+// ContainerPatch model
+// swagger:model ContainerPatch
+type ContainerPatch struct {
+	// Labels set, or removed when null
+	// example: {"env": "prod", "team": null}
+	Labels map[string]*string `json:"labels"`
+
+	// Annotations set, or removed when null
+	// example: {"contact": "ops@example.com"}
+	Annotations map[string]*string `json:"annotations"`
+}
+
+// labelRequirement is a term of a label selector: key having value, not
+// having it, or being set or not when value is not compared
+type labelRequirement struct {
+	key   string
+	op    string
+	value string
+}
+
+// Operators of label requirements
+const (
+	labelEquals    = "="
+	labelNotEquals = "!="
+	labelExists    = "exists"
+	labelMissing   = "!exists"
+)
+
+// labelSelector matches the labels meeting all its requirements
+type labelSelector []labelRequirement
+
+// validateKey checks a label or annotation key
+func validateKey(key string) error {
+	name := key[strings.LastIndex(key, "/")+1:]
+	if !labelKey.MatchString(key) || len(name) > 63 || len(key)-len(name) > 254 {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	return nil
+}
+
+// validateLabels checks the keys and values of labels
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if err := validateKey(key); err != nil {
+			return fmt.Errorf("labels: %v", err)
+		}
+		if !labelValue.MatchString(value) || len(value) > 63 {
+			return fmt.Errorf("labels: invalid value %q for %s", value, key)
+		}
+	}
+	return nil
+}
+
+// validateAnnotations checks the keys and total size of annotations
+func validateAnnotations(annotations map[string]string) error {
+	size := 0
+	for key, value := range annotations {
+		if err := validateKey(key); err != nil {
+			return fmt.Errorf("annotations: %v", err)
+		}
+		size += len(key) + len(value)
+	}
+	if size > maxAnnotationsSize {
+		return fmt.Errorf("annotations: more than %d bytes", maxAnnotationsSize)
+	}
+	return nil
+}
+
+// parseLabelSelector reads selectors such as "env=prod,team!=ml,tier,
+// !legacy", requiring labels to have a value, not to have it, to be set,
+// or not
+func parseLabelSelector(s string) (labelSelector, error) {
+	var sel labelSelector
+	if strings.TrimSpace(s) == "" {
+		return sel, nil
+	}
+
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+
+		var req labelRequirement
+		switch {
+		case strings.HasPrefix(term, "!"):
+			req = labelRequirement{key: term[1:], op: labelMissing}
+		case strings.Contains(term, "!="):
+			i := strings.Index(term, "!=")
+			req = labelRequirement{key: term[:i], op: labelNotEquals, value: term[i+2:]}
+		case strings.Contains(term, "=="):
+			i := strings.Index(term, "==")
+			req = labelRequirement{key: term[:i], op: labelEquals, value: term[i+2:]}
+		case strings.Contains(term, "="):
+			i := strings.Index(term, "=")
+			req = labelRequirement{key: term[:i], op: labelEquals, value: term[i+1:]}
+		default:
+			req = labelRequirement{key: term, op: labelExists}
+		}
+
+		req.key, req.value = strings.TrimSpace(req.key), strings.TrimSpace(req.value)
+		if err := validateKey(req.key); err != nil {
+			return nil, fmt.Errorf("selector %q: %v", term, err)
+		}
+		if !labelValue.MatchString(req.value) {
+			return nil, fmt.Errorf("selector %q: invalid value %q", term, req.value)
+		}
+		sel = append(sel, req)
+	}
+
+	return sel, nil
+}
+
+// matches reports whether labels meet the requirements of sel. Labels
+// which are not set differ from every value.
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, req := range sel {
+		value, ok := labels[req.key]
+		switch req.op {
+		case labelEquals:
+			if !ok || value != req.value {
+				return false
+			}
+		case labelNotEquals:
+			if ok && value == req.value {
+				return false
+			}
+		case labelExists:
+			if !ok {
+				return false
+			}
+		case labelMissing:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// filterLabels returns the names of the containers of lxcpath whose
+// labels sel matches
+func filterLabels(lxcpath string, names []string, sel labelSelector) ([]string, error) {
+	if len(sel) == 0 {
+		return names, nil
+	}
+
+	matched := []string{}
+	for _, name := range names {
+		md, err := readMetadata(lxcpath, name)
+		if err != nil {
+			return nil, err
+		}
+		if sel.matches(md.Labels) {
+			matched = append(matched, name)
+		}
+	}
+	return matched, nil
+}
+
+// patchValues returns values with the entries of patch set, or removed
+// when nil
+func patchValues(values map[string]string, patch map[string]*string) map[string]string {
+	if len(patch) == 0 {
+		return values
+	}
+
+	patched := make(map[string]string, len(values)+len(patch))
+	for key, value := range values {
+		patched[key] = value
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(patched, key)
+		} else {
+			patched[key] = *value
+		}
+	}
+
+	if len(patched) == 0 {
+		return nil
+	}
+	return patched
+}
+
+// PatchContainer sets or removes labels and annotations of a container,
+// and replies with it
+func PatchContainer(w http.ResponseWriter, r *http.Request) *apiError {
+	var patch ContainerPatch
+
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+	if len(patch.Labels) == 0 && len(patch.Annotations) == 0 {
+		err := errors.New("no labels or annotations passed")
+		return &apiError{err, err.Error(), 400}
+	}
+
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	if e := patchMetadata(r, lxcpath, name, &patch); e != nil {
+		return e
+	}
+
+	return writeContainer(w, http.StatusOK, requestRootName(r), lxcpath, name)
+}
+
+// patchMetadata sets or removes the labels and annotations of patch on
+// container name of lxcpath
+func patchMetadata(r *http.Request, lxcpath string, name string, patch *ContainerPatch) *apiError {
+	unlock, e := locks.lock(r.Context(), "patch", lxcpath, name)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	md, err := readMetadata(lxcpath, name)
+	if err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	labels := patchValues(md.Labels, patch.Labels)
+	annotations := patchValues(md.Annotations, patch.Annotations)
+	if err := validateLabels(labels); err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+	if err := validateAnnotations(annotations); err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	md.Labels, md.Annotations = labels, annotations
+	if err := writeMetadata(lxcpath, name, md); err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	return nil
+}
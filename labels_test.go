@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	api := newTestAPI(t)
+	ci := api.token(t, "ci", []string{scopeContainersRead, scopeContainersWrite}, nil)
+
+	for name, labels := range map[string]map[string]string{
+		"c1": {"env": "prod", "team": "web"},
+		"c2": {"env": "prod", "team": "ml"},
+		"c3": {"env": "dev", "example.com/tier": "front"},
+		"c4": nil,
+	} {
+		opts := ContainerTemplate{Name: name, Labels: labels, Annotations: map[string]string{"contact": "ops@example.com"}}
+		status, body := api.do(t, "POST", "/v1/containers", ci, opts)
+		expectStatus(t, status, 201, body)
+
+		var c Container
+		decode(t, body, &c)
+		if !reflect.DeepEqual(c.Labels, labels) || c.Annotations["contact"] != "ops@example.com" {
+			t.Errorf("created %s", body)
+		}
+	}
+
+	for selector, want := range map[string][]string{
+		"":                       {"c1", "c2", "c3", "c4"},
+		"env=prod,team!=ml":      {"c1"},
+		"env==prod":              {"c1", "c2"},
+		"env":                    {"c1", "c2", "c3"},
+		"!env":                   {"c4"},
+		"team!=ml":               {"c1", "c3", "c4"},
+		"example.com/tier=front": {"c3"},
+	} {
+		var list Containers
+		status, body := api.do(t, "GET", "/v1/containers?selector="+url.QueryEscape(selector), ci, nil)
+		expectStatus(t, status, 200, body)
+		decode(t, body, &list)
+		if !reflect.DeepEqual(list.Containers, want) {
+			t.Errorf("selector %q: %v, want %v", selector, list.Containers, want)
+		}
+	}
+
+	for _, selector := range []string{"=prod", "env=pr od", "env,", "Example.com/tier"} {
+		status, body := api.do(t, "GET", "/v1/containers?selector="+url.QueryEscape(selector), ci, nil)
+		expectError(t, status, 400, body, "bad_request")
+	}
+
+	status, body := api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: "c5", Labels: map[string]string{"env": "pr od"}})
+	expectError(t, status, 400, body, "bad_request")
+
+	// Patches set the entries given, and remove the null ones
+	var c Container
+	status, body = api.do(t, "PATCH", "/v1/containers/c1", ci,
+		`{"labels": {"team": null, "tier": "front"}, "annotations": {"contact": null, "runbook": "https://example.com/web"}}`)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &c)
+	if want := map[string]string{"env": "prod", "tier": "front"}; !reflect.DeepEqual(c.Labels, want) {
+		t.Errorf("labels %v, want %v", c.Labels, want)
+	}
+	if want := map[string]string{"runbook": "https://example.com/web"}; !reflect.DeepEqual(c.Annotations, want) {
+		t.Errorf("annotations %v, want %v", c.Annotations, want)
+	}
+
+	status, body = api.do(t, "PATCH", "/v1/containers/c1", ci, `{"labels": {"tier": "front end"}}`)
+	expectError(t, status, 400, body, "bad_request")
+
+	status, body = api.do(t, "PATCH", "/v1/containers/c1", ci, `{}`)
+	expectError(t, status, 400, body, "bad_request")
+
+	status, body = api.do(t, "PATCH", "/v1/containers/missing", ci, `{"labels": {"env": "prod"}}`)
+	expectError(t, status, 404, body, "not_defined")
+
+	// Batches select containers by label
+	var results BatchResults
+	status, body = api.do(t, "POST", "/v1/containers:batch", ci, `{"action": "start", "selector": {"labels": "env=prod"}}`)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &results)
+	if want := [][3]string{{"c1", actionDone, ""}, {"c2", actionDone, ""}}; !reflect.DeepEqual(batchSummary(results.Results), want) {
+		t.Errorf("results %v, want %v", batchSummary(results.Results), want)
+	}
+
+	// Manifests set the labels they list, leaving the others
+	var p Plan
+	status, body = api.do(t, "POST", "/v1/apply", ci, `{"containers": [{"name": "c2", "started": true, "labels": {"team": "ai"}}]}`)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &p)
+	if len(p.Actions) != 1 || !reflect.DeepEqual(p.Actions[0].Changes, []string{"labels.team: ml -> ai"}) {
+		t.Errorf("unexpected plan %s", body)
+	}
+
+	c = Container{}
+	status, body = api.do(t, "GET", "/v1/containers/c2", ci, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &c)
+	if want := map[string]string{"env": "prod", "team": "ai"}; !reflect.DeepEqual(c.Labels, want) {
+		t.Errorf("labels %v, want %v", c.Labels, want)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// lockRetryAfter is the delay clients are told to retry operations on busy
+// containers after
+const lockRetryAfter = time.Second
+
+var errContainerBusy = errors.New("container is busy")
+
+// busyError is the error of operations on a container locked by another
+// operation for longer than the lock timeout
+type busyError struct {
+	name string
+	op   string
+}
+
+func (e *busyError) Error() string {
+	if e.op == "" {
+		return fmt.Sprintf("%v: %q", errContainerBusy, e.name)
+	}
+	return fmt.Sprintf("%v with %s: %q", errContainerBusy, e.op, e.name)
+}
+
+func (e *busyError) Is(target error) bool {
+	return target == errContainerBusy
+}
+
+// RetryAfter returns the delay to retry the operation after
+func (e *busyError) RetryAfter() time.Duration {
+	return lockRetryAfter
+}
+
+// locks serializes the operations changing containers. Read-only ones do
+// not lock.
+var locks *lockManager
+
+// lockKey identifies a container
+type lockKey struct {
+	lxcpath string
+	name    string
+}
+
+// containerLock is the lock of a container, held by one operation at a
+// time
+type containerLock struct {
+	sem chan struct{}
+
+	// Operation holding the lock, and since when
+	op    string
+	since time.Time
+
+	// Operations waiting for the lock
+	waiting int
+
+	// Holder and waiters, the lock is forgotten when there are none
+	refs int
+}
+
+// lockManager holds the locks of containers having operations in progress
+type lockManager struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	locks   map[lockKey]*containerLock
+
+	acquired  uint64
+	contended uint64
+	busy      uint64
+}
+
+// newLockManager returns a manager making operations wait up to timeout
+// for the lock of a container
+func newLockManager(timeout time.Duration) *lockManager {
+	return &lockManager{timeout: timeout, locks: make(map[lockKey]*containerLock)}
+}
+
+// lock locks the containers of names in lxcpath for op, and returns the
+// function unlocking them. Containers are locked in order, so that
+// operations locking several do not deadlock.
+func (m *lockManager) lock(ctx context.Context, op string, lxcpath string, names ...string) (func(), *apiError) {
+	keys := make([]lockKey, 0, len(names))
+	for _, name := range names {
+		keys = append(keys, lockKey{lxcpath, name})
+	}
+	return m.lockKeys(ctx, op, keys...)
+}
+
+// lockKeys is lock, for containers of different paths
+func (m *lockManager) lockKeys(ctx context.Context, op string, keys ...lockKey) (func(), *apiError) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].lxcpath != keys[j].lxcpath {
+			return keys[i].lxcpath < keys[j].lxcpath
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	var held []lockKey
+	unlock := func() {
+		for _, key := range held {
+			m.release(key)
+		}
+	}
+
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+
+		if err := m.acquire(ctx, op, key); err != nil {
+			unlock()
+			return nil, driverError(err)
+		}
+		held = append(held, key)
+	}
+
+	return unlock, nil
+}
+
+// acquire waits for the lock of key, up to the lock timeout
+func (m *lockManager) acquire(ctx context.Context, op string, key lockKey) error {
+	m.mu.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &containerLock{sem: make(chan struct{}, 1)}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	select {
+	case l.sem <- struct{}{}:
+	default:
+		m.mu.Lock()
+		l.waiting++
+		m.contended++
+		m.mu.Unlock()
+
+		timer := time.NewTimer(m.timeout)
+		defer timer.Stop()
+
+		// Requests given up by their client fail as busy too, rather than
+		// as server errors
+		acquired := false
+		select {
+		case l.sem <- struct{}{}:
+			acquired = true
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+
+		var err error
+		if !acquired {
+			m.mu.Lock()
+			err = &busyError{key.name, l.op}
+			m.mu.Unlock()
+		}
+
+		m.mu.Lock()
+		l.waiting--
+		if err != nil {
+			m.busy++
+			m.forget(key, l)
+		}
+		m.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	l.op = op
+	l.since = time.Now().UTC()
+	m.acquired++
+	m.mu.Unlock()
+
+	return nil
+}
+
+// release unlocks key
+func (m *lockManager) release(key lockKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l := m.locks[key]
+	l.op = ""
+	<-l.sem
+	m.forget(key, l)
+}
+
+// forget drops a reference to the lock of key, m.mu being held
+func (m *lockManager) forget(key lockKey, l *containerLock) {
+	l.refs--
+	if l.refs == 0 {
+		delete(m.locks, key)
+	}
+}
+
+// Lock model
+// swagger:model Lock
+type Lock struct {
+	// Containers directory
+	// example: /var/lib/lxc
+	LXCPath string `json:"lxcpath"`
+
+	// Container name
+	// example: dummy
+	Container string `json:"container"`
+
+	// Operation holding the lock, empty while it is handed over
+	// example: start
+	Operation string `json:"operation"`
+
+	// Since when the operation holds the lock
+	HeldSince *time.Time `json:"held_since,omitempty"`
+
+	// Operations waiting for the lock
+	// example: 1
+	Waiting int `json:"waiting"`
+}
+
+// LockStats model
+// swagger:model LockStats
+type LockStats struct {
+	// Locks acquired since startup
+	// example: 42
+	Acquired uint64 `json:"acquired"`
+
+	// Operations which had to wait for a lock
+	// example: 3
+	Contended uint64 `json:"contended"`
+
+	// Operations which gave up waiting, and failed with container_busy
+	// example: 1
+	Busy uint64 `json:"busy"`
+
+	// Locks of containers having operations in progress
+	Locks []Lock `json:"locks"`
+}
+
+// stats returns the current locks and contention counters
+func (m *lockManager) stats() *LockStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := &LockStats{
+		Acquired:  m.acquired,
+		Contended: m.contended,
+		Busy:      m.busy,
+		Locks:     make([]Lock, 0, len(m.locks)),
+	}
+
+	for key, l := range m.locks {
+		lock := Lock{LXCPath: key.lxcpath, Container: key.name, Operation: l.op, Waiting: l.waiting}
+		if l.op != "" {
+			since := l.since
+			lock.HeldSince = &since
+		}
+		stats.Locks = append(stats.Locks, lock)
+	}
+
+	sort.Slice(stats.Locks, func(i, j int) bool {
+		if stats.Locks[i].LXCPath != stats.Locks[j].LXCPath {
+			return stats.Locks[i].LXCPath < stats.Locks[j].LXCPath
+		}
+		return stats.Locks[i].Container < stats.Locks[j].Container
+	})
+
+	return stats
+}
+
+// GetLocks returns the container locks, to debug contention
+func GetLocks(w http.ResponseWriter, r *http.Request) *apiError {
+	return writeJSON(w, http.StatusOK, locks.stats())
+}
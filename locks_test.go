@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestContainerBusy(t *testing.T) {
+	api := newTestAPI(t)
+	locks.timeout = 0
+
+	api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c1"})
+
+	unlock, e := locks.lock(context.Background(), "snapshot", config.LXCPath, "c1")
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+
+	resp, body := api.send(t, "POST", "/v1/containers/c1/start", api.admin, nil)
+	expectError(t, resp.StatusCode, 409, body, "container_busy")
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After %q, want 1", got)
+	}
+
+	status, body := api.do(t, "DELETE", "/destroy/c1", api.admin, DestroyOptions{Force: true})
+	expectError(t, status, 409, body, "container_busy")
+
+	// Read-only calls do not lock
+	status, body = api.do(t, "GET", "/v1/containers/c1", api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	// Other containers are not locked
+	status, body = api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c2"})
+	expectStatus(t, status, 201, body)
+
+	unlock()
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/start", api.admin, nil)
+	expectStatus(t, status, 200, body)
+}
+
+func TestContainerLockCanceled(t *testing.T) {
+	newTestAPI(t)
+	locks.timeout = time.Minute
+
+	unlock, e := locks.lock(context.Background(), "start", config.LXCPath, "c1")
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+	defer unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, e := locks.lock(ctx, "stop", config.LXCPath, "c1"); e == nil || e.Code != 409 || errorCode(e) != "container_busy" {
+		t.Errorf("canceled lock error %+v", e)
+	}
+}
+
+func TestContainerLockQueued(t *testing.T) {
+	api := newTestAPI(t)
+	locks.timeout = time.Minute
+
+	api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c1"})
+
+	unlock, e := locks.lock(context.Background(), "start", config.LXCPath, "c1")
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		status, body := api.do(t, "DELETE", "/v1/containers/c1", api.admin, nil)
+		expectStatus(t, status, 204, body)
+	}()
+
+	// The destroy waits for the start to be over
+	var waiting []Lock
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if waiting = locks.stats().Locks; len(waiting) == 1 && waiting[0].Waiting == 1 {
+			break
+		}
+	}
+
+	var stats LockStats
+	status, body := api.do(t, "GET", "/v1/debug/locks", api.admin, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &stats)
+
+	if len(stats.Locks) != 1 || stats.Locks[0].Container != "c1" || stats.Locks[0].Operation != "start" ||
+		stats.Locks[0].Waiting != 1 || stats.Locks[0].HeldSince == nil || stats.Contended == 0 {
+		t.Errorf("unexpected locks %s", body)
+	}
+
+	unlock()
+	<-done
+
+	if stats := locks.stats(); len(stats.Locks) != 0 {
+		t.Errorf("locks left %+v", stats.Locks)
+	}
+}
+
+func TestDebugLocksAccess(t *testing.T) {
+	api := newTestAPI(t)
+	reader := api.token(t, "reader", []string{scopeContainersRead}, nil)
+
+	status, body := api.do(t, "GET", "/v1/debug/locks", reader, nil)
+	expectError(t, status, 403, body, "forbidden")
+}
+
+func TestLockOrder(t *testing.T) {
+	m := newLockManager(time.Minute)
+	ctx := context.Background()
+
+	// Locking the same containers in any order does not deadlock
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func(names ...string) {
+			for j := 0; j < 100; j++ {
+				unlock, e := m.lock(ctx, "clone", "/var/lib/lxc", names...)
+				if e != nil {
+					t.Error(e.Error)
+					break
+				}
+				unlock()
+			}
+			done <- struct{}{}
+		}([][]string{{"a", "b"}, {"b", "a"}}[i]...)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("deadlock")
+		}
+	}
+
+	if stats := m.stats(); stats.Acquired != 400 || len(stats.Locks) != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
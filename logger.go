@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logLevel orders log entries by severity
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+// parseLogLevel returns the level named s
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// Log formats
+var logFormats = []string{"json", "logfmt"}
+
+// checkLogFormat fails when s is not one of logFormats
+func checkLogFormat(s string) error {
+	for _, format := range logFormats {
+		if s == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log format %q, want one of %s", s, strings.Join(logFormats, ", "))
+}
+
+// logger writes the server log
+var logger = newLogger(os.Stderr, levelInfo, "json")
+
+// structuredLogger writes entries of a message and key-value pairs, as
+// JSON objects or logfmt lines. Its level may change while it is used.
+type structuredLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+	level  int32
+}
+
+func newLogger(out io.Writer, level logLevel, format string) *structuredLogger {
+	return &structuredLogger{out: out, format: format, level: int32(level)}
+}
+
+func (l *structuredLogger) Level() logLevel {
+	return logLevel(atomic.LoadInt32(&l.level))
+}
+
+func (l *structuredLogger) SetLevel(level logLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Writer returns the output of l
+func (l *structuredLogger) Writer() io.Writer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out
+}
+
+func (l *structuredLogger) SetOutput(out io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out = out
+}
+
+func (l *structuredLogger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *structuredLogger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *structuredLogger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *structuredLogger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+// log writes an entry of msg and the key-value pairs of kv, when level is
+// enabled
+func (l *structuredLogger) log(level logLevel, msg string, kv []interface{}) {
+	if level < l.Level() {
+		return
+	}
+
+	fields := append([]interface{}{
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", msg,
+	}, kv...)
+
+	var buf bytes.Buffer
+	if l.format == "logfmt" {
+		writeLogfmt(&buf, fields)
+	} else {
+		writeJSONLog(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+// logValue returns the value logged for v
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSONLog(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		value, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
+
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+
+		value := fmt.Sprint(logValue(fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+			value = strconv.Quote(value)
+		}
+
+		fmt.Fprintf(buf, "%v=%s", fields[i], value)
+	}
+}
+
+// stdLogWriter turns the lines of the standard logger, such as the errors
+// of net/http, into entries of logger
+type stdLogWriter struct {
+	level logLevel
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	logger.log(w.level, string(bytes.TrimRight(p, "\n")), nil)
+	return len(p), nil
+}
+
+// fatal logs err and exits
+func fatal(err error) {
+	logger.Error(err.Error())
+	os.Exit(1)
+}
+
+// LogLevel model
+// swagger:model LogLevel
+type LogLevel struct {
+	// Lowest level of the entries logged
+	// required: true
+	// enum: debug,info,warn,error
+	// example: info
+	Level string `json:"level"`
+}
+
+// GetLogLevel returns the current log level
+func GetLogLevel(w http.ResponseWriter, r *http.Request) *apiError {
+	return writeJSON(w, http.StatusOK, &LogLevel{Level: logger.Level().String()})
+}
+
+// PutLogLevel changes the log level until the server restarts
+func PutLogLevel(w http.ResponseWriter, r *http.Request) *apiError {
+	var req LogLevel
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	if previous := logger.Level(); previous != level {
+		logger.SetLevel(level)
+		logger.Warn("log level changed", "from", previous, "to", level,
+			"principal", principalFromContext(r.Context()).Name)
+	}
+
+	return writeJSON(w, http.StatusOK, &LogLevel{Level: level.String()})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog returns the buffer the log is written to until the end of
+// the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+
+	out, level := logger.Writer(), logger.Level()
+	t.Cleanup(func() {
+		logger.SetOutput(out)
+		logger.SetLevel(level)
+	})
+	logger.SetOutput(&buf)
+
+	return &buf
+}
+
+// logEntries decodes the JSON log entries of buf having msg
+func logEntries(t *testing.T, buf *bytes.Buffer, msg string) []map[string]interface{} {
+	t.Helper()
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		if entry["msg"] == msg {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+func TestLogFormats(t *testing.T) {
+	var buf bytes.Buffer
+
+	l := newLogger(&buf, levelInfo, "json")
+	l.Debug("hidden")
+	l.Warn("disk full", "path", "/var/lib/lxc", "free", 0, "error", errors.New("no space"), "after", time.Second)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%s: %v", buf.String(), err)
+	}
+	if entry["level"] != "warn" || entry["msg"] != "disk full" || entry["path"] != "/var/lib/lxc" ||
+		entry["free"] != 0.0 || entry["error"] != "no space" || entry["after"] != "1s" || entry["time"] == nil {
+		t.Errorf("unexpected entry %s", buf.String())
+	}
+
+	buf.Reset()
+	l = newLogger(&buf, levelDebug, "logfmt")
+	l.Debug("container started", "container", "c1", "detail", `said "hi"`, "empty", "")
+
+	line := buf.String()
+	want := ` level=debug msg="container started" container=c1 detail="said \"hi\"" empty=""` + "\n"
+	if !strings.HasPrefix(line, "time=") || !strings.HasSuffix(line, want) {
+		t.Errorf("unexpected line %q", line)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	api := newTestAPI(t)
+	buf := captureLog(t)
+
+	resp, body := api.send(t, "GET", "/v1/containers/c1?root=fast", api.admin, nil)
+	expectError(t, resp.StatusCode, 404, body, "not_defined")
+
+	api.do(t, "GET", "/nowhere", "", nil)
+
+	entries := logEntries(t, buf, "request")
+	if len(entries) != 2 {
+		t.Fatalf("access log %s", buf.String())
+	}
+
+	want := map[string]interface{}{
+		"level":      "info",
+		"method":     "GET",
+		"route":      "/v1/containers/{name}",
+		"path":       "/v1/containers/c1",
+		"container":  "c1",
+		"status":     404.0,
+		"principal":  "admin",
+		"request_id": resp.Header.Get(requestIDHeader),
+	}
+	for key, value := range want {
+		if entries[0][key] != value {
+			t.Errorf("%s: %v, want %v", key, entries[0][key], value)
+		}
+	}
+	if _, ok := entries[0]["duration_ms"].(float64); !ok {
+		t.Errorf("no duration in %v", entries[0])
+	}
+
+	if entries[1]["path"] != "/nowhere" || entries[1]["status"] != 404.0 || entries[1]["route"] != "" {
+		t.Errorf("unexpected entry %v", entries[1])
+	}
+
+	// Client errors are only detailed when debugging
+	if failed := logEntries(t, buf, "request failed"); len(failed) != 0 {
+		t.Errorf("client error logged at level info: %v", failed)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	api := newTestAPI(t)
+	buf := captureLog(t)
+	reader := api.token(t, "reader", []string{scopeContainersRead}, nil)
+
+	var level LogLevel
+	status, body := api.do(t, "GET", "/v1/admin/log-level", api.admin, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &level)
+	if level.Level != "info" {
+		t.Errorf("level %s, want info", level.Level)
+	}
+
+	status, body = api.do(t, "PUT", "/v1/admin/log-level", reader, LogLevel{Level: "debug"})
+	expectError(t, status, 403, body, "forbidden")
+
+	status, body = api.do(t, "PUT", "/v1/admin/log-level", api.admin, LogLevel{Level: "verbose"})
+	expectError(t, status, 422, body, "validation_failed")
+
+	status, body = api.do(t, "PUT", "/v1/admin/log-level", api.admin, LogLevel{Level: "debug"})
+	expectStatus(t, status, 200, body)
+
+	if logger.Level() != levelDebug {
+		t.Errorf("level %v, want debug", logger.Level())
+	}
+
+	changed := logEntries(t, buf, "log level changed")
+	if len(changed) != 1 || changed[0]["to"] != "debug" || changed[0]["principal"] != "admin" {
+		t.Errorf("change not logged: %s", buf.String())
+	}
+
+	api.do(t, "GET", "/v1/containers/c1", api.admin, nil)
+
+	failed := logEntries(t, buf, "request failed")
+	if len(failed) != 1 || failed[0]["code"] != "not_defined" || failed[0]["level"] != "debug" {
+		t.Errorf("client error not logged at level debug: %s", buf.String())
+	}
+}
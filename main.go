@@ -15,13 +15,16 @@
 //
 //     Produces:
 //     - application/json
+//     - application/problem+json
 //
 //     Security:
-//     - basic:
+//     - bearer:
 //
 //     SecurityDefinitions:
-//     basic:
-//          type: basic
+//     bearer:
+//          type: apiKey
+//          name: Authorization
+//          in: header
 //
 // swagger:meta
 
@@ -29,14 +32,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/go-openapi/runtime/middleware"
 	"github.com/gorilla/mux" // http-swagger middleware
-	lxc "gopkg.in/lxc/go-lxc.v2"
 )
 
 // @title LXC HTTP API
@@ -47,8 +53,6 @@ import (
 // @host server.clerc.im:8000
 // @BasePath /
 
-const lxcpath string = "/var/lib/lxc"
-
 // Version model
 // swagger:model Version
 type Version struct {
@@ -75,6 +79,10 @@ type HTTPClientResp struct {
 	// example: container created successfully
 
 	Message string `json:"message"`
+
+	// Machine-readable error code, only set on errors
+	// example: not_defined
+	Code string `json:"code,omitempty"`
 }
 
 type apiError struct {
@@ -88,6 +96,7 @@ type apiError struct {
 type ContainerTemplate struct {
 	// Container name
 	// required: true
+	// min length: 1
 	// example: dummy
 	Name string `json:"name"`
 
@@ -95,9 +104,27 @@ type ContainerTemplate struct {
 	// example: true
 	Started bool `json:"started"`
 
-	// Container template
-	// required: true
-	TemplateOpts lxc.TemplateOptions `json:"template"`
+	// Container template, merged over the one of the profiles
+	TemplateOpts TemplateOptions `json:"template"`
+
+	// Resource limits, merged over the ones of the profiles
+	Limits ContainerLimits `json:"limits"`
+
+	// Profiles applied in order, later ones overriding earlier ones
+	// example: ["base", "web"]
+	Profiles []string `json:"profiles"`
+
+	// Labels, which containers are selected by
+	// example: {"env": "prod", "team": "web"}
+	Labels map[string]string `json:"labels"`
+
+	// Annotations, free-form
+	// example: {"contact": "ops@example.com"}
+	Annotations map[string]string `json:"annotations"`
+
+	// Fields of the template and limits given in the request, which
+	// override profiles even when false or 0
+	given givenFields
 }
 
 // DestroyOptions model
@@ -106,20 +133,38 @@ type DestroyOptions struct {
 	// Defined if container need to be stopped before destroy
 	// example: true
 	Force bool `json:"force"`
+}
+
+// CloneOptions model
+// swagger:model CloneOptions
+type CloneOptions struct {
+	// Clone name
+	// required: true
+	// example: dummy-clone
+	Name string `json:"name"`
+
+	// Storage root of the clone, the one of the original container when empty
+	// example: fast
+	Root string `json:"root"`
+
+	// Do not change the hostname of the clone
+	// example: false
+	KeepName bool `json:"keep_name"`
 
+	// Use the same MAC address as the original container
+	// example: false
+	KeepMAC bool `json:"keep_mac"`
+
+	// Clone as a copy-on-write snapshot, when the backend supports it
+	// example: false
+	Snapshot bool `json:"snapshot"`
 }
 
 type apiHandler func(http.ResponseWriter, *http.Request) *apiError
 
 func (fn apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if e := fn(w, r); e != nil {
-		log.Printf("ERROR: %s\n", e.Error)
-		jsonError := &HTTPClientResp{
-			Status:  "error",
-			Message: e.Message}
-		js, _ := json.Marshal(jsonError)
-		fmt.Println(string(js))
-		http.Error(w, string(js), e.Code)
+		writeError(w, r, e)
 	}
 }
 
@@ -134,7 +179,7 @@ func (fn apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func GetVersion(w http.ResponseWriter, r *http.Request) *apiError {
 	lxcVersion := &Version{
 
-		Version: lxc.Version()}
+		Version: driver.Version()}
 
 	js, err := json.Marshal(lxcVersion)
 
@@ -156,13 +201,39 @@ func GetVersion(w http.ResponseWriter, r *http.Request) *apiError {
 // @Description Return list of containers
 // @Tags containers
 // @Produce json
+// @Param selector query string false "Label selector, such as env=prod,team!=ml"
 // @Success 200 {object} Containers
 // @Failure 500 {object} HTTPClientResp
 // @Router /containers [get]
 func GetContainers(w http.ResponseWriter, r *http.Request) *apiError {
+	p := principalFromContext(r.Context())
+
+	lxcpath, e := requestRoot(r)
+	if e != nil {
+		return e
+	}
+
+	names, err := driver.List(lxcpath)
+
+	if err != nil {
+		return driverError(err)
+	}
+
+	sel, err := parseLabelSelector(r.URL.Query().Get("selector"))
+
+	if err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	names, err = filterLabels(lxcpath, policy.Filter(p, lxcpath, names), sel)
+
+	if err != nil {
+		return driverError(err)
+	}
+
 	lxcContainers := &Containers{
 
-		Containers: lxc.ContainerNames(lxcpath)}
+		Containers: names}
 
 	js, err := json.Marshal(lxcContainers)
 
@@ -183,7 +254,7 @@ func GetContainers(w http.ResponseWriter, r *http.Request) *apiError {
 // @Accept json
 // @Tags container
 // @Produce json
-// @Param options body lxc.TemplateOptions false "Creation parameters"
+// @Param options body ContainerTemplate false "Creation parameters"
 // @Success 200 {object} HTTPClientResp
 // @Failure 400 {object} HTTPClientResp
 // @Failure 500 {object} HTTPClientResp
@@ -197,22 +268,13 @@ func CreateContainer(w http.ResponseWriter, r *http.Request) *apiError {
 		return &apiError{err, err.Error(), 400}
 	}
 
-	c, err := lxc.NewContainer(opts.Name, lxcpath)
-
-	if err != nil {
-		return &apiError{err, err.Error(), 500}
-	}
-	defer c.Release()
-
-	if err := c.Create(opts.TemplateOpts); err != nil {
-		return &apiError{err, err.Error(), 500}
+	lxcpath, e := requestRoot(r)
+	if e != nil {
+		return e
 	}
 
-	if opts.Started {
-
-		if err := c.Start(); err != nil {
-			return &apiError{err, err.Error(), 500}
-		}
+	if e := createContainer(r, lxcpath, opts); e != nil {
+		return e
 	}
 
 	jsonResp := &HTTPClientResp{
@@ -227,6 +289,91 @@ func CreateContainer(w http.ResponseWriter, r *http.Request) *apiError {
 	return nil
 }
 
+// createContainer creates, and possibly starts, a container in lxcpath on
+// behalf of the principal of r
+func createContainer(r *http.Request, lxcpath string, opts ContainerTemplate) *apiError {
+	if opts.Name == "" {
+		err := errors.New("no container name passed")
+		return &apiError{err, err.Error(), 400}
+	}
+
+	opts, profile, err := mergeProfiles(opts)
+	if err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	if err := validateLabels(opts.Labels); err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+	if err := validateAnnotations(opts.Annotations); err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	unlock, e := locks.lock(r.Context(), "create", lxcpath, opts.Name)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	if _, err := driver.State(lxcpath, opts.Name); err == nil {
+		if e := checkAccess(r, lxcpath, opts.Name); e != nil {
+			return e
+		}
+	} else {
+
+		// Only containers created here are cleaned up when interrupted
+		done, e := journal.begin(journalEntry{Op: journalCreate, LXCPath: lxcpath, Name: opts.Name, Start: opts.Started})
+		if e != nil {
+			return e
+		}
+		defer done()
+
+		if e := checkTenants(principalFromContext(r.Context()), opts.Name); e != nil {
+			return e
+		}
+		release, e := quotas.reserve(lxcpath, opts.Name, opts.Limits)
+		if e != nil {
+			return e
+		}
+		defer release()
+	}
+
+	if err := driver.Create(lxcpath, opts.Name, opts.TemplateOpts); err != nil {
+		return driverError(err)
+	}
+
+	md := &ContainerMetadata{
+		Owner:       principalFromContext(r.Context()).Name,
+		OwnerID:     principalFromContext(r.Context()).ID,
+		CreatedAt:   time.Now().UTC(),
+		Profiles:    opts.Profiles,
+		Labels:      opts.Labels,
+		Annotations: opts.Annotations}
+
+	if err := writeMetadata(lxcpath, opts.Name, md); err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	if err := applyProfile(lxcpath, opts.Name, profile); err != nil {
+		return driverError(err)
+	}
+
+	if opts.Limits != (ContainerLimits{}) {
+		if err := setContainerLimits(lxcpath, opts.Name, opts.Limits); err != nil {
+			return driverError(err)
+		}
+	}
+
+	if opts.Started {
+
+		if err := driver.Start(lxcpath, opts.Name); err != nil {
+			return driverError(err)
+		}
+	}
+
+	return nil
+}
+
 // DestroyContainer godoc
 // @Summary Destroy a container
 // @Description Destroy a container
@@ -243,65 +390,435 @@ func DestroyContainer(w http.ResponseWriter, r *http.Request) *apiError {
 
 	var opts DestroyOptions
 
+	// Options are optional, and so is the body
 	err := json.NewDecoder(r.Body).Decode(&opts)
 
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return &apiError{err, err.Error(), 400}
 	}
 
 	if vars["container"] == "" {
-		var err error
-		return &apiError{err, "no container name passed", 500}
+		err := errors.New("no container name passed")
+		return &apiError{err, err.Error(), 400}
+	}
+
+	lxcpath, e := requestRoot(r)
+	if e != nil {
+		return e
+	}
+
+	if e := destroyContainer(r, lxcpath, vars["container"], opts.Force); e != nil {
+		return e
+	}
+
+	jsonResp := &HTTPClientResp{
+		Status:  "success",
+		Message: "container destroyed"}
+	js, _ := json.Marshal(jsonResp)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(string(js)))
+
+	return nil
+}
+
+// destroyContainer destroys container name of lxcpath, stopping it first
+// when force is set
+func destroyContainer(r *http.Request, lxcpath string, name string, force bool) *apiError {
+	if e := checkAccess(r, lxcpath, name); e != nil {
+		return e
 	}
 
-	c, err := lxc.NewContainer(vars["container"], lxcpath)
+	unlock, e := locks.lock(r.Context(), "destroy", lxcpath, name)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	done, e := journal.begin(journalEntry{Op: journalDestroy, LXCPath: lxcpath, Name: name, Force: force})
+	if e != nil {
+		return e
+	}
+	defer done()
+
+	// A stopped container is destroyed all the same
+	if err := stopAndDestroy(lxcpath, name, force); err != nil {
+		return driverError(err)
+	}
+
+	return nil
+}
+
+// CloneContainer godoc
+// @Summary Clone a container
+// @Description Clone a stopped container, possibly to another storage root
+// @Accept json
+// @Tags container
+// @Produce json
+// @Param container path string true "Container name"
+// @Param options body CloneOptions true "Clone parameters"
+// @Success 200 {object} HTTPClientResp
+// @Failure 400 {object} HTTPClientResp
+// @Failure 404 {object} HTTPClientResp
+// @Failure 500 {object} HTTPClientResp
+// @Router /clone/{container} [post]
+func CloneContainer(w http.ResponseWriter, r *http.Request) *apiError {
+	vars := mux.Vars(r)
+
+	var opts CloneOptions
+
+	err := json.NewDecoder(r.Body).Decode(&opts)
 
 	if err != nil {
 		return &apiError{err, err.Error(), 400}
 	}
 
-	if opts.Force {
+	lxcpath, e := requestRoot(r)
+	if e != nil {
+		return e
+	}
+
+	if _, e := cloneContainer(r, lxcpath, vars["container"], opts); e != nil {
+		return e
+	}
+
+	jsonResp := &HTTPClientResp{
+		Status:  "success",
+		Message: "container cloned"}
+	js, _ := json.Marshal(jsonResp)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+
+	return nil
+}
+
+// cloneContainer clones container name of lxcpath on behalf of the
+// principal of r, and returns the lxcpath of the clone
+func cloneContainer(r *http.Request, lxcpath string, name string, opts CloneOptions) (string, *apiError) {
+	if opts.Name == "" {
+		err := errors.New("no clone name passed")
+		return "", &apiError{err, err.Error(), 400}
+	}
 
-		err := c.Stop()
+	target := lxcpath
+	if opts.Root != "" {
+		var err error
+		target, err = rootPath(opts.Root)
 		if err != nil {
-			return &apiError{err, err.Error(), 500}
+			return "", &apiError{err, err.Error(), 400}
 		}
 	}
 
-	err = c.Destroy()
+	if e := checkAccess(r, lxcpath, name); e != nil {
+		return "", e
+	}
+
+	unlock, e := locks.lockKeys(r.Context(), "clone", lockKey{lxcpath, name}, lockKey{target, opts.Name})
+	if e != nil {
+		return "", e
+	}
+	defer unlock()
 
+	limits, err := containerLimits(lxcpath, name)
 	if err != nil {
-		return &apiError{err, err.Error(), 400}
+		return "", driverError(err)
+	}
+
+	if _, err := driver.State(target, opts.Name); err == nil {
+		if e := checkAccess(r, target, opts.Name); e != nil {
+			return "", e
+		}
 	} else {
-		jsonResp := &HTTPClientResp{
-			Status:  "success",
-			Message: "container destroyed"}
-		js, _ := json.Marshal(jsonResp)
+		done, e := journal.begin(journalEntry{Op: journalClone, LXCPath: target, Name: opts.Name})
+		if e != nil {
+			return "", e
+		}
+		defer done()
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(string(js)))
+		// The clone has the limits of the original container
+		if e := checkTenants(principalFromContext(r.Context()), opts.Name); e != nil {
+			return "", e
+		}
+		release, e := quotas.reserve(target, opts.Name, limits)
+		if e != nil {
+			return "", e
+		}
+		defer release()
+	}
 
-		return nil
+	if err := driver.Clone(lxcpath, name, target, opts); err != nil {
+		return "", driverError(err)
 	}
 
-	return nil
+	md := &ContainerMetadata{
+		Owner:     principalFromContext(r.Context()).Name,
+		OwnerID:   principalFromContext(r.Context()).ID,
+		CreatedAt: time.Now().UTC(),
+		DiskBytes: limits.DiskBytes}
+
+	if err := writeMetadata(target, opts.Name, md); err != nil {
+		return "", &apiError{err, err.Error(), 500}
+	}
+
+	return target, nil
 }
 
 func main() {
+	var err error
+	var command string
+	config, command, err = loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch command {
+	case commandPrintConfig:
+		if err := config.Print(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case commandVerifyAudit:
+		n, err := verifyAuditLog(config.Audit.File)
+		if err != nil {
+			log.Fatalf("%s: %v", config.Audit.File, err)
+		}
+		fmt.Printf("%s: %d records, hash chain intact\n", config.Audit.File, n)
+		return
+	}
+
+	// The configuration is validated, so are the level and format
+	level, _ := parseLogLevel(config.Log.Level)
+	logger = newLogger(os.Stderr, level, config.Log.Format)
+
+	if config.Log.File != "" {
+		f, err := os.OpenFile(config.Log.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.SetOutput(f)
+	}
+
+	// Errors logged by net/http go to the same log
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{levelError})
+
+	policy = &config.Auth.Policy
+
+	driver, err = newDriver(config.Driver)
+	if err != nil {
+		fatal(err)
+	}
+
+	tokens, err = openTokenStore(config.Auth.TokensFile)
+	if err != nil {
+		fatal(err)
+	}
+
+	if config.Features.TokenBootstrap {
+		bootstrap, err := tokens.bootstrap()
+		if err != nil {
+			fatal(err)
+		}
+		if bootstrap != "" {
+			logger.Warn("no API token found, bootstrap admin token written", "file", bootstrap)
+		}
+	}
+
+	idempotency = newIdempotencyStore(config.IdempotencyTTL)
+	locks = newLockManager(config.LockTimeout)
+
+	limiter = newRateLimiter(config.Limits)
+	limiter.reloadLimitsOnSIGHUP(os.Args[1:])
+
+	if config.Audit.Enabled {
+		audit, err = openAuditLog(config.Audit.File)
+		if err != nil {
+			fatal(err)
+		}
+		defer audit.Close()
+	}
+
+	profiles, err = openProfileStore(filepath.Join(config.StateDir, profilesFile))
+	if err != nil {
+		fatal(err)
+	}
+
+	// Operations interrupted by the previous run are recovered before
+	// serving new ones
+	journal, err = openJournal(filepath.Join(config.StateDir, journalFile))
+	if err != nil {
+		fatal(err)
+	}
+	if err := journal.recover(); err != nil {
+		fatal(err)
+	}
+
+	if config.Features.Validation || config.Debug {
+		validator, err = loadSpecValidator(config.SpecFile)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	var configuredRouter http.Handler = newRouter()
+	if config.Features.Docs {
+		a := middleware.RedocOpts{
+			SpecURL: "/swagger/swagger.json",
+		}
+		configuredRouter = middleware.Redoc(a, configuredRouter)
+	}
+
+	srv := &http.Server{
+		Handler: configuredRouter,
+		Addr:    config.Listen,
+
+		// Good practice: enforce timeouts for servers you create!
+		WriteTimeout: config.WriteTimeout,
+		ReadTimeout:  config.ReadTimeout,
+
+		// Unix socket clients are authorized by their credentials
+		ConnContext: peerCredContext,
+	}
+
+	// Signals are caught before listening, not to be killed by an early
+	// one
+	signals := notifyShutdown()
+
+	errs := make(chan error, 2)
+
+	if config.Socket.Path != "" {
+		mode, _ := config.Socket.FileMode()
+
+		l, err := listenUnix(config.Socket.Path, mode, config.Socket.Group)
+		if err != nil {
+			fatal(err)
+		}
+
+		go func() { errs <- srv.Serve(l) }()
+	}
+
+	if config.Listen != "" && !config.TLS.Enabled {
+		go func() { errs <- srv.ListenAndServe() }()
+	}
+
+	if config.Listen != "" && config.TLS.Enabled {
+		certFile, keyFile := config.TLS.Cert, config.TLS.Key
+		if certFile == "" {
+			certFile, keyFile, err = bootstrapCertificate(filepath.Join(config.StateDir, "tls"))
+			if err != nil {
+				fatal(err)
+			}
+		}
+
+		certs, err := newTLSReloader(certFile, keyFile, config.TLS.ClientCA, config.TLS.RequireClientCert)
+		if err != nil {
+			fatal(err)
+		}
+		certs.reloadOnSIGHUP()
+		srv.TLSConfig = certs.Config()
+
+		go func() { errs <- srv.ListenAndServeTLS("", "") }()
+	}
+
+	// systemd is told once listening, and its watchdog pinged while
+	// serving
+	stop := make(chan struct{})
+	defer close(stop)
+	go notifyReady(stop)
+
+	if err := waitForShutdown(srv, errs, signals); err != nil {
+		fatal(err)
+	}
+}
+
+// newRouter returns the API routes
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(withRequestID)
+	r.Use(withAccessLog)
+	if audit != nil {
+		r.Use(audit.withAudit)
+	}
+	r.Use(authenticate)
+	if limiter != nil {
+		r.Use(limiter.withLimits)
+	}
+
+	// Requests matching no route are logged all the same
+	r.NotFoundHandler = withRequestID(withAccessLog(http.NotFoundHandler()))
+
+	if idempotency != nil {
+		r.Use(idempotency.withIdempotency)
+	}
 
-	a := middleware.RedocOpts{
-		SpecURL: "/swagger/swagger.json",
+	if validator != nil {
+		if config.Debug {
+			r.Use(validator.validateResponses)
+		}
+		if config.Features.Validation {
+			r.Use(validator.validateRequests)
+		}
 	}
-	configuredRouter := middleware.Redoc(a, r)
+
+	registerV1(r)
+
+	// swagger:operation GET /healthz health health
+	//
+	// Tell the server is alive
+	// ---
+	// security: []
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// responses:
+	//   '200':
+	//     description: Health response
+	//     schema:
+	//       "$ref": "#/definitions/Health"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/healthz", apiHandler(GetHealth)).Methods("GET")
+
+	// swagger:operation GET /readyz health readiness
+	//
+	// Run the self-checks telling whether the server can serve containers,
+	// reporting each to authenticated callers
+	// ---
+	// security: []
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// responses:
+	//   '200':
+	//     description: Every check passed
+	//     schema:
+	//       "$ref": "#/definitions/Readiness"
+	//   '503':
+	//     description: A check failed
+	//     schema:
+	//       "$ref": "#/definitions/Readiness"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/readyz", apiHandler(GetReadiness)).Methods("GET")
+
+	// Routes predating /v1 are kept as deprecated aliases
 
 	// swagger:operation GET /version general version
 	//
 	// Return current LXC version
 	// ---
+	// deprecated: true
+	// security: []
 	// produces:
 	// - application/json
+	// - application/problem+json
 	// responses:
 	//   '200':
 	//     description: Version response
@@ -310,15 +827,22 @@ func main() {
 	//   default:
 	//     description: unexpected error
 	//     schema:
-	//       "$ref": "#/definitions/HTTPClientResp"
-	r.Handle("/version", apiHandler(GetVersion)).Methods("GET")
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/version", deprecated("/v1/version", apiHandler(GetVersion))).Methods("GET")
 
 	// swagger:operation GET /containers containers containers
 	//
 	// Return containers list
 	// ---
+	// deprecated: true
 	// produces:
 	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
 	// responses:
 	//   '200':
 	//     description: Containers response
@@ -327,20 +851,24 @@ func main() {
 	//   default:
 	//     description: unexpected error
 	//     schema:
-	//       "$ref": "#/definitions/HTTPClientResp"
-	r.Handle("/containers", apiHandler(GetContainers)).Methods("GET")
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/containers", deprecated("/v1/containers", requireScope(scopeContainersRead, GetContainers))).Methods("GET")
 
 	// Serve swagger json file
 	// r.Path("/swagger.json").Handler(http.FileServer(http.Dir("./swagger")))
-	r.PathPrefix("/swagger/").Handler(
-		http.StripPrefix("/swagger/", http.FileServer(http.Dir("./docs"))))
+	if config.Features.Docs {
+		r.PathPrefix("/swagger/").Handler(
+			http.StripPrefix("/swagger/", http.FileServer(http.Dir("./docs"))))
+	}
 
 	// swagger:operation POST /create container create
 	//
 	// Create a new container
 	// ---
+	// deprecated: true
 	// produces:
 	// - application/json
+	// - application/problem+json
 	// parameters:
 	// - name: template
 	//   in: body
@@ -348,26 +876,41 @@ func main() {
 	//   required: true
 	//   schema:
 	//     "$ref": "#/definitions/ContainerTemplate"
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
 	// responses:
 	//   '200':
 	//     description: API response
 	//     schema:
 	//       "$ref": "#/definitions/HTTPClientResp"
+	//   '404':
+	//     description: a container of that name exists that the caller cannot access
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: container already defined
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
 	//   default:
 	//     description: unexpected error
 	//     schema:
-	//       "$ref": "#/definitions/HTTPClientResp"
-	r.Handle("/create", apiHandler(CreateContainer)).Methods("POST")
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/create", deprecated("/v1/containers", requireScope(scopeContainersWrite, CreateContainer))).Methods("POST")
 
 	// Handle request to destroy endpoint when container name is missing
-	r.Handle("/destroy/", apiHandler(DestroyContainer)).Methods("DELETE")
+	r.Handle("/destroy/", deprecated("/v1/containers", requireScope(scopeContainersWrite, DestroyContainer))).Methods("DELETE")
 
-	// swagger:operation DELETE /delete/{container} container delete
+	// swagger:operation DELETE /destroy/{container} container delete
 	//
 	// Delete a container
 	// ---
+	// deprecated: true
 	// produces:
 	// - application/json
+	// - application/problem+json
 	// parameters:
 	// - name: container
 	//   in: path
@@ -378,27 +921,165 @@ func main() {
 	//   in: body
 	//   schema:
 	//     "$ref": "#/definitions/DestroyOptions"
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
 	// responses:
 	//   '200':
 	//     description: API response
 	//     schema:
 	//       "$ref": "#/definitions/HTTPClientResp"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: container is running, and force is not set
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
 	//   default:
 	//     description: unexpected error
 	//     schema:
+	//       "$ref": "#/definitions/Problem"
+
+	r.Handle("/destroy/{container}", deprecated("/v1/containers/{container}", requireScope(scopeContainersWrite, DestroyContainer))).Methods("DELETE")
+
+	// swagger:operation POST /clone/{container} container clone
+	//
+	// Clone a stopped container, possibly to another storage root
+	// ---
+	// deprecated: true
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: container
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: options
+	//   in: body
+	//   description: clone parameters
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/CloneOptions"
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: API response
+	//     schema:
 	//       "$ref": "#/definitions/HTTPClientResp"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: container is running, or the clone already exists
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/clone/{container}", deprecated("/v1/containers/{container}/clone", requireScope(scopeContainersWrite, CloneContainer))).Methods("POST")
 
-	r.Handle("/destroy/{container}", apiHandler(DestroyContainer)).Methods("DELETE")
-	http.Handle("/", r)
+	// swagger:operation GET /roots general roots
+	//
+	// Return storage roots list
+	// ---
+	// deprecated: true
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// responses:
+	//   '200':
+	//     description: Roots response
+	//     schema:
+	//       "$ref": "#/definitions/Roots"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/roots", deprecated("/v1/roots", requireScope(scopeContainersRead, GetRoots))).Methods("GET")
 
-	srv := &http.Server{
-		Handler: configuredRouter,
-		Addr:    "0.0.0.0:8000",
+	// swagger:operation GET /tokens tokens listTokens
+	//
+	// Return API tokens list, without their secret
+	// ---
+	// deprecated: true
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// responses:
+	//   '200':
+	//     description: Tokens response
+	//     schema:
+	//       "$ref": "#/definitions/Tokens"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/tokens", deprecated("/v1/tokens", requireScope(scopeTokens, GetTokens))).Methods("GET")
 
-		// Good practice: enforce timeouts for servers you create!
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
-	}
+	// swagger:operation POST /tokens tokens createToken
+	//
+	// Create an API token, its secret is only returned once
+	// ---
+	// deprecated: true
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: token
+	//   in: body
+	//   description: token parameters
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/TokenRequest"
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: New token response
+	//     schema:
+	//       "$ref": "#/definitions/NewToken"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/tokens", deprecated("/v1/tokens", requireScope(scopeTokens, CreateToken))).Methods("POST")
+
+	// swagger:operation DELETE /tokens/{id} tokens revokeToken
+	//
+	// Revoke an API token
+	// ---
+	// deprecated: true
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: id
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Token identifier
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: API response
+	//     schema:
+	//       "$ref": "#/definitions/HTTPClientResp"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/tokens/{id}", deprecated("/v1/tokens/{id}", requireScope(scopeTokens, RevokeToken))).Methods("DELETE")
 
-	log.Fatal(srv.ListenAndServe())
+	return r
 }
@@ -0,0 +1,745 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-openapi/loads"
+	"github.com/go-openapi/spec"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/validate"
+	"github.com/gorilla/mux"
+)
+
+// specFile is the API documentation responses are validated against
+const specFile = "docs/swagger.json"
+
+var (
+	// apiSpec is the expanded API documentation
+	apiSpec *loads.Document
+
+	// specValidatorCache is loaded once for all the servers of the suite
+	specValidatorCache *specValidator
+
+	// coveredRoutes records the routes exercised by the suite, as
+	// "METHOD template"
+	coveredMu     sync.Mutex
+	coveredRoutes = map[string]bool{}
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	// Requests and errors are logged, as expected by most tests
+	if !testing.Verbose() {
+		logger.SetOutput(ioutil.Discard)
+		log.SetOutput(ioutil.Discard)
+	}
+
+	doc, err := loads.Spec(specFile)
+	if err == nil {
+		apiSpec, err = doc.Expanded()
+	}
+	if err == nil {
+		specValidatorCache, err = loadSpecValidator(specFile)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+
+	// Only the whole suite is expected to cover every route
+	if code == 0 && flag.Lookup("test.run").Value.String() == "" {
+		if missing := uncoveredRoutes(newRouter()); len(missing) > 0 {
+			fmt.Fprintf(os.Stderr, "routes not covered by tests:\n  %s\n", strings.Join(missing, "\n  "))
+			code = 1
+		}
+	}
+
+	os.Exit(code)
+}
+
+// uncoveredRoutes returns the routes of r no test requested
+func uncoveredRoutes(r *mux.Router) []string {
+	coveredMu.Lock()
+	defer coveredMu.Unlock()
+
+	var missing []string
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+
+		for _, method := range methods {
+			if !coveredRoutes[method+" "+tmpl] {
+				missing = append(missing, method+" "+tmpl)
+			}
+		}
+		return nil
+	})
+	sort.Strings(missing)
+
+	return missing
+}
+
+// testAPI is an API server backed by the fake driver
+type testAPI struct {
+	server *httptest.Server
+	router *mux.Router
+
+	// admin is a token holding every scope
+	admin string
+}
+
+// newTestAPI resets the server state and starts a new server
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "lxc-go-http-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config = defaultConfig()
+	config.Driver = "fake"
+	config.StateDir = dir
+	config.Debug = true
+	config.Roots = map[string]string{
+		defaultRoot: config.LXCPath,
+		"fast":      "/srv/fast/lxc",
+	}
+	config.Auth.TokensFile = filepath.Join(dir, "tokens.json")
+	config.Auth.Policy = Policy{
+		Groups: map[string][]string{
+			"team-a": {"a-*"},
+		},
+	}
+	if err := config.Auth.Policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	policy = &config.Auth.Policy
+
+	driver = newFakeDriver()
+	validator = specValidatorCache
+	idempotency = newIdempotencyStore(config.IdempotencyTTL)
+	locks = newLockManager(config.LockTimeout)
+	limiter = newRateLimiter(config.Limits)
+	quotas = newQuotaTracker()
+	operations = newOperationStore()
+	readinessProbe = &readinessCache{}
+
+	journal, err = openJournal(filepath.Join(dir, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audit, err = openAuditLog(filepath.Join(dir, auditFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+
+	tokens, err = openTokenStore(config.Auth.TokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profiles, err = openProfileStore(filepath.Join(dir, profilesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := &testAPI{router: newRouter()}
+	api.server = httptest.NewServer(api.router)
+	t.Cleanup(api.server.Close)
+
+	api.admin = api.token(t, "admin", []string{scopeAdmin}, nil)
+
+	return api
+}
+
+// token creates a token and returns its secret
+func (api *testAPI) token(t *testing.T, name string, scopes []string, groups []string) string {
+	t.Helper()
+
+	tok, err := tokens.Create("", name, scopes, groups, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok.Secret
+}
+
+// do sends a request authenticated with token, when not empty, and
+// returns the response status and body. body is sent as is when it is a
+// string, and JSON encoded otherwise. Responses are validated against the
+// API documentation.
+func (api *testAPI) do(t *testing.T, method string, path string, token string, body interface{}) (int, []byte) {
+	t.Helper()
+
+	resp, data := api.send(t, method, path, token, body)
+	return resp.StatusCode, data
+}
+
+// send is do, returning the whole response
+func (api *testAPI) send(t *testing.T, method string, path string, token string, body interface{}) (*http.Response, []byte) {
+	t.Helper()
+
+	return api.roundTrip(t, api.request(t, method, path, token, body))
+}
+
+// request returns the request of send, for tests to add headers
+func (api *testAPI) request(t *testing.T, method string, path string, token string, body interface{}) *http.Request {
+	t.Helper()
+
+	var reader *bytes.Reader
+	switch b := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case string:
+		reader = bytes.NewReader([]byte(b))
+	default:
+		js, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, api.server.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req
+}
+
+// roundTrip sends req, recording the route it covers and checking the
+// response against the API documentation
+func (api *testAPI) roundTrip(t *testing.T, req *http.Request) (*http.Response, []byte) {
+	t.Helper()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var match mux.RouteMatch
+	if api.router.Match(req, &match) && match.Route != nil {
+		tmpl, _ := match.Route.GetPathTemplate()
+
+		coveredMu.Lock()
+		coveredRoutes[req.Method+" "+tmpl] = true
+		coveredMu.Unlock()
+
+		checkContract(t, req.Method, tmpl, resp, data)
+	}
+
+	return resp, data
+}
+
+// checkContract validates a response body against the schema documented
+// for the operation and status code. Legacy error responses are validated
+// against HTTPClientResp.
+func checkContract(t *testing.T, method string, tmpl string, resp *http.Response, data []byte) {
+	t.Helper()
+
+	status := resp.StatusCode
+	if status >= 400 {
+		switch ct := resp.Header.Get("Content-Type"); ct {
+		case problemMediaType:
+		case jsonMediaType:
+			legacy := apiSpec.Spec().Definitions["HTTPClientResp"]
+			validateBody(t, method, tmpl, status, &legacy, data)
+			return
+		default:
+			t.Errorf("%s %s: error response content type %q", method, tmpl, ct)
+			return
+		}
+	}
+
+	item, ok := apiSpec.Spec().Paths.Paths[tmpl]
+	if !ok {
+		if !undocumentedRoutes[tmpl] {
+			t.Errorf("%s %s is not documented", method, tmpl)
+		}
+		return
+	}
+
+	op := operation(item, method)
+	if op == nil {
+		t.Errorf("%s %s is not documented", method, tmpl)
+		return
+	}
+
+	response, ok := op.Responses.StatusCodeResponses[status]
+	if !ok {
+		if op.Responses.Default == nil {
+			t.Errorf("%s %s: status %d is not documented", method, tmpl, status)
+			return
+		}
+		response = *op.Responses.Default
+	}
+
+	if response.Schema == nil {
+		return
+	}
+
+	validateBody(t, method, tmpl, status, response.Schema, data)
+}
+
+func validateBody(t *testing.T, method string, tmpl string, status int, schema *spec.Schema, data []byte) {
+	t.Helper()
+
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Errorf("%s %s: response is not JSON: %s", method, tmpl, data)
+		return
+	}
+
+	if err := validate.AgainstSchema(schema, body, strfmt.Default); err != nil {
+		t.Errorf("%s %s: status %d response does not match documentation: %v\n%s", method, tmpl, status, err, data)
+	}
+}
+
+// undocumentedRoutes are served but deliberately not part of the API
+// documentation
+var undocumentedRoutes = map[string]bool{
+	"/swagger/": true,
+	"/destroy/": true,
+}
+
+func operation(item spec.PathItem, method string) *spec.Operation {
+	switch method {
+	case http.MethodGet:
+		return item.Get
+	case http.MethodPost:
+		return item.Post
+	case http.MethodPut:
+		return item.Put
+	case http.MethodPatch:
+		return item.Patch
+	case http.MethodDelete:
+		return item.Delete
+	}
+	return nil
+}
+
+// decode unmarshals a response body into v
+func decode(t *testing.T, data []byte, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("%v: %s", err, data)
+	}
+}
+
+func expectStatus(t *testing.T, got int, want int, body []byte) {
+	t.Helper()
+
+	if got != want {
+		t.Fatalf("status %d, want %d: %s", got, want, body)
+	}
+}
+
+// expectError checks a problem details response status and code
+func expectError(t *testing.T, got int, want int, body []byte, code string) {
+	t.Helper()
+
+	expectStatus(t, got, want, body)
+
+	var p Problem
+	decode(t, body, &p)
+	if p.Status != want || p.Code != code {
+		t.Fatalf("error code %q, want %q: %s", p.Code, code, body)
+	}
+}
+
+func TestSpecIsValid(t *testing.T) {
+	doc, err := loads.Spec(specFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validate.Spec(doc, strfmt.Default); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSpecMatchesRouter checks that the documented operations are exactly
+// the served routes
+func TestSpecMatchesRouter(t *testing.T) {
+	config = defaultConfig()
+
+	served := map[string]bool{}
+	newRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || undocumentedRoutes[tmpl] {
+			return nil
+		}
+
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			served[method+" "+tmpl] = true
+		}
+		return nil
+	})
+
+	documented := map[string]bool{}
+	for tmpl, item := range apiSpec.Spec().Paths.Paths {
+		for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+			if operation(item, method) != nil {
+				documented[method+" "+tmpl] = true
+			}
+		}
+	}
+
+	for route := range served {
+		if !documented[route] {
+			t.Errorf("%s is served but not documented", route)
+		}
+	}
+	for route := range documented {
+		if !served[route] {
+			t.Errorf("%s is documented but not served", route)
+		}
+	}
+}
+
+func TestSwaggerFile(t *testing.T) {
+	api := newTestAPI(t)
+
+	status, body := api.do(t, "GET", "/swagger/swagger.json", "", nil)
+	expectStatus(t, status, 200, body)
+
+	var doc map[string]interface{}
+	decode(t, body, &doc)
+	if doc["swagger"] != "2.0" {
+		t.Errorf("unexpected swagger file: %.80s", body)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	api := newTestAPI(t)
+
+	status, body := api.do(t, "GET", "/version", "", nil)
+	expectStatus(t, status, 200, body)
+
+	var v Version
+	decode(t, body, &v)
+	if v.Version != "fake" {
+		t.Errorf("version %q, want fake", v.Version)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	api := newTestAPI(t)
+	reader := api.token(t, "reader", []string{scopeContainersRead}, nil)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   interface{}
+		status int
+	}{
+		{"no token", "GET", "/containers", "", nil, 401},
+		{"malformed token", "GET", "/containers", "garbage", nil, 401},
+		{"unknown token", "GET", "/containers", "0000000000000000.secret", nil, 401},
+		{"wrong secret", "GET", "/containers", strings.SplitN(reader, ".", 2)[0] + ".secret", nil, 401},
+		{"read scope", "GET", "/containers", reader, nil, 200},
+		{"missing write scope", "POST", "/create", reader, ContainerTemplate{Name: "c1"}, 403},
+		{"missing tokens scope", "GET", "/tokens", reader, nil, 403},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := api.do(t, tt.method, tt.path, tt.token, tt.body)
+			expectStatus(t, status, tt.status, body)
+		})
+	}
+}
+
+func TestGetContainers(t *testing.T) {
+	api := newTestAPI(t)
+
+	status, body := api.do(t, "GET", "/containers", api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	var list Containers
+	decode(t, body, &list)
+	if len(list.Containers) != 0 {
+		t.Errorf("containers %v, want none", list.Containers)
+	}
+
+	driver.Create(config.LXCPath, "c1", TemplateOptions{})
+	driver.Create(config.Roots["fast"], "c2", TemplateOptions{})
+
+	status, body = api.do(t, "GET", "/containers", api.admin, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &list)
+	if len(list.Containers) != 1 || list.Containers[0] != "c1" {
+		t.Errorf("containers %v, want [c1]", list.Containers)
+	}
+
+	status, body = api.do(t, "GET", "/containers?root=fast", api.admin, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &list)
+	if len(list.Containers) != 1 || list.Containers[0] != "c2" {
+		t.Errorf("containers %v, want [c2]", list.Containers)
+	}
+
+	status, body = api.do(t, "GET", "/containers?root=nope", api.admin, nil)
+	expectStatus(t, status, 400, body)
+}
+
+func TestCreateContainer(t *testing.T) {
+	api := newTestAPI(t)
+
+	template := ContainerTemplate{
+		Name:         "c1",
+		Started:      true,
+		TemplateOpts: TemplateOptions{Template: "busybox"},
+	}
+
+	status, body := api.do(t, "POST", "/create", api.admin, template)
+	expectStatus(t, status, 200, body)
+
+	state, err := driver.State(config.LXCPath, "c1")
+	if err != nil || state != "RUNNING" {
+		t.Errorf("state %q (%v), want RUNNING", state, err)
+	}
+
+	md, err := readMetadata(config.LXCPath, "c1")
+	if err != nil || md.Owner != "admin" {
+		t.Errorf("owner %+v (%v), want admin", md, err)
+	}
+
+	t.Run("duplicate", func(t *testing.T) {
+		status, body := api.do(t, "POST", "/create", api.admin, template)
+		expectError(t, status, 409, body, "already_defined")
+	})
+
+	t.Run("malformed JSON", func(t *testing.T) {
+		status, body := api.do(t, "POST", "/create", api.admin, `{"name": `)
+		expectError(t, status, 400, body, "bad_request")
+	})
+
+	t.Run("missing name", func(t *testing.T) {
+		status, body := api.do(t, "POST", "/create", api.admin, ContainerTemplate{})
+		expectError(t, status, 422, body, "validation_failed")
+	})
+
+	t.Run("unknown root", func(t *testing.T) {
+		status, body := api.do(t, "POST", "/create?root=nope", api.admin, ContainerTemplate{Name: "c2"})
+		expectStatus(t, status, 400, body)
+	})
+
+	t.Run("other root", func(t *testing.T) {
+		status, body := api.do(t, "POST", "/create?root=fast", api.admin, ContainerTemplate{Name: "c1"})
+		expectStatus(t, status, 200, body)
+
+		if _, err := driver.State(config.Roots["fast"], "c1"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestDestroyContainer(t *testing.T) {
+	api := newTestAPI(t)
+
+	api.do(t, "POST", "/create", api.admin, ContainerTemplate{Name: "c1", Started: true})
+
+	t.Run("missing name", func(t *testing.T) {
+		status, body := api.do(t, "DELETE", "/destroy/", api.admin, DestroyOptions{})
+		expectError(t, status, 400, body, "bad_request")
+	})
+
+	t.Run("malformed JSON", func(t *testing.T) {
+		status, body := api.do(t, "DELETE", "/destroy/c1", api.admin, `{"force": `)
+		expectStatus(t, status, 400, body)
+	})
+
+	t.Run("running without force", func(t *testing.T) {
+		status, body := api.do(t, "DELETE", "/destroy/c1", api.admin, DestroyOptions{})
+		expectError(t, status, 409, body, "already_running")
+
+		if _, err := driver.State(config.LXCPath, "c1"); err != nil {
+			t.Errorf("container destroyed: %v", err)
+		}
+	})
+
+	t.Run("running with force", func(t *testing.T) {
+		status, body := api.do(t, "DELETE", "/destroy/c1", api.admin, DestroyOptions{Force: true})
+		expectStatus(t, status, 200, body)
+
+		if _, err := driver.State(config.LXCPath, "c1"); err == nil {
+			t.Error("container not destroyed")
+		}
+	})
+
+	t.Run("stopped with force", func(t *testing.T) {
+		api.do(t, "POST", "/create", api.admin, ContainerTemplate{Name: "c2"})
+
+		status, body := api.do(t, "DELETE", "/destroy/c2", api.admin, DestroyOptions{Force: true})
+		expectStatus(t, status, 200, body)
+	})
+
+	t.Run("without body", func(t *testing.T) {
+		api.do(t, "POST", "/create", api.admin, ContainerTemplate{Name: "c3"})
+
+		status, body := api.do(t, "DELETE", "/destroy/c3", api.admin, nil)
+		expectStatus(t, status, 200, body)
+	})
+
+	t.Run("unknown container", func(t *testing.T) {
+		status, body := api.do(t, "DELETE", "/destroy/c1", api.admin, DestroyOptions{})
+		expectError(t, status, 404, body, "not_defined")
+	})
+}
+
+func TestCloneContainer(t *testing.T) {
+	api := newTestAPI(t)
+
+	api.do(t, "POST", "/create", api.admin, ContainerTemplate{Name: "base"})
+
+	status, body := api.do(t, "POST", "/clone/base", api.admin, CloneOptions{Name: "scratch", Root: "fast"})
+	expectStatus(t, status, 200, body)
+
+	if _, err := driver.State(config.Roots["fast"], "scratch"); err != nil {
+		t.Errorf("clone not created in fast root: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   interface{}
+		status int
+	}{
+		{"malformed JSON", "/clone/base", `{`, 400},
+		{"missing name", "/clone/base", CloneOptions{}, 400},
+		{"unknown root", "/clone/base", CloneOptions{Name: "c", Root: "nope"}, 400},
+		{"unknown container", "/clone/nope", CloneOptions{Name: "c"}, 404},
+		{"existing clone", "/clone/base", CloneOptions{Name: "scratch", Root: "fast"}, 409},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := api.do(t, "POST", tt.path, api.admin, tt.body)
+			expectStatus(t, status, tt.status, body)
+		})
+	}
+}
+
+func TestGetRoots(t *testing.T) {
+	api := newTestAPI(t)
+
+	status, body := api.do(t, "GET", "/roots", api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	var roots Roots
+	decode(t, body, &roots)
+	if len(roots.Roots) != 2 || roots.Roots[0].Name != defaultRoot || !roots.Roots[0].Default {
+		t.Errorf("unexpected roots %+v", roots.Roots)
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	api := newTestAPI(t)
+	scopes := []string{scopeContainersRead, scopeContainersWrite}
+	alice := api.token(t, "alice", scopes, nil)
+	bob := api.token(t, "bob", scopes, []string{"team-a"})
+
+	for _, name := range []string{"alice-1", "a-shared"} {
+		status, body := api.do(t, "POST", "/create", alice, ContainerTemplate{Name: name})
+		expectStatus(t, status, 200, body)
+	}
+	api.do(t, "POST", "/create", api.admin, ContainerTemplate{Name: "admin-1"})
+
+	visible := func(token string) []string {
+		status, body := api.do(t, "GET", "/containers", token, nil)
+		expectStatus(t, status, 200, body)
+
+		var list Containers
+		decode(t, body, &list)
+		return list.Containers
+	}
+
+	if got := visible(alice); strings.Join(got, ",") != "a-shared,alice-1" {
+		t.Errorf("alice sees %v", got)
+	}
+	if got := visible(bob); strings.Join(got, ",") != "a-shared" {
+		t.Errorf("bob sees %v", got)
+	}
+
+	// Names outside grants answer as if they did not exist
+	status, body := api.do(t, "DELETE", "/destroy/alice-1", bob, DestroyOptions{})
+	expectError(t, status, 404, body, "not_defined")
+
+	_, missing := api.do(t, "DELETE", "/destroy/nope", bob, DestroyOptions{})
+	var hiddenProblem, missingProblem Problem
+	decode(t, body, &hiddenProblem)
+	decode(t, []byte(strings.Replace(string(missing), "nope", "alice-1", -1)), &missingProblem)
+	hiddenProblem.RequestID, missingProblem.RequestID = "", ""
+	if !reflect.DeepEqual(hiddenProblem, missingProblem) {
+		t.Errorf("hidden container answer %s differs from missing one %s", body, missing)
+	}
+
+	status, body = api.do(t, "POST", "/create", bob, ContainerTemplate{Name: "admin-1"})
+	expectError(t, status, 404, body, "not_defined")
+
+	status, body = api.do(t, "POST", "/clone/alice-1", bob, CloneOptions{Name: "b-1"})
+	expectError(t, status, 404, body, "not_defined")
+
+	status, body = api.do(t, "DELETE", "/destroy/a-shared", bob, DestroyOptions{})
+	expectStatus(t, status, 200, body)
+
+	// Containers belong to the principal, not to whatever shares its name
+	manager := api.token(t, "manager", []string{scopeTokens, scopeContainersRead, scopeContainersWrite}, nil)
+	status, body = api.do(t, "POST", "/tokens", manager, TokenRequest{Name: "alice", Scopes: scopes})
+	expectStatus(t, status, 403, body)
+
+	status, body = api.do(t, "POST", "/tokens", manager, TokenRequest{Name: "manager", Scopes: scopes})
+	expectStatus(t, status, 200, body)
+	var own NewToken
+	decode(t, body, &own)
+
+	impostor := &Principal{ID: unixPrincipal + "alice", Name: "alice", Scopes: scopes}
+	if md, _ := readMetadata(config.LXCPath, "alice-1"); policy.CanAccess(impostor, config.LXCPath, "alice-1") || md.OwnerID != tokenPrincipal+"alice" {
+		t.Errorf("alice-1 owned by %+v, accessible to %s", md, impostor.ID)
+	}
+
+	status, body = api.do(t, "DELETE", "/destroy/alice-1", own.Secret, DestroyOptions{})
+	expectError(t, status, 404, body, "not_defined")
+}
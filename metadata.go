@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// metadataFile is written by the lxc driver in each container directory
+const metadataFile = "api-metadata.json"
+
+// ContainerMetadata holds what the API knows about a container on top of
+// its LXC configuration
+type ContainerMetadata struct {
+	// Principal which created the container
+	Owner string `json:"owner,omitempty"`
+
+	// ID of the principal which created the container, which owns it
+	OwnerID string `json:"owner_id,omitempty"`
+
+	// Creation date
+	CreatedAt time.Time `json:"created_at"`
+
+	// Disk allowance in bytes, accounted in quotas
+	DiskBytes int64 `json:"disk_bytes,omitempty"`
+
+	// Profiles the container was created with, in order
+	Profiles []string `json:"profiles,omitempty"`
+
+	// Labels, which containers are selected by
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations, free-form
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// readMetadata returns the metadata of container name in lxcpath, or an
+// empty metadata when the container was not created through the API
+func readMetadata(lxcpath string, name string) (*ContainerMetadata, error) {
+	var md ContainerMetadata
+
+	data, err := driver.Metadata(lxcpath, name)
+	if err != nil || data == nil {
+		return &md, err
+	}
+
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, err
+	}
+
+	return &md, nil
+}
+
+// ownerID returns the ID of the principal owning the container. Metadata
+// written before principals had IDs only name owners, which were tokens.
+func (md *ContainerMetadata) ownerID() string {
+	if md.OwnerID == "" && md.Owner != "" {
+		return tokenPrincipal + md.Owner
+	}
+	return md.OwnerID
+}
+
+func writeMetadata(lxcpath string, name string, md *ContainerMetadata) error {
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return driver.SetMetadata(lxcpath, name, data)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// operationTTL is how long finished operations are kept, for clients to
+// fetch their results
+const operationTTL = time.Hour
+
+// Statuses of operations
+const (
+	operationRunning = "running"
+	operationDone    = "done"
+)
+
+// operations holds the operations run in the background by the server
+var operations = newOperationStore()
+
+// Operation model
+// swagger:model Operation
+type Operation struct {
+	// Operation identifier
+	// example: 9b2f61c04d3e8a75c1d0e2f3a4b5c6d7
+	ID string `json:"id"`
+
+	// enum: running,done
+	// example: running
+	Status string `json:"status"`
+
+	// Batch action run
+	// example: stop
+	Action string `json:"action"`
+
+	// Start date
+	CreatedAt time.Time `json:"created_at"`
+
+	// End date, empty while running
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	// Result for each container, pending until its action ran
+	Results []BatchResult `json:"results"`
+}
+
+// storedOperation is an operation along with the principal which
+// started it
+type storedOperation struct {
+	Operation
+	principal string
+}
+
+// operationStore keeps operations in memory, for operationTTL after they
+// finished
+type operationStore struct {
+	mu         sync.Mutex
+	operations map[string]*storedOperation
+
+	// Operations running, waited for on shutdown
+	running sync.WaitGroup
+}
+
+func newOperationStore() *operationStore {
+	return &operationStore{operations: make(map[string]*storedOperation)}
+}
+
+// start records an operation of principal running action on containers,
+// and returns it
+func (s *operationStore) start(principal string, action string, names []string) (*storedOperation, error) {
+	id, err := randomString(16, hex.EncodeToString)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &storedOperation{
+		Operation: Operation{
+			ID:        id,
+			Status:    operationRunning,
+			Action:    action,
+			CreatedAt: time.Now().UTC(),
+			Results:   make([]BatchResult, len(names)),
+		},
+		principal: principal,
+	}
+	for i, name := range names {
+		op.Results[i] = BatchResult{Container: name, Status: batchPending}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, o := range s.operations {
+		if o.FinishedAt != nil && now.Sub(*o.FinishedAt) > operationTTL {
+			delete(s.operations, key)
+		}
+	}
+	s.operations[id] = op
+	s.running.Add(1)
+
+	return op, nil
+}
+
+// setResult records the result of the i-th container of op
+func (s *operationStore) setResult(op *storedOperation, i int, result BatchResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op.Results[i] = result
+}
+
+// finish marks op as done
+func (s *operationStore) finish(op *storedOperation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	op.Status = operationDone
+	op.FinishedAt = &now
+	s.running.Done()
+}
+
+// wait waits for the running operations to finish, or fails when ctx is
+// done first
+func (s *operationStore) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// get returns a copy of operation id, for principal p. Admins see every
+// operation, other principals their own only.
+func (s *operationStore) get(p *Principal, id string) (*Operation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op, ok := s.operations[id]
+	if !ok || (op.principal != p.ID && !p.HasScope(scopeAdmin)) {
+		return nil, false
+	}
+
+	o := op.Operation
+	o.Results = append([]BatchResult(nil), op.Results...)
+	return &o, true
+}
+
+// operationLocation returns the URL of operation id
+func operationLocation(id string) string {
+	return "/v1/operations/" + url.PathEscape(id)
+}
+
+// detachedContext carries the values of a request context, but is not
+// canceled with the request, for operations outliving their request
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// GetOperation returns an operation, with the results it has so far
+func GetOperation(w http.ResponseWriter, r *http.Request) *apiError {
+	id := mux.Vars(r)["id"]
+
+	op, ok := operations.get(principalFromContext(r.Context()), id)
+	if !ok {
+		err := fmt.Errorf("no operation %s", id)
+		return &apiError{err, err.Error(), 404}
+	}
+
+	return writeJSON(w, http.StatusOK, op)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// peerCredContext stores the credentials of the process at the other end
+// of a unix socket connection in the connection context
+func peerCredContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, peerCredKey{}, &peerCred{
+		PID: int(cred.Pid),
+		UID: int(cred.Uid),
+		GID: int(cred.Gid),
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// peerCredContext is a no-op, peer credentials are only read on linux
+func peerCredContext(ctx context.Context, c net.Conn) context.Context {
+	return ctx
+}
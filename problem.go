@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media types of error responses
+const (
+	problemMediaType = "application/problem+json"
+	jsonMediaType    = "application/json"
+)
+
+// problemTypePrefix prefixes the code of errors having a type of their own
+const problemTypePrefix = "urn:lxc-go-http-api:error:"
+
+// Problem model, as in RFC 7807
+// swagger:model Problem
+type Problem struct {
+	// URI identifying the problem type, about:blank when the status says
+	// it all
+	// example: urn:lxc-go-http-api:error:not_defined
+	Type string `json:"type"`
+
+	// Short summary of the problem type
+	// example: Not Found
+	Title string `json:"title"`
+
+	// HTTP status code
+	// example: 404
+	Status int `json:"status"`
+
+	// Explanation of this occurrence of the problem
+	// example: container is not defined: "dummy"
+	Detail string `json:"detail"`
+
+	// Request path
+	// example: /v1/containers/dummy
+	Instance string `json:"instance"`
+
+	// Machine-readable error code
+	// example: not_defined
+	Code string `json:"code"`
+
+	// Request ID, as in the X-Request-ID response header
+	// example: 4f9d2c1be07a53d8e1c4a0b9d6f2e817
+	RequestID string `json:"request_id,omitempty"`
+
+	// Fields of the request which do not match the API documentation
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// newProblem returns the problem details of e for request r
+func newProblem(r *http.Request, e *apiError) *Problem {
+	p := &Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(e.Code),
+		Status:    e.Code,
+		Detail:    e.Message,
+		Instance:  r.URL.Path,
+		Code:      errorCode(e),
+		RequestID: requestIDFromContext(r.Context()),
+	}
+	if _, ok := knownError(e.Error); ok {
+		p.Type = problemTypePrefix + p.Code
+	}
+
+	var invalid *validationError
+	if errors.As(e.Error, &invalid) {
+		p.Errors = invalid.fields
+	}
+
+	return p
+}
+
+// wantsLegacyError tells whether the client of r prefers errors in the
+// HTTPClientResp shape, that is accepts application/json with a higher
+// quality than application/problem+json
+func wantsLegacyError(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+	return acceptQuality(accept, jsonMediaType) > acceptQuality(accept, problemMediaType)
+}
+
+// acceptQuality returns the quality the accept header gives to
+// mediaType, from its most specific matching range
+func acceptQuality(accept string, mediaType string) float64 {
+	major := strings.SplitN(mediaType, "/", 2)[0]
+
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rng, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		s := -1
+		switch rng {
+		case mediaType:
+			s = 2
+		case major + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		quality, specificity = q, s
+	}
+
+	return quality
+}
+
+// writeError replies e to r, as problem details unless the client asked
+// for the legacy shape
+func writeError(w http.ResponseWriter, r *http.Request, e *apiError) {
+	problem := newProblem(r, e)
+
+	// Client errors are in the access log, their detail is only worth
+	// debugging
+	fields := []interface{}{
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", e.Code,
+		"code", problem.Code,
+		"error", e.Error,
+		"request_id", problem.RequestID,
+	}
+	if e.Code >= 500 {
+		logger.Error("request failed", fields...)
+	} else {
+		logger.Debug("request failed", fields...)
+	}
+
+	var js []byte
+	if wantsLegacyError(r) {
+		w.Header().Set("Content-Type", jsonMediaType)
+		js, _ = json.Marshal(&HTTPClientResp{
+			Status:  "error",
+			Message: e.Message,
+			Code:    problem.Code})
+	} else {
+		w.Header().Set("Content-Type", problemMediaType)
+		js, _ = json.Marshal(problem)
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// Errors of operations to retry later tell when
+	var retry interface{ RetryAfter() time.Duration }
+	if errors.As(e.Error, &retry) {
+		seconds := int((retry.RetryAfter() + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+
+	w.WriteHeader(e.Code)
+	w.Write(js)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProblemResponse(t *testing.T) {
+	api := newTestAPI(t)
+
+	req, _ := http.NewRequest("DELETE", api.server.URL+"/destroy/nope", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer "+api.admin)
+	req.Header.Set(requestIDHeader, "req-42")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != problemMediaType {
+		t.Errorf("content type %q, want %s", ct, problemMediaType)
+	}
+	if id := resp.Header.Get(requestIDHeader); id != "req-42" {
+		t.Errorf("request ID header %q, want req-42", id)
+	}
+
+	var p Problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Problem{
+		Type:      problemTypePrefix + "not_defined",
+		Title:     "Not Found",
+		Status:    404,
+		Detail:    `container is not defined: "nope"`,
+		Instance:  "/destroy/nope",
+		Code:      "not_defined",
+		RequestID: "req-42",
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("problem %+v, want %+v", p, want)
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	api := newTestAPI(t)
+
+	for _, sent := range []string{"", "bad id", strings.Repeat("x", maxRequestIDLength+1)} {
+		req, _ := http.NewRequest("GET", api.server.URL+"/containers", nil)
+		req.Header.Set(requestIDHeader, sent)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		id := resp.Header.Get(requestIDHeader)
+		if len(id) != 32 {
+			t.Errorf("sent %q, got request ID %q", sent, id)
+		}
+	}
+}
+
+func TestLegacyErrorNegotiation(t *testing.T) {
+	api := newTestAPI(t)
+
+	tests := []struct {
+		accept string
+		legacy bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", true},
+		{"application/problem+json", false},
+		{"application/json, application/problem+json", false},
+		{"application/json, application/problem+json;q=0.5", true},
+		{"application/*, application/problem+json;q=0.1", true},
+		{"application/problem+json, application/json;q=0.9", false},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", api.server.URL+"/containers", nil)
+		req.Header.Set("Authorization", "Bearer invalid")
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var body map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ct := resp.Header.Get("Content-Type")
+		if tt.legacy {
+			if ct != jsonMediaType || body["status"] != "error" || body["code"] != "unauthorized" {
+				t.Errorf("Accept %q: got %s %v, want legacy error", tt.accept, ct, body)
+			}
+		} else if ct != problemMediaType || body["status"] != float64(401) {
+			t.Errorf("Accept %q: got %s %v, want problem details", tt.accept, ct, body)
+		}
+	}
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gorilla/mux"
+)
+
+// profilesFile is written in the state directory
+const profilesFile = "profiles.json"
+
+var (
+	errNoProfile        = errors.New("profile not found")
+	errProfileExists    = errors.New("profile already exists")
+	errConfigNotAllowed = errors.New("configuration not allowed")
+)
+
+// profileName is the pattern of profile names, used in URLs
+var profileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// limitKeys are the configuration keys profiles cannot set, limits being
+// accounted in quotas
+var limitKeys = []string{memoryMaxKey, cpuMaxKey, memoryLimitKey, cpuQuotaKey, cpuPeriodKey}
+
+// configKeys are the configuration keys clients may set, and the
+// prefixes ending with a dot of those. Others, such as hooks, includes or
+// security settings, would let them run commands on the host or lift the
+// confinement of containers.
+var configKeys = []string{
+	"lxc.net.",
+	"lxc.start.",
+	"lxc.signal.",
+	"lxc.group",
+	"lxc.environment",
+	"lxc.uts.name",
+	"lxc.mount.entry",
+}
+
+// deviceRule is the pattern of the cgroup rules of devices: a character
+// device by its numbers, and its access
+var deviceRule = regexp.MustCompile(`^c ([0-9]+):([0-9]+) [rwm]{1,3}$`)
+
+// listKeys are the configuration keys whose items add up, such as mounts
+var listKeys = map[string]bool{
+	"lxc.mount.entry":           true,
+	"lxc.environment":           true,
+	"lxc.cap.drop":              true,
+	"lxc.cap.keep":              true,
+	"lxc.cgroup.devices.allow":  true,
+	"lxc.cgroup.devices.deny":   true,
+	"lxc.cgroup2.devices.allow": true,
+	"lxc.cgroup2.devices.deny":  true,
+}
+
+// profiles holds the container profiles of the running server
+var profiles *profileStore
+
+// Profile model
+// swagger:model Profile
+type Profile struct {
+	// Profile name
+	// required: true
+	// pattern: ^[A-Za-z0-9][A-Za-z0-9_.-]*$
+	// example: web
+	Name string `json:"name"`
+
+	// example: Alpine web servers
+	Description string `json:"description,omitempty"`
+
+	// Default template parameters
+	TemplateOpts TemplateOptions `json:"template"`
+
+	// Configuration items, set in order after the template ran
+	Config []ConfigEntry `json:"config"`
+
+	// Resource limits
+	Limits ContainerLimits `json:"limits"`
+
+	// Host devices made available in the container
+	Devices []Device `json:"devices"`
+}
+
+// ConfigEntry model
+// swagger:model ConfigEntry
+type ConfigEntry struct {
+	// Configuration key
+	// required: true
+	// example: lxc.start.auto
+	Key string `json:"key"`
+
+	// example: 1
+	Value string `json:"value"`
+}
+
+// Device model
+// swagger:model Device
+type Device struct {
+	// Device node on the host, bind mounted at the same path in the
+	// container
+	// required: true
+	// example: /dev/net/tun
+	Path string `json:"path"`
+
+	// cgroup rule allowing its use: c, major:minor and access, matching
+	// the device node
+	// required: true
+	// example: c 10:200 rwm
+	Rule string `json:"rule"`
+}
+
+// Profiles model
+// swagger:model Profiles
+type Profiles struct {
+	// List of profiles
+	Profiles []Profile `json:"profiles"`
+}
+
+// validate checks a profile received by the API
+func (p *Profile) validate() error {
+	if !profileName.MatchString(p.Name) {
+		return fmt.Errorf("invalid profile name %q", p.Name)
+	}
+
+	for _, d := range p.Devices {
+		if !filepath.IsAbs(d.Path) || d.Rule == "" {
+			return fmt.Errorf("devices: %q needs an absolute path and a rule", d.Path)
+		}
+	}
+
+	if err := validateConfig(p.Config); err != nil {
+		return err
+	}
+	if err := validateDevices(p.Devices); err != nil {
+		return err
+	}
+
+	return p.Limits.validate()
+}
+
+// validateConfig checks configuration items received by the API. Keys
+// out of configKeys, and mounts the access policy does not allow, fail
+// with errConfigNotAllowed.
+func validateConfig(entries []ConfigEntry) error {
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Key, "lxc.") {
+			return fmt.Errorf("config: %q is not an LXC configuration key", entry.Key)
+		}
+		if containsString(limitKeys, entry.Key) {
+			return fmt.Errorf("config: %s is set through limits", entry.Key)
+		}
+
+		if !allowedKey(entry.Key) {
+			return fmt.Errorf("%w: config: %s", errConfigNotAllowed, entry.Key)
+		}
+		if entry.Key == "lxc.mount.entry" {
+			if err := validateMount(entry.Value); err != nil {
+				return fmt.Errorf("%w: config: %s: %v", errConfigNotAllowed, entry.Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// allowedKey reports whether configuration key is one of configKeys.
+// Network scripts are hooks.
+func allowedKey(key string) bool {
+	if strings.HasPrefix(key, "lxc.net.") && strings.Contains(key, ".script.") {
+		return false
+	}
+
+	for _, allowed := range configKeys {
+		if key == allowed || (strings.HasSuffix(allowed, ".") && strings.HasPrefix(key, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMount checks a mount entry: a tmpfs, or a bind mount of a host
+// directory the access policy allows, within the container
+func validateMount(entry string) error {
+	fields := strings.Fields(entry)
+	if len(fields) < 4 {
+		return fmt.Errorf("%q is not a mount entry", entry)
+	}
+	source, target, fstype, options := fields[0], fields[1], fields[2], strings.Split(fields[3], ",")
+
+	if filepath.IsAbs(target) || strings.HasPrefix(filepath.Clean(target), "..") {
+		return fmt.Errorf("target %s is not within the container", target)
+	}
+
+	if !containsString(options, "bind") && !containsString(options, "rbind") {
+		if fstype != "tmpfs" {
+			return fmt.Errorf("only tmpfs and bind mounts are allowed, not %s", fstype)
+		}
+		return nil
+	}
+
+	if filepath.IsAbs(source) {
+		source = filepath.Clean(source)
+		for _, dir := range policy.Mounts {
+			dir = filepath.Clean(dir)
+			if source == dir || strings.HasPrefix(source, strings.TrimSuffix(dir, "/")+"/") {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s is not in the mounts of the access policy", source)
+}
+
+// validateDevices checks that devices are character devices the access
+// policy allows, whose rules match their device numbers
+func validateDevices(devices []Device) error {
+	for _, d := range devices {
+		if !containsString(policy.Devices, d.Path) {
+			return fmt.Errorf("%w: devices: %s is not in the devices of the access policy", errConfigNotAllowed, d.Path)
+		}
+
+		m := deviceRule.FindStringSubmatch(d.Rule)
+		if m == nil {
+			return fmt.Errorf("%w: devices: %s: rule %q does not allow a character device by its numbers",
+				errConfigNotAllowed, d.Path, d.Rule)
+		}
+
+		major, minor, err := deviceNumbers(d.Path)
+		if err != nil {
+			return fmt.Errorf("%w: devices: %v", errConfigNotAllowed, err)
+		}
+		if m[1] != strconv.FormatUint(major, 10) || m[2] != strconv.FormatUint(minor, 10) {
+			return fmt.Errorf("%w: devices: %s: rule %q does not match device %d:%d",
+				errConfigNotAllowed, d.Path, d.Rule, major, minor)
+		}
+	}
+	return nil
+}
+
+// deviceNumbers returns the major and minor numbers of the character
+// device at path
+func deviceNumbers(path string) (uint64, uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if info.Mode()&os.ModeCharDevice == 0 || !ok {
+		return 0, 0, fmt.Errorf("%s is not a character device", path)
+	}
+
+	// Linux encoding of device numbers
+	dev := uint64(st.Rdev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	return major, minor, nil
+}
+
+// profileStore keeps container profiles in a JSON file
+type profileStore struct {
+	mu       sync.Mutex
+	path     string
+	profiles map[string]*Profile
+}
+
+func openProfileStore(path string) (*profileStore, error) {
+	s := &profileStore{
+		path:     path,
+		profiles: make(map[string]*Profile),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Profile
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, p := range list {
+		s.profiles[p.Name] = p
+	}
+
+	return s, nil
+}
+
+// save writes the store to disk, callers must hold s.mu
+func (s *profileStore) save() error {
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// list returns the profiles sorted by name, callers must hold s.mu
+func (s *profileStore) list() []Profile {
+	list := make([]Profile, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// List returns the profiles sorted by name
+func (s *profileStore) List() []Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.list()
+}
+
+// Get returns profile name
+func (s *profileStore) Get(name string) (*Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoProfile, name)
+	}
+	profile := *p
+	return &profile, nil
+}
+
+// Put stores p, replacing the profile of the same name only when replace
+// is set
+func (s *profileStore) Put(p Profile, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, exists := s.profiles[p.Name]
+	switch {
+	case exists && !replace:
+		return fmt.Errorf("%w: %s", errProfileExists, p.Name)
+	case !exists && replace:
+		return fmt.Errorf("%w: %s", errNoProfile, p.Name)
+	}
+
+	s.profiles[p.Name] = &p
+	if err := s.save(); err != nil {
+		if exists {
+			s.profiles[p.Name] = previous
+		} else {
+			delete(s.profiles, p.Name)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes profile name
+func (s *profileStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.profiles[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", errNoProfile, name)
+	}
+
+	delete(s.profiles, name)
+	if err := s.save(); err != nil {
+		s.profiles[name] = p
+		return err
+	}
+
+	return nil
+}
+
+// mergeProfiles applies the profiles of opts in order, then opts itself:
+// fields set later override those set before. It returns opts with the
+// merged template and limits, along with the merged configuration items
+// and devices.
+func mergeProfiles(opts ContainerTemplate) (ContainerTemplate, *Profile, error) {
+	merged := &Profile{}
+
+	for _, name := range opts.Profiles {
+		p, err := profiles.Get(name)
+		if err != nil {
+			return opts, nil, err
+		}
+
+		// The access policy may have changed since the profile was stored
+		if err := validateConfig(p.Config); err != nil {
+			return opts, nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		if err := validateDevices(p.Devices); err != nil {
+			return opts, nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+
+		overrideFields(&merged.TemplateOpts, p.TemplateOpts, nil)
+		overrideFields(&merged.Limits, p.Limits, nil)
+		merged.Config = mergeConfig(merged.Config, p.Config)
+		merged.Devices = mergeDevices(merged.Devices, p.Devices)
+	}
+
+	overrideFields(&merged.TemplateOpts, opts.TemplateOpts, opts.given.template)
+	overrideFields(&merged.Limits, opts.Limits, opts.given.limits)
+	opts.TemplateOpts = merged.TemplateOpts
+	opts.Limits = merged.Limits
+
+	return opts, merged, nil
+}
+
+// givenFields records the fields of the template and limits of a
+// request, by lower case JSON name
+type givenFields struct {
+	template map[string]bool
+	limits   map[string]bool
+}
+
+// UnmarshalJSON decodes opts, recording the fields of its template and
+// limits which were given
+func (opts *ContainerTemplate) UnmarshalJSON(data []byte) error {
+	type plain ContainerTemplate
+	if err := json.Unmarshal(data, (*plain)(opts)); err != nil {
+		return err
+	}
+
+	var given struct {
+		Template map[string]json.RawMessage `json:"template"`
+		Limits   map[string]json.RawMessage `json:"limits"`
+	}
+	if err := json.Unmarshal(data, &given); err != nil {
+		return err
+	}
+
+	keys := func(values map[string]json.RawMessage) map[string]bool {
+		set := make(map[string]bool, len(values))
+		for key := range values {
+			set[strings.ToLower(key)] = true
+		}
+		return set
+	}
+	opts.given = givenFields{template: keys(given.Template), limits: keys(given.Limits)}
+
+	return nil
+}
+
+// overrideFields sets the fields of the struct dst pointed to which are
+// set in src, empty lists being unset, or which given names
+func overrideFields(dst interface{}, src interface{}, given map[string]bool) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src)
+
+	for i := 0; i < s.NumField(); i++ {
+		f := s.Field(i)
+
+		name := s.Type().Field(i).Name
+		if tag := s.Type().Field(i).Tag.Get("json"); tag != "" {
+			name = strings.Split(tag, ",")[0]
+		}
+
+		unset := f.IsZero() || (f.Kind() == reflect.Slice && f.Len() == 0)
+		if unset && !given[strings.ToLower(name)] {
+			continue
+		}
+		d.Field(i).Set(f)
+	}
+}
+
+// mergeConfig returns the items of base whose keys next does not set,
+// followed by the items of next. Keys holding lists keep the items of
+// both.
+func mergeConfig(base []ConfigEntry, next []ConfigEntry) []ConfigEntry {
+	set := make(map[string]bool)
+	for _, entry := range next {
+		set[entry.Key] = !listKeys[entry.Key]
+	}
+
+	var merged []ConfigEntry
+	for _, entry := range base {
+		if !set[entry.Key] {
+			merged = append(merged, entry)
+		}
+	}
+	return append(merged, next...)
+}
+
+// mergeDevices returns the devices of base next does not have, followed
+// by the devices of next
+func mergeDevices(base []Device, next []Device) []Device {
+	var merged []Device
+	for _, d := range base {
+		replaced := false
+		for _, n := range next {
+			replaced = replaced || n.Path == d.Path
+		}
+		if !replaced {
+			merged = append(merged, d)
+		}
+	}
+	return append(merged, next...)
+}
+
+// applyProfile sets the configuration items and devices of p on container
+// name of lxcpath
+func applyProfile(lxcpath string, name string, p *Profile) error {
+	items := append([]ConfigEntry(nil), p.Config...)
+
+	allowKey := "lxc.cgroup.devices.allow"
+	if unifiedCgroups() {
+		allowKey = "lxc.cgroup2.devices.allow"
+	}
+	for _, d := range p.Devices {
+		items = append(items,
+			ConfigEntry{allowKey, d.Rule},
+			ConfigEntry{"lxc.mount.entry", d.Path + " " + strings.TrimPrefix(d.Path, "/") + " none bind,optional,create=file 0 0"})
+	}
+
+	for _, item := range items {
+		if err := driver.SetConfigItem(lxcpath, name, item.Key, item.Value); err != nil {
+			return fmt.Errorf("%s: %w", item.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// profileLocation returns the URL of profile name
+func profileLocation(name string) string {
+	return "/v1/profiles/" + url.PathEscape(name)
+}
+
+// GetProfiles returns the profiles
+func GetProfiles(w http.ResponseWriter, r *http.Request) *apiError {
+	return writeJSON(w, http.StatusOK, &Profiles{Profiles: profiles.List()})
+}
+
+// GetProfile returns a profile
+func GetProfile(w http.ResponseWriter, r *http.Request) *apiError {
+	p, err := profiles.Get(mux.Vars(r)["profile"])
+	if err != nil {
+		return driverError(err)
+	}
+
+	return writeJSON(w, http.StatusOK, p)
+}
+
+// decodeProfile reads and checks the profile of the body of r
+func decodeProfile(r *http.Request) (*Profile, *apiError) {
+	var p Profile
+
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return nil, &apiError{err, err.Error(), 400}
+	}
+
+	if name, ok := mux.Vars(r)["profile"]; ok && p.Name != name {
+		err := fmt.Errorf("profile %s cannot be renamed %s", name, p.Name)
+		return nil, &apiError{err, err.Error(), 400}
+	}
+
+	if err := p.validate(); errors.Is(err, errConfigNotAllowed) {
+		return nil, driverError(err)
+	} else if err != nil {
+		return nil, &apiError{err, err.Error(), 400}
+	}
+
+	// Lists are replied empty rather than null
+	if p.Config == nil {
+		p.Config = []ConfigEntry{}
+	}
+	if p.Devices == nil {
+		p.Devices = []Device{}
+	}
+	if p.TemplateOpts.ExtraArgs == nil {
+		p.TemplateOpts.ExtraArgs = []string{}
+	}
+
+	return &p, nil
+}
+
+// PostProfile creates a profile, replying 201 with it
+func PostProfile(w http.ResponseWriter, r *http.Request) *apiError {
+	p, e := decodeProfile(r)
+	if e != nil {
+		return e
+	}
+
+	if err := profiles.Put(*p, false); err != nil {
+		return driverError(err)
+	}
+
+	w.Header().Set("Location", profileLocation(p.Name))
+	return writeJSON(w, http.StatusCreated, p)
+}
+
+// PutProfile replaces a profile. Containers created with it keep the
+// configuration it had.
+func PutProfile(w http.ResponseWriter, r *http.Request) *apiError {
+	p, e := decodeProfile(r)
+	if e != nil {
+		return e
+	}
+
+	if err := profiles.Put(*p, true); err != nil {
+		return driverError(err)
+	}
+
+	return writeJSON(w, http.StatusOK, p)
+}
+
+// DeleteProfile deletes a profile, replying 204
+func DeleteProfile(w http.ResponseWriter, r *http.Request) *apiError {
+	if err := profiles.Delete(mux.Vars(r)["profile"]); err != nil {
+		return driverError(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	api := newTestAPI(t)
+	ops := api.token(t, "ops", []string{scopeProfiles, scopeContainersRead}, nil)
+	ci := api.token(t, "ci", []string{scopeContainersRead, scopeContainersWrite}, nil)
+
+	policy.Mounts = []string{"/srv"}
+	policy.Devices = []string{"/dev/null"}
+
+	base := Profile{
+		Name:         "base",
+		TemplateOpts: TemplateOptions{Template: "download", Distro: "alpine", Release: "3.18", Arch: "amd64"},
+		Config: []ConfigEntry{
+			{"lxc.start.auto", "1"},
+			{"lxc.mount.entry", "/srv/shared srv/shared none bind,create=dir 0 0"},
+		},
+		Limits: ContainerLimits{MemoryBytes: 1 << 30, CPUs: 1},
+	}
+	web := Profile{
+		Name:         "web",
+		TemplateOpts: TemplateOptions{Release: "3.19"},
+		Config: []ConfigEntry{
+			{"lxc.start.auto", "0"},
+			{"lxc.mount.entry", "/srv/www srv/www none bind,create=dir 0 0"},
+		},
+		Devices: []Device{{Path: "/dev/null", Rule: "c 1:3 rwm"}},
+	}
+
+	for _, p := range []Profile{base, web} {
+		resp, body := api.send(t, "POST", "/v1/profiles", ops, p)
+		expectStatus(t, resp.StatusCode, 201, body)
+		if got := resp.Header.Get("Location"); got != "/v1/profiles/"+p.Name {
+			t.Errorf("Location %q", got)
+		}
+	}
+
+	status, body := api.do(t, "POST", "/v1/profiles", ops, base)
+	expectError(t, status, 409, body, "profile_exists")
+
+	status, body = api.do(t, "POST", "/v1/profiles", ci, Profile{Name: "other"})
+	expectError(t, status, 403, body, "forbidden")
+
+	status, body = api.do(t, "POST", "/v1/profiles", ops,
+		Profile{Name: "limits", Config: []ConfigEntry{{memoryMaxKey, "1G"}}})
+	expectError(t, status, 400, body, "bad_request")
+
+	var list Profiles
+	status, body = api.do(t, "GET", "/v1/profiles", ci, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &list)
+	if len(list.Profiles) != 2 || list.Profiles[0].Name != "base" || list.Profiles[1].Name != "web" {
+		t.Errorf("unexpected profiles %s", body)
+	}
+
+	// Request fields override the profiles, applied in order
+	opts := ContainerTemplate{
+		Name:         "c1",
+		TemplateOpts: TemplateOptions{Arch: "arm64"},
+		Limits:       ContainerLimits{CPUs: 2},
+		Profiles:     []string{"base", "web"},
+	}
+	status, body = api.do(t, "POST", "/v1/containers", ci,
+		`{"name": "c1", "template": {"Arch": "arm64"}, "limits": {"cpus": 2}, "profiles": ["base", "web"]}`)
+	expectStatus(t, status, 201, body)
+
+	var c Container
+	decode(t, body, &c)
+	if !reflect.DeepEqual(c.Profiles, []string{"base", "web"}) {
+		t.Errorf("container profiles %v", c.Profiles)
+	}
+
+	merged, _, err := mergeProfiles(opts)
+	if want := (TemplateOptions{Template: "download", Distro: "alpine", Release: "3.19", Arch: "arm64"}); err != nil ||
+		!reflect.DeepEqual(merged.TemplateOpts, want) {
+		t.Errorf("template %+v, %v, want %+v", merged.TemplateOpts, err, want)
+	}
+
+	items := map[string][]string{
+		"lxc.start.auto": {"0"},
+		"lxc.mount.entry": {
+			"/srv/shared srv/shared none bind,create=dir 0 0",
+			"/srv/www srv/www none bind,create=dir 0 0",
+			"/dev/null dev/null none bind,optional,create=file 0 0",
+		},
+	}
+	for key, want := range items {
+		if got, _ := driver.ConfigItem(config.LXCPath, "c1", key); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %q, want %q", key, got, want)
+		}
+	}
+
+	var limits ContainerLimits
+	status, body = api.do(t, "GET", "/v1/containers/c1/limits", ci, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &limits)
+	if limits != (ContainerLimits{MemoryBytes: 1 << 30, CPUs: 2}) {
+		t.Errorf("limits %+v", limits)
+	}
+
+	status, body = api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: "c2", Profiles: []string{"missing"}})
+	expectError(t, status, 400, body, "no_profile")
+
+	web.Description = "Web servers"
+	status, body = api.do(t, "PUT", "/v1/profiles/web", ops, web)
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "PUT", "/v1/profiles/base", ops, web)
+	expectError(t, status, 400, body, "bad_request")
+
+	var p Profile
+	status, body = api.do(t, "GET", "/v1/profiles/web", ci, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &p)
+	if p.Name != "web" || p.Description != "Web servers" {
+		t.Errorf("unexpected profile %s", body)
+	}
+
+	status, body = api.do(t, "PUT", "/v1/profiles/missing", ops, Profile{Name: "missing"})
+	expectError(t, status, 404, body, "no_profile")
+
+	status, body = api.do(t, "DELETE", "/v1/profiles/web", ops, nil)
+	expectStatus(t, status, 204, body)
+
+	status, body = api.do(t, "GET", "/v1/profiles/web", ci, nil)
+	expectError(t, status, 404, body, "no_profile")
+
+	// Profiles are kept across restarts
+	store, err := openProfileStore(filepath.Join(config.StateDir, profilesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := store.List(); len(got) != 1 || got[0].Name != "base" {
+		t.Errorf("stored profiles %+v", got)
+	}
+}
+
+func TestProfileOverrides(t *testing.T) {
+	api := newTestAPI(t)
+
+	cached := Profile{
+		Name:         "cached",
+		TemplateOpts: TemplateOptions{Template: "download", FlushCache: true, DisableGPGValidation: true},
+		Limits:       ContainerLimits{MemoryBytes: 1 << 30, CPUs: 1},
+	}
+	status, body := api.do(t, "POST", "/v1/profiles", api.admin, cached)
+	expectStatus(t, status, 201, body)
+
+	// Fields given in the request override the profiles even when false or
+	// 0, the others are left to them
+	m := `{"name": "c1", "template": {"FlushCache": false}, "limits": {"memory_bytes": 0}, "profiles": ["cached"]}`
+	var opts ContainerTemplate
+	if err := json.Unmarshal([]byte(m), &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, _, err := mergeProfiles(opts)
+	if want := (TemplateOptions{Template: "download", DisableGPGValidation: true}); err != nil ||
+		!reflect.DeepEqual(merged.TemplateOpts, want) {
+		t.Errorf("template %+v, %v, want %+v", merged.TemplateOpts, err, want)
+	}
+
+	status, body = api.do(t, "POST", "/v1/containers", api.admin, m)
+	expectStatus(t, status, 201, body)
+
+	var limits ContainerLimits
+	status, body = api.do(t, "GET", "/v1/containers/c1/limits", api.admin, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &limits)
+	if limits != (ContainerLimits{CPUs: 1}) {
+		t.Errorf("limits %+v", limits)
+	}
+}
+
+func TestProfilesNotAllowed(t *testing.T) {
+	api := newTestAPI(t)
+	ops := api.token(t, "ops", []string{scopeProfiles}, nil)
+
+	policy.Mounts = []string{"/srv/www"}
+	policy.Devices = []string{"/dev/null"}
+
+	tests := []struct {
+		name    string
+		config  []ConfigEntry
+		devices []Device
+	}{
+		{"hook", []ConfigEntry{{"lxc.hook.start", "/tmp/run"}}, nil},
+		{"include", []ConfigEntry{{"lxc.include", "/tmp/lxc.conf"}}, nil},
+		{"apparmor", []ConfigEntry{{"lxc.apparmor.profile", "unconfined"}}, nil},
+		{"net script", []ConfigEntry{{"lxc.net.0.script.up", "/tmp/run"}}, nil},
+		{"host mount", []ConfigEntry{{"lxc.mount.entry", "/etc etc none bind 0 0"}}, nil},
+		{"mount escaping", []ConfigEntry{{"lxc.mount.entry", "/srv/www/../../etc etc none bind 0 0"}}, nil},
+		{"mount target", []ConfigEntry{{"lxc.mount.entry", "/srv/www /etc none bind 0 0"}}, nil},
+		{"proc mount", []ConfigEntry{{"lxc.mount.entry", "proc proc proc rw 0 0"}}, nil},
+		{"device path", nil, []Device{{Path: "/dev/sda", Rule: "b 8:* rwm"}}},
+		{"device rule", nil, []Device{{Path: "/dev/null", Rule: "b 8:* rwm"}}},
+		{"device numbers", nil, []Device{{Path: "/dev/null", Rule: "c 10:200 rwm"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := Profile{Name: "p", Config: test.config, Devices: test.devices}
+			status, body := api.do(t, "POST", "/v1/profiles", ops, p)
+			expectError(t, status, 422, body, "config_not_allowed")
+		})
+	}
+
+	p := Profile{
+		Name: "allowed",
+		Config: []ConfigEntry{
+			{"lxc.net.0.link", "lxcbr0"},
+			{"lxc.mount.entry", "/srv/www/site srv/site none bind,create=dir 0 0"},
+			{"lxc.mount.entry", "tmpfs tmp tmpfs defaults 0 0"},
+		},
+		Devices: []Device{{Path: "/dev/null", Rule: "c 1:3 rw"}},
+	}
+	status, body := api.do(t, "POST", "/v1/profiles", ops, p)
+	expectStatus(t, status, 201, body)
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Container configuration keys holding the cgroup limits of containers,
+// under the unified hierarchy and under cgroup v1
+const (
+	memoryMaxKey   = "lxc.cgroup2.memory.max"
+	cpuMaxKey      = "lxc.cgroup2.cpu.max"
+	memoryLimitKey = "lxc.cgroup.memory.limit_in_bytes"
+	cpuQuotaKey    = "lxc.cgroup.cpu.cfs_quota_us"
+	cpuPeriodKey   = "lxc.cgroup.cpu.cfs_period_us"
+)
+
+// cpuPeriod is the cgroup period CPU allowances are set over, in
+// microseconds
+const cpuPeriod = 100000
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// quotaError is the error of operations which would take a tenant over
+// its quota
+type quotaError struct {
+	tenant   string
+	resource string
+	detail   string
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("%v: tenant %s, %s: %s", errQuotaExceeded, e.tenant, e.resource, e.detail)
+}
+
+func (e *quotaError) Is(target error) bool {
+	return target == errQuotaExceeded
+}
+
+// Quota caps the resources of the containers of a tenant, a group of the
+// access policy. Usage is reported with the same fields.
+type Quota struct {
+	// Number of containers, unlimited when 0
+	Containers int `yaml:"containers"`
+
+	// Total memory limit, unlimited when 0
+	MemoryBytes int64 `yaml:"memory_bytes"`
+
+	// Total CPU allowance, unlimited when 0
+	CPUs float64 `yaml:"cpus"`
+
+	// Total disk allowance, unlimited when 0
+	DiskBytes int64 `yaml:"disk_bytes"`
+}
+
+// add counts a container having limits in q
+func (q *Quota) add(limits ContainerLimits) {
+	q.Containers++
+	q.MemoryBytes += limits.MemoryBytes
+	q.CPUs += limits.CPUs
+	q.DiskBytes += limits.DiskBytes
+}
+
+// remove stops counting a container having limits in q
+func (q *Quota) remove(limits ContainerLimits) {
+	q.Containers--
+	q.MemoryBytes -= limits.MemoryBytes
+	q.CPUs -= limits.CPUs
+	q.DiskBytes -= limits.DiskBytes
+}
+
+// check returns the error of adding a container having limits to used,
+// when that would exceed q of tenant. Containers must have the limits q
+// caps, for their usage to be accounted.
+func (q Quota) check(tenant string, used Quota, limits ContainerLimits) error {
+	if q.Containers > 0 && used.Containers+1 > q.Containers {
+		return &quotaError{tenant, "containers", fmt.Sprintf("%d of %d used", used.Containers, q.Containers)}
+	}
+
+	resources := []struct {
+		name                 string
+		quota, used, request float64
+	}{
+		{"memory_bytes", float64(q.MemoryBytes), float64(used.MemoryBytes), float64(limits.MemoryBytes)},
+		{"cpus", q.CPUs, used.CPUs, limits.CPUs},
+		{"disk_bytes", float64(q.DiskBytes), float64(used.DiskBytes), float64(limits.DiskBytes)},
+	}
+
+	for _, r := range resources {
+		switch {
+		case r.quota <= 0:
+		case r.request <= 0:
+			return &quotaError{tenant, r.name, "containers must have a limit"}
+		case r.used+r.request > r.quota:
+			detail := fmt.Sprintf("%s requested, %s of %s used",
+				formatAmount(r.request), formatAmount(r.used), formatAmount(r.quota))
+			if r.name == "disk_bytes" {
+				// Root filesystems are not measured
+				detail += " by the declared disk allowances"
+			}
+			return &quotaError{tenant, r.name, detail}
+		}
+	}
+
+	return nil
+}
+
+func formatAmount(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// ContainerLimits model
+// swagger:model ContainerLimits
+type ContainerLimits struct {
+	// Memory limit in bytes, unlimited when 0
+	// minimum: 0
+	// example: 1073741824
+	MemoryBytes int64 `json:"memory_bytes"`
+
+	// CPU allowance, in CPUs, unlimited when 0
+	// minimum: 0
+	// example: 1.5
+	CPUs float64 `json:"cpus"`
+
+	// Disk allowance in bytes, accounted in quotas as declared, unlimited
+	// when 0
+	// minimum: 0
+	// example: 10737418240
+	DiskBytes int64 `json:"disk_bytes"`
+}
+
+func (l ContainerLimits) validate() error {
+	if l.MemoryBytes < 0 || l.CPUs < 0 || l.DiskBytes < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// QuotaUsage model
+// swagger:model QuotaUsage
+type QuotaUsage struct {
+	// Tenant, a group of the access policy
+	// example: team-a
+	Tenant string `json:"tenant"`
+
+	// Containers of the tenant
+	Containers QuotaItem `json:"containers"`
+
+	// Memory limits of the containers, in bytes
+	MemoryBytes QuotaItem `json:"memory_bytes"`
+
+	// CPU allowances of the containers, in CPUs
+	CPUs QuotaItem `json:"cpus"`
+
+	// Disk allowances declared by the containers, in bytes
+	DiskBytes QuotaItem `json:"disk_bytes"`
+}
+
+// QuotaItem model
+// swagger:model QuotaItem
+type QuotaItem struct {
+	// Amount used by the containers of the tenant
+	// example: 3
+	Used float64 `json:"used"`
+
+	// Quota, unlimited when 0
+	// example: 10
+	Limit float64 `json:"limit"`
+}
+
+// containerLimits returns the limits of container name of lxcpath, read
+// from its cgroup configuration and, for disk, its metadata
+func containerLimits(lxcpath string, name string) (ContainerLimits, error) {
+	var limits ContainerLimits
+
+	item := func(key string) (string, error) {
+		values, err := driver.ConfigItem(lxcpath, name, key)
+		if err != nil || len(values) == 0 {
+			return "", err
+		}
+		return strings.TrimSpace(values[len(values)-1]), nil
+	}
+
+	memory, err := item(memoryMaxKey)
+	if err == nil && memory == "" {
+		memory, err = item(memoryLimitKey)
+	}
+	if err != nil {
+		return limits, err
+	}
+	if n, err := strconv.ParseInt(memory, 10, 64); err == nil && n > 0 {
+		limits.MemoryBytes = n
+	}
+
+	quota, period := "", ""
+	cpu, err := item(cpuMaxKey)
+	if err == nil && cpu != "" {
+		fields := strings.Fields(cpu)
+		quota, period = fields[0], strconv.Itoa(cpuPeriod)
+		if len(fields) > 1 {
+			period = fields[1]
+		}
+	} else if err == nil {
+		if quota, err = item(cpuQuotaKey); err == nil {
+			period, err = item(cpuPeriodKey)
+		}
+	}
+	if err != nil {
+		return limits, err
+	}
+	q, qErr := strconv.ParseFloat(quota, 64)
+	p, pErr := strconv.ParseFloat(period, 64)
+	if qErr == nil && pErr == nil && q > 0 && p > 0 {
+		limits.CPUs = q / p
+	}
+
+	md, err := readMetadata(lxcpath, name)
+	if err != nil {
+		return limits, err
+	}
+	limits.DiskBytes = md.DiskBytes
+
+	return limits, nil
+}
+
+// setContainerLimits writes limits in the cgroup configuration of
+// container name of lxcpath, for the hierarchy of the host, and its disk
+// allowance in its metadata
+func setContainerLimits(lxcpath string, name string, limits ContainerLimits) error {
+	memory, quota, period := "", "", ""
+	if limits.MemoryBytes > 0 {
+		memory = strconv.FormatInt(limits.MemoryBytes, 10)
+	}
+	if limits.CPUs > 0 {
+		quota = strconv.FormatInt(int64(math.Ceil(limits.CPUs*cpuPeriod)), 10)
+		period = strconv.Itoa(cpuPeriod)
+	}
+
+	items := [][2]string{{memoryLimitKey, memory}, {cpuQuotaKey, quota}, {cpuPeriodKey, period}}
+	if unifiedCgroups() {
+		items = [][2]string{{memoryMaxKey, memory}, {cpuMaxKey, strings.TrimSpace(quota + " " + period)}}
+	}
+
+	// cgroup keys add up values, the previous ones are cleared first
+	for _, item := range items {
+		if err := driver.SetConfigItem(lxcpath, name, item[0], ""); err != nil {
+			return err
+		}
+		if item[1] == "" {
+			continue
+		}
+		if err := driver.SetConfigItem(lxcpath, name, item[0], item[1]); err != nil {
+			return err
+		}
+	}
+
+	md, err := readMetadata(lxcpath, name)
+	if err != nil {
+		return err
+	}
+	md.DiskBytes = limits.DiskBytes
+
+	return writeMetadata(lxcpath, name, md)
+}
+
+// unifiedCgroups reports whether the host only mounts the cgroup v2
+// hierarchy, which limits are then set for
+func unifiedCgroups() bool {
+	types, err := cgroupFilesystems(mountinfoFile)
+	return err == nil && cgroupVersion(types) == "2"
+}
+
+// quotas holds the resources of containers being created, until they
+// are accounted from their configuration
+var quotas = newQuotaTracker()
+
+// quotaTracker checks operations against the quotas of config, counting
+// the containers being created in each storage root. The limits of the
+// containers of tenants, and the usage of tenants, are read from the
+// storage roots once, then kept up to date by the operations.
+type quotaTracker struct {
+	mu        sync.Mutex
+	pending   map[lockKey]ContainerLimits
+	accounted map[lockKey]ContainerLimits
+	used      map[string]Quota
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{pending: make(map[lockKey]ContainerLimits)}
+}
+
+// tenants returns the tenants having a quota whose policy patterns match
+// container name
+func tenants(name string) []string {
+	var matched []string
+	for tenant := range config.Quotas {
+		for _, pattern := range policy.Groups[tenant] {
+			if ok, _ := path.Match(pattern, name); ok {
+				matched = append(matched, tenant)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// checkTenants fails unless container name, created by principal p,
+// belongs to one of the tenants having a quota p is in, if any. Their
+// containers would otherwise escape quotas, only accounted by name.
+func checkTenants(p *Principal, name string) *apiError {
+	if p.HasScope(scopeAdmin) {
+		return nil
+	}
+
+	var own []string
+	for _, group := range p.Groups {
+		if _, ok := config.Quotas[group]; ok {
+			own = append(own, group)
+		}
+	}
+	if len(own) == 0 {
+		return nil
+	}
+
+	for _, tenant := range tenants(name) {
+		if containsString(own, tenant) {
+			return nil
+		}
+	}
+
+	err := fmt.Errorf("container %s belongs to none of the tenants %s", name, strings.Join(own, ", "))
+	return &apiError{err, err.Error(), http.StatusForbidden}
+}
+
+// load accounts the containers of tenants of every storage root, unless
+// done already, q.mu being held
+func (q *quotaTracker) load() error {
+	if q.accounted != nil {
+		return nil
+	}
+
+	accounted := make(map[lockKey]ContainerLimits)
+	for _, root := range config.Roots {
+		names, err := driver.List(root)
+		if err != nil {
+			return err
+		}
+
+		for _, n := range names {
+			if len(tenants(n)) == 0 {
+				continue
+			}
+
+			limits, err := containerLimits(root, n)
+			if errors.Is(err, errNotDefined) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			accounted[lockKey{root, n}] = limits
+		}
+	}
+
+	q.accounted = accounted
+	q.used = make(map[string]Quota)
+	for key, limits := range accounted {
+		for _, tenant := range tenants(key.name) {
+			used := q.used[tenant]
+			used.add(limits)
+			q.used[tenant] = used
+		}
+	}
+
+	return nil
+}
+
+// account records the limits of container key, or that it is gone when
+// limits is nil, in the usage of its tenants, q.mu being held
+func (q *quotaTracker) account(key lockKey, limits *ContainerLimits) {
+	if q.accounted == nil {
+		return
+	}
+
+	old, ok := q.accounted[key]
+	for _, tenant := range tenants(key.name) {
+		used := q.used[tenant]
+		if ok {
+			used.remove(old)
+		}
+		if limits != nil {
+			used.add(*limits)
+		}
+		q.used[tenant] = used
+	}
+
+	delete(q.accounted, key)
+	if limits != nil {
+		q.accounted[key] = *limits
+	}
+}
+
+// usage returns what the containers of tenant use, leaving out container
+// name of lxcpath, q.mu being held and the usage loaded
+func (q *quotaTracker) usage(tenant string, lxcpath string, name string) Quota {
+	used := q.used[tenant]
+	skip := lockKey{lxcpath, name}
+
+	// Containers whose limits change count with their new ones
+	if limits, ok := q.accounted[skip]; ok && containsString(tenants(name), tenant) {
+		used.remove(limits)
+	}
+	for key, limits := range q.pending {
+		if key == skip || !containsString(tenants(key.name), tenant) {
+			continue
+		}
+		if old, ok := q.accounted[key]; ok {
+			used.remove(old)
+		}
+		used.add(limits)
+	}
+
+	return used
+}
+
+// reserve checks that container name of lxcpath, having limits, fits in
+// the quotas of its tenants, along with the other containers. Its limits
+// count until the returned function is called, once it is created or
+// its limits are changed, which accounts the container as it then is.
+func (q *quotaTracker) reserve(lxcpath string, name string, limits ContainerLimits) (func(), *apiError) {
+	if err := limits.validate(); err != nil {
+		return nil, &apiError{err, err.Error(), 400}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	owners := tenants(name)
+	if len(owners) > 0 {
+		if err := q.load(); err != nil {
+			return nil, driverError(err)
+		}
+	}
+
+	for _, tenant := range owners {
+		if err := config.Quotas[tenant].check(tenant, q.usage(tenant, lxcpath, name), limits); err != nil {
+			return nil, driverError(err)
+		}
+	}
+
+	key := lockKey{lxcpath, name}
+	q.pending[key] = limits
+
+	return func() {
+		var current ContainerLimits
+		var err error
+		if len(owners) > 0 {
+			// The container is still locked by the operation
+			current, err = containerLimits(lxcpath, name)
+		}
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		delete(q.pending, key)
+		switch {
+		case len(owners) == 0:
+		case errors.Is(err, errNotDefined):
+			q.account(key, nil)
+		case err != nil:
+			// Read the storage roots again rather than miscount
+			q.accounted, q.used = nil, nil
+		default:
+			q.account(key, &current)
+		}
+	}, nil
+}
+
+// forget stops accounting container name of lxcpath, once destroyed
+func (q *quotaTracker) forget(lxcpath string, name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.account(lockKey{lxcpath, name}, nil)
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GetContainerLimits returns the resource limits of a container
+func GetContainerLimits(w http.ResponseWriter, r *http.Request) *apiError {
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	limits, err := containerLimits(lxcpath, name)
+	if err != nil {
+		return driverError(err)
+	}
+
+	return writeJSON(w, http.StatusOK, limits)
+}
+
+// PutContainerLimits replaces the resource limits of a container, within
+// the quotas of its tenants
+func PutContainerLimits(w http.ResponseWriter, r *http.Request) *apiError {
+	var limits ContainerLimits
+
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	if e := changeLimits(r, lxcpath, name, limits); e != nil {
+		return e
+	}
+
+	return writeJSON(w, http.StatusOK, limits)
+}
+
+// changeLimits replaces the limits of container name of lxcpath, within
+// the quotas of its tenants
+func changeLimits(r *http.Request, lxcpath string, name string, limits ContainerLimits) *apiError {
+	unlock, e := locks.lock(r.Context(), "limits", lxcpath, name)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	if _, err := driver.State(lxcpath, name); err != nil {
+		return driverError(err)
+	}
+
+	release, e := quotas.reserve(lxcpath, name, limits)
+	if e != nil {
+		return e
+	}
+	defer release()
+
+	if err := setContainerLimits(lxcpath, name, limits); err != nil {
+		return driverError(err)
+	}
+
+	return nil
+}
+
+// GetQuota returns the quota of a tenant, with what its containers use.
+// Principals only see the quotas of their groups.
+func GetQuota(w http.ResponseWriter, r *http.Request) *apiError {
+	tenant := mux.Vars(r)["tenant"]
+	p := principalFromContext(r.Context())
+
+	quota, ok := config.Quotas[tenant]
+	if !ok || !p.InGroup(tenant) {
+		err := fmt.Errorf("no quota for tenant %s", tenant)
+		return &apiError{err, err.Error(), 404}
+	}
+
+	quotas.mu.Lock()
+	err := quotas.load()
+	used := quotas.usage(tenant, "", "")
+	quotas.mu.Unlock()
+
+	if err != nil {
+		return driverError(err)
+	}
+
+	return writeJSON(w, http.StatusOK, &QuotaUsage{
+		Tenant:      tenant,
+		Containers:  QuotaItem{float64(used.Containers), float64(quota.Containers)},
+		MemoryBytes: QuotaItem{float64(used.MemoryBytes), float64(quota.MemoryBytes)},
+		CPUs:        QuotaItem{used.CPUs, quota.CPUs},
+		DiskBytes:   QuotaItem{float64(used.DiskBytes), float64(quota.DiskBytes)}})
+}
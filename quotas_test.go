@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+	api := newTestAPI(t)
+	ci := api.token(t, "ci", []string{scopeContainersRead, scopeContainersWrite}, []string{"team-a"})
+	other := api.token(t, "other", []string{scopeContainersRead}, nil)
+
+	config.Quotas = map[string]Quota{
+		"team-a": {Containers: 2, MemoryBytes: 2 << 30, CPUs: 2},
+	}
+
+	half := ContainerLimits{MemoryBytes: 1 << 30, CPUs: 1}
+
+	status, body := api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: "a-1", Limits: half})
+	expectStatus(t, status, 201, body)
+
+	// Containers must have the limits the quota caps
+	status, body = api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: "a-2"})
+	expectError(t, status, 403, body, "quota_exceeded")
+	if !strings.Contains(string(body), "memory_bytes: containers must have a limit") {
+		t.Errorf("unexpected error %s", body)
+	}
+
+	status, body = api.do(t, "POST", "/v1/containers", ci,
+		ContainerTemplate{Name: "a-2", Limits: ContainerLimits{MemoryBytes: 2 << 30, CPUs: 1}})
+	expectError(t, status, 403, body, "quota_exceeded")
+	if !strings.Contains(string(body), "memory_bytes: 2147483648 requested, 1073741824 of 2147483648 used") {
+		t.Errorf("unexpected error %s", body)
+	}
+
+	status, body = api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: "a-2", Limits: half})
+	expectStatus(t, status, 201, body)
+
+	status, body = api.do(t, "POST", "/v1/containers/a-1/clone", ci, CloneOptions{Name: "a-3"})
+	expectError(t, status, 403, body, "quota_exceeded")
+	if !strings.Contains(string(body), "containers: 2 of 2 used") {
+		t.Errorf("unexpected error %s", body)
+	}
+
+	// Members of a tenant cannot escape its quota with names out of it
+	status, body = api.do(t, "POST", "/v1/containers/a-1/clone", ci, CloneOptions{Name: "b-1"})
+	expectError(t, status, 403, body, "forbidden")
+
+	status, body = api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: "b-2", Limits: half})
+	expectError(t, status, 403, body, "forbidden")
+
+	// Containers out of the tenant are not capped
+	status, body = api.do(t, "POST", "/v1/containers/a-1/clone", api.admin, CloneOptions{Name: "b-1"})
+	expectStatus(t, status, 201, body)
+
+	var limits ContainerLimits
+	status, body = api.do(t, "GET", "/v1/containers/b-1/limits", api.admin, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &limits)
+	if limits != half {
+		t.Errorf("clone limits %+v, want %+v", limits, half)
+	}
+
+	status, body = api.do(t, "PUT", "/v1/containers/a-1/limits", ci, ContainerLimits{MemoryBytes: 1 << 30, CPUs: 1.5})
+	expectError(t, status, 403, body, "quota_exceeded")
+
+	status, body = api.do(t, "PUT", "/v1/containers/a-1/limits", ci, ContainerLimits{MemoryBytes: 512 << 20, CPUs: 0.5, DiskBytes: 1 << 30})
+	expectStatus(t, status, 200, body)
+
+	values, _ := driver.ConfigItem(config.LXCPath, "a-1", memoryLimitKey)
+	if unifiedCgroups() {
+		values, _ = driver.ConfigItem(config.LXCPath, "a-1", memoryMaxKey)
+	}
+	if len(values) != 1 || values[0] != "536870912" {
+		t.Errorf("memory limit values %q", values)
+	}
+
+	status, body = api.do(t, "PUT", "/v1/containers/a-1/limits", ci, ContainerLimits{CPUs: -1})
+	expectError(t, status, 422, body, "validation_failed")
+
+	var usage QuotaUsage
+	status, body = api.do(t, "GET", "/v1/quotas/team-a", ci, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &usage)
+
+	want := QuotaUsage{
+		Tenant:      "team-a",
+		Containers:  QuotaItem{Used: 2, Limit: 2},
+		MemoryBytes: QuotaItem{Used: 1536 << 20, Limit: 2 << 30},
+		CPUs:        QuotaItem{Used: 1.5, Limit: 2},
+		DiskBytes:   QuotaItem{Used: 1 << 30},
+	}
+	if usage != want {
+		t.Errorf("usage %+v, want %+v", usage, want)
+	}
+
+	// Destroyed containers stop counting
+	status, body = api.do(t, "DELETE", "/v1/containers/a-2", ci, nil)
+	expectStatus(t, status, 204, body)
+
+	usage = QuotaUsage{}
+	status, body = api.do(t, "GET", "/v1/quotas/team-a", ci, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &usage)
+	want.Containers.Used, want.MemoryBytes.Used, want.CPUs.Used = 1, 512<<20, 0.5
+	if usage != want {
+		t.Errorf("usage %+v, want %+v", usage, want)
+	}
+
+	// Disk quotas cap declared allowances
+	config.Quotas["team-a"] = Quota{DiskBytes: 2 << 30}
+	status, body = api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: "a-2", Limits: ContainerLimits{DiskBytes: 2 << 30}})
+	expectError(t, status, 403, body, "quota_exceeded")
+	if !strings.Contains(string(body), "of 2147483648 used by the declared disk allowances") {
+		t.Errorf("unexpected error %s", body)
+	}
+
+	// Principals out of the tenant do not see its quota
+	status, body = api.do(t, "GET", "/v1/quotas/team-a", other, nil)
+	expectError(t, status, 404, body, "not_found")
+
+	status, body = api.do(t, "GET", "/v1/quotas/team-b", api.admin, nil)
+	expectError(t, status, 404, body, "not_found")
+}
+
+func TestContainerLimitsKeys(t *testing.T) {
+	newTestAPI(t)
+
+	if err := driver.Create(config.LXCPath, "c1", TemplateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Limits set outside of the API, under either hierarchy, are read
+	items := map[string]string{
+		memoryLimitKey: "268435456",
+		cpuQuotaKey:    "50000",
+		cpuPeriodKey:   "100000",
+	}
+	for key, value := range items {
+		if err := driver.SetConfigItem(config.LXCPath, "c1", key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	limits, err := containerLimits(config.LXCPath, "c1")
+	if want := (ContainerLimits{MemoryBytes: 256 << 20, CPUs: 0.5}); err != nil || limits != want {
+		t.Errorf("cgroup v1 limits %+v, %v, want %+v", limits, err, want)
+	}
+
+	driver.SetConfigItem(config.LXCPath, "c1", memoryMaxKey, "max")
+	driver.SetConfigItem(config.LXCPath, "c1", cpuMaxKey, "200000 100000")
+
+	limits, err = containerLimits(config.LXCPath, "c1")
+	if want := (ContainerLimits{CPUs: 2}); err != nil || limits != want {
+		t.Errorf("cgroup v2 limits %+v, %v, want %+v", limits, err, want)
+	}
+}
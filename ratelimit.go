@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Classes of routes, rate limited separately
+const (
+	classRead   = "read"
+	classMutate = "mutate"
+	classExec   = "exec"
+)
+
+// Operations capped in number running at once for each principal
+const (
+	concurrentCreates = "create"
+	concurrentExecs   = "exec"
+)
+
+// concurrencyRetryAfter is the delay clients are told to retry operations
+// over their concurrency cap after
+const concurrencyRetryAfter = time.Second
+
+// concurrentRoutes gives the capped operation of routes, by method and
+// template
+var concurrentRoutes = map[string]string{
+	"POST /v1/containers":                                     concurrentCreates,
+	"POST /create":                                            concurrentCreates,
+	"POST /v1/containers/{name}/clone":                        concurrentCreates,
+	"POST /clone/{container}":                                 concurrentCreates,
+	"POST /v1/containers/{name}/exec":                         concurrentExecs,
+	"POST /v1/apply":                                          concurrentCreates,
+	"POST /v1/containers:batch":                               concurrentCreates,
+	"POST /v1/containers/{name}/snapshots/{snapshot}/restore": concurrentCreates,
+}
+
+var (
+	errRateLimited        = errors.New("rate limit exceeded")
+	errConcurrencyLimited = errors.New("too many operations in progress")
+)
+
+// limitError is the error of requests over a limit of their principal
+type limitError struct {
+	err   error
+	what  string
+	after time.Duration
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%v: %s", e.err, e.what)
+}
+
+func (e *limitError) Is(target error) bool {
+	return target == e.err
+}
+
+// RetryAfter returns the delay to retry the request after
+func (e *limitError) RetryAfter() time.Duration {
+	return e.after
+}
+
+// limiter applies rate limits and concurrency caps to principals
+var limiter *rateLimiter
+
+// rateLimiter keeps a token bucket per principal and route class, and
+// counts the capped operations each principal runs. Its limits may change
+// while it is used.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limits  LimitsConfig
+	buckets map[string]*tokenBucket
+	running map[string]int
+}
+
+// tokenBucket holds the requests a principal may still send at once,
+// refilled at the rate of its class
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limits LimitsConfig) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		buckets: make(map[string]*tokenBucket),
+		running: make(map[string]int),
+	}
+}
+
+// SetLimits replaces the limits. Buckets keep their tokens, up to the new
+// bursts.
+func (l *rateLimiter) SetLimits(limits LimitsConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limits = limits
+}
+
+// rate returns the limit of class, l.mu being held
+func (l *rateLimiter) rate(class string) RateLimit {
+	switch class {
+	case classExec:
+		return l.limits.Exec
+	case classMutate:
+		return l.limits.Mutate
+	}
+	return l.limits.Read
+}
+
+// take spends a token of the bucket of principal for class, and returns
+// how long to wait for one when there is none left
+func (l *rateLimiter) take(principal string, class string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.rate(class)
+	if limit.Rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	key := principal + "\x00" + class
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// start counts an op of principal, and returns the function to call once
+// it is over, or false when the principal already runs as many as its cap
+func (l *rateLimiter) start(principal string, op string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.limits.ConcurrentCreates
+	if op == concurrentExecs {
+		limit = l.limits.ConcurrentExecs
+	}
+
+	key := principal + "\x00" + op
+	if limit > 0 && l.running[key] >= limit {
+		return nil, false
+	}
+	l.running[key]++
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if l.running[key]--; l.running[key] == 0 {
+			delete(l.running, key)
+		}
+	}, true
+}
+
+// concurrencySlot is the count of a capped request, released once it is
+// served unless an operation outliving it took the slot over
+type concurrencySlot struct {
+	mu      sync.Mutex
+	release func()
+	kept    bool
+}
+
+type concurrencySlotKey struct{}
+
+// keepConcurrencySlot takes over the slot of the capped request of ctx,
+// and returns the function releasing it, for operations running once the
+// request is replied to
+func keepConcurrencySlot(ctx context.Context) func() {
+	slot, ok := ctx.Value(concurrencySlotKey{}).(*concurrencySlot)
+	if !ok {
+		return func() {}
+	}
+
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	slot.kept = true
+	return slot.release
+}
+
+// done releases slot, unless an operation took it over
+func (slot *concurrencySlot) done() {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	if !slot.kept {
+		slot.release()
+	}
+}
+
+// routeClass returns the class of the route having method and template
+func routeClass(method string, template string) string {
+	switch {
+	case concurrentRoutes[method+" "+template] == concurrentExecs:
+		return classExec
+	case method == http.MethodGet || method == http.MethodHead:
+		return classRead
+	}
+	return classMutate
+}
+
+// withLimits rejects the requests of principals over the rate of the
+// route class, or running as many creations or exec sessions as their
+// cap. Anonymous requests are left to requireScope.
+func (l *rateLimiter) withLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := principalFromContext(r.Context())
+		current := mux.CurrentRoute(r)
+		if p == nil || current == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		template, _ := current.GetPathTemplate()
+		class := routeClass(r.Method, template)
+
+		if wait := l.take(p.ID, class); wait > 0 {
+			writeError(w, r, driverError(&limitError{errRateLimited, class + " requests", wait}))
+			return
+		}
+
+		if op := concurrentRoutes[r.Method+" "+template]; op != "" {
+			done, ok := l.start(p.ID, op)
+			if !ok {
+				writeError(w, r, driverError(&limitError{errConcurrencyLimited, op + " operations", concurrencyRetryAfter}))
+				return
+			}
+
+			slot := &concurrencySlot{release: done}
+			defer slot.done()
+			r = r.WithContext(context.WithValue(r.Context(), concurrencySlotKey{}, slot))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reloadLimitsOnSIGHUP reads the configuration from args again each time
+// the process receives SIGHUP, and applies its limits
+func (l *rateLimiter) reloadLimitsOnSIGHUP(args []string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			c, _, err := loadConfig(args)
+			if err != nil {
+				logger.Error("limits not reloaded", "error", err)
+				continue
+			}
+
+			l.SetLimits(c.Limits)
+			logger.Info("limits reloaded")
+		}
+	}()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	api := newTestAPI(t)
+	ci := api.token(t, "ci", []string{scopeContainersRead, scopeContainersWrite}, nil)
+
+	limiter.SetLimits(LimitsConfig{Mutate: RateLimit{Rate: 0.5, Burst: 2}})
+
+	for _, name := range []string{"c1", "c2"} {
+		status, body := api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: name})
+		expectStatus(t, status, 201, body)
+	}
+
+	resp, body := api.send(t, "POST", "/create", ci, ContainerTemplate{Name: "c3"})
+	expectError(t, resp.StatusCode, 429, body, "rate_limited")
+	if got := resp.Header.Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After %q, want 2", got)
+	}
+
+	// Reads, and other principals, have buckets of their own
+	status, body := api.do(t, "GET", "/v1/containers", ci, nil)
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c3"})
+	expectStatus(t, status, 201, body)
+
+	// Lifting the limits applies right away
+	limiter.SetLimits(LimitsConfig{})
+
+	status, body = api.do(t, "DELETE", "/v1/containers/c1", ci, nil)
+	expectStatus(t, status, 204, body)
+}
+
+func TestTokenBucket(t *testing.T) {
+	l := newRateLimiter(LimitsConfig{Exec: RateLimit{Rate: 100, Burst: 1}})
+
+	if wait := l.take("ci", classExec); wait != 0 {
+		t.Fatalf("first request waits %s", wait)
+	}
+	wait := l.take("ci", classExec)
+	if wait <= 0 || wait > 10*time.Millisecond {
+		t.Fatalf("second request waits %s, want up to 10ms", wait)
+	}
+
+	time.Sleep(wait + time.Millisecond)
+	if wait := l.take("ci", classExec); wait != 0 {
+		t.Errorf("request after the refill waits %s", wait)
+	}
+
+	if class := routeClass("POST", "/v1/containers/{name}/exec"); class != classExec {
+		t.Errorf("exec route class %s", class)
+	}
+	if class := routeClass("GET", "/v1/containers/{name}"); class != classRead {
+		t.Errorf("get route class %s", class)
+	}
+	if class := routeClass("DELETE", "/v1/containers/{name}"); class != classMutate {
+		t.Errorf("delete route class %s", class)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	api := newTestAPI(t)
+	ci := api.token(t, "ci", []string{scopeContainersWrite, scopeExec}, nil)
+
+	status, body := api.do(t, "POST", "/v1/containers", ci, ContainerTemplate{Name: "c1", Started: true})
+	expectStatus(t, status, 201, body)
+
+	limiter.SetLimits(LimitsConfig{ConcurrentCreates: 1, ConcurrentExecs: 1})
+
+	// An exec session and a creation are in progress
+	execDone, _ := limiter.start(tokenPrincipal+"ci", concurrentExecs)
+	createDone, _ := limiter.start(tokenPrincipal+"ci", concurrentCreates)
+
+	resp, body := api.send(t, "POST", "/v1/containers/c1/exec", ci, ExecCommand{Args: []string{"true"}})
+	expectError(t, resp.StatusCode, 429, body, "concurrency_limited")
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After %q, want 1", got)
+	}
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/clone", ci, CloneOptions{Name: "c2"})
+	expectError(t, status, 429, body, "concurrency_limited")
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/snapshots/snap0/restore", ci, RestoreOptions{Name: "c2"})
+	expectError(t, status, 429, body, "concurrency_limited")
+
+	// Other operations, and other principals, are not capped
+	status, body = api.do(t, "POST", "/v1/containers/c1/stop", ci, nil)
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c3"})
+	expectStatus(t, status, 201, body)
+
+	execDone()
+	createDone()
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/clone", ci, CloneOptions{Name: "c2"})
+	expectStatus(t, status, 201, body)
+
+	if len(limiter.running) != 0 {
+		t.Errorf("operations still counted: %v", limiter.running)
+	}
+}
+
+func TestReloadLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxc-go-http-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	file := filepath.Join(dir, "config.yml")
+	data := "driver: fake\nstate_dir: " + dir + "\nspec_file: " + specFile + "\nlimits:\n  exec:\n    rate: 2\n    burst: 4\n  concurrent_execs: 3\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l := newRateLimiter(LimitsConfig{})
+	l.reloadLimitsOnSIGHUP([]string{"-config", file})
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	want := LimitsConfig{Exec: RateLimit{Rate: 2, Burst: 4}, ConcurrentExecs: 3}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		l.mu.Lock()
+		limits := l.limits
+		l.mu.Unlock()
+
+		if limits == want {
+			return
+		}
+	}
+	t.Errorf("limits not reloaded")
+}
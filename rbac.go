@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// policy holds the access rules of the running server
+var policy = &Policy{}
+
+// Policy grants groups of principals access to containers they do not own
+type Policy struct {
+	// Container name patterns, as in path.Match, granted to each group
+	Groups map[string][]string `yaml:"groups"`
+
+	// Scopes and groups given to principals not authenticated by a token
+	Roles map[string]Role `yaml:"roles"`
+
+	// Client certificate common names mapped to roles
+	Certificates map[string]string `yaml:"certificates"`
+
+	// Unix socket client users and groups, by name or id, mapped to roles
+	UnixUsers  map[string]string `yaml:"unix_users"`
+	UnixGroups map[string]string `yaml:"unix_groups"`
+
+	// Host directories configuration items may bind mount in containers,
+	// along with those below them
+	Mounts []string `yaml:"mounts"`
+
+	// Host device nodes profiles may make available in containers
+	Devices []string `yaml:"devices"`
+
+	unixUsers  map[int]string
+	unixGroups map[int]string
+}
+
+// Role bundles the scopes and groups of a principal
+type Role struct {
+	Scopes []string `yaml:"scopes"`
+	Groups []string `yaml:"groups"`
+}
+
+// Principal returns principal id called name holding role, or nil when
+// the role does not exist
+func (pol *Policy) Principal(id string, name string, role string) *Principal {
+	r, ok := pol.Roles[role]
+	if !ok {
+		return nil
+	}
+	return &Principal{ID: id, Name: name, Groups: r.Groups, Scopes: r.Scopes}
+}
+
+// CanAccess reports whether principal p may see and act on container name
+// of lxcpath
+func (pol *Policy) CanAccess(p *Principal, lxcpath string, name string) bool {
+	if p.HasScope(scopeAdmin) {
+		return true
+	}
+
+	md, err := readMetadata(lxcpath, name)
+	if err != nil {
+		logger.Error("metadata not read", "container", name, "lxcpath", lxcpath, "error", err)
+	} else if owner := md.ownerID(); owner != "" && owner == p.ID {
+		return true
+	}
+
+	for _, group := range p.Groups {
+		for _, pattern := range pol.Groups[group] {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Filter returns the container names of lxcpath p may access
+func (pol *Policy) Filter(p *Principal, lxcpath string, names []string) []string {
+	allowed := make([]string, 0, len(names))
+	for _, name := range names {
+		if pol.CanAccess(p, lxcpath, name) {
+			allowed = append(allowed, name)
+		}
+	}
+	return allowed
+}
+
+// checkAccess returns the error of a missing container when the request
+// principal cannot access container name of lxcpath, so that names are not
+// leaked
+func checkAccess(r *http.Request, lxcpath string, name string) *apiError {
+	if !policy.CanAccess(principalFromContext(r.Context()), lxcpath, name) {
+		return driverError(fmt.Errorf("%w: %q", errNotDefined, name))
+	}
+	return nil
+}
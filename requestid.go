@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader carries the request ID, from clients and proxies which
+// set one, and back to clients
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request IDs accepted from clients
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDFromContext returns the ID of the request of ctx, empty when
+// none was assigned
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID assigns every request an ID, the one sent by the client
+// when it is sane, and echoes it in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			var err error
+			if id, err = randomString(16, hex.EncodeToString); err != nil {
+				id = ""
+			}
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID tells whether id, sent by a client, can be logged and
+// echoed as is
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
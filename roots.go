@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// defaultRoot is the name of the storage root pointing to lxcpath, used
+// when requests do not select one
+const defaultRoot = "default"
+
+// Root model
+// swagger:model Root
+type Root struct {
+	// Root name, passed as the root query parameter
+	// example: fast
+	Name string `json:"name"`
+
+	// lxcpath of the root
+	// example: /var/lib/lxc
+	Path string `json:"path"`
+
+	// Defined if the root is used when none is requested
+	// example: false
+	Default bool `json:"default"`
+}
+
+// Roots model
+// swagger:model Roots
+type Roots struct {
+	// List of storage roots
+	Roots []Root `json:"roots"`
+}
+
+// rootPath returns the lxcpath of root name
+func rootPath(name string) (string, error) {
+	if name == "" {
+		name = defaultRoot
+	}
+
+	path, ok := config.Roots[name]
+	if !ok {
+		return "", fmt.Errorf("unknown root %s", name)
+	}
+
+	return path, nil
+}
+
+// requestRoot returns the lxcpath selected by the root query parameter
+// of r
+func requestRoot(r *http.Request) (string, *apiError) {
+	path, err := rootPath(r.URL.Query().Get("root"))
+	if err != nil {
+		return "", &apiError{err, err.Error(), 400}
+	}
+	return path, nil
+}
+
+// GetRoots godoc
+// @Summary Get storage roots list
+// @Description Return the lxcpaths served by the API
+// @Tags general
+// @Produce json
+// @Success 200 {object} Roots
+// @Failure 500 {object} HTTPClientResp
+// @Router /roots [get]
+func GetRoots(w http.ResponseWriter, r *http.Request) *apiError {
+	roots := &Roots{Roots: make([]Root, 0, len(config.Roots))}
+	for name, path := range config.Roots {
+		roots.Roots = append(roots.Roots, Root{
+			Name:    name,
+			Path:    path,
+			Default: name == defaultRoot,
+		})
+	}
+	sort.Slice(roots.Roots, func(i, j int) bool { return roots.Roots[i].Name < roots.Roots[j].Name })
+
+	js, err := json.Marshal(roots)
+
+	if err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+
+	return nil
+}
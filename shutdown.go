@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyShutdown returns the channel receiving the signals stopping the
+// server
+func notifyShutdown() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	return signals
+}
+
+// waitForShutdown returns the first error of the listeners of srv, or
+// stops srv on the first signal. New connections are then refused, and
+// in-flight requests and background operations drained for up to the
+// shutdown timeout. Operations they still run past it are recovered from
+// the journal on the next start.
+func waitForShutdown(srv *http.Server, errs <-chan error, signals <-chan os.Signal) error {
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		logger.Info("draining in-flight requests", "signal", sig, "timeout", config.ShutdownTimeout)
+	}
+
+	if err := sdNotify("STOPPING=1"); err != nil {
+		logger.Warn("systemd not notified", "error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutdown: %v, operations in progress are recovered on the next start", err)
+	}
+	if err := operations.wait(ctx); err != nil {
+		return fmt.Errorf("shutdown: %v, operations in progress are recovered on the next start", err)
+	}
+
+	logger.Info("server stopped")
+	return nil
+}
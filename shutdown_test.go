@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startServer serves h on a local port, and returns the server, its URL and
+// the channel of its errors
+func startServer(t *testing.T, h http.Handler) (*http.Server, string, chan error) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: h}
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Serve(l) }()
+
+	return srv, "http://" + l.Addr().String(), errs
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	config = defaultConfig()
+	operations = newOperationStore()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	srv, url, errs := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+
+	responses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Error(err)
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+	<-started
+
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- waitForShutdown(srv, errs, signals) }()
+
+	// New connections are refused while draining
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, err := net.Dial("tcp", url[len("http://"):]); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("listener still open")
+		}
+	}
+
+	close(release)
+
+	if err := <-stopped; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+	if status := <-responses; status != 200 {
+		t.Errorf("in-flight request status %d", status)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	config = defaultConfig()
+	config.ShutdownTimeout = 10 * time.Millisecond
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+
+	srv, url, errs := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	go http.Get(url)
+	<-started
+
+	signals := make(chan os.Signal, 1)
+	signals <- os.Interrupt
+
+	if err := waitForShutdown(srv, errs, signals); err == nil {
+		t.Error("shutdown did not time out")
+	}
+}
+
+func TestShutdownWaitsForOperations(t *testing.T) {
+	config = defaultConfig()
+	operations = newOperationStore()
+
+	op, err := operations.start(tokenPrincipal+"ci", batchStop, []string{"c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, _, errs := startServer(t, http.NotFoundHandler())
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- waitForShutdown(srv, errs, signals) }()
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("stopped with an operation running: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	operations.finish(op)
+	if err := <-stopped; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+
+	// Operations still running past the timeout are left to the journal
+	config.ShutdownTimeout = 10 * time.Millisecond
+	if _, err := operations.start(tokenPrincipal+"ci", batchStop, []string{"c1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, _, errs = startServer(t, http.NotFoundHandler())
+	signals <- os.Interrupt
+	if err := waitForShutdown(srv, errs, signals); err == nil {
+		t.Error("shutdown did not time out")
+	}
+}
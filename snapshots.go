@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Snapshots model
+// swagger:model Snapshots
+type Snapshots struct {
+	// List of container snapshots
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// RestoreOptions model
+// swagger:model RestoreOptions
+type RestoreOptions struct {
+	// Name of the restored container, the snapshotted one when empty
+	// example: dummy-restored
+	Name string `json:"name"`
+}
+
+// GetSnapshots returns the snapshots of a container
+func GetSnapshots(w http.ResponseWriter, r *http.Request) *apiError {
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	snapshots, err := driver.Snapshots(lxcpath, name)
+
+	if err != nil {
+		return driverError(err)
+	}
+
+	if snapshots == nil {
+		snapshots = []Snapshot{}
+	}
+
+	return writeJSON(w, http.StatusOK, &Snapshots{Snapshots: snapshots})
+}
+
+// PostSnapshot snapshots a stopped container, replying 201 with the
+// snapshot
+func PostSnapshot(w http.ResponseWriter, r *http.Request) *apiError {
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	unlock, e := locks.lock(r.Context(), "snapshot", lxcpath, name)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	snapshot, err := driver.CreateSnapshot(lxcpath, name)
+
+	if err != nil {
+		return driverError(err)
+	}
+
+	location := "/v1/containers/" + url.PathEscape(name) + "/snapshots/" + url.PathEscape(snapshot.Name)
+	if root := requestRootName(r); root != defaultRoot {
+		location += "?root=" + url.QueryEscape(root)
+	}
+	w.Header().Set("Location", location)
+
+	return writeJSON(w, http.StatusCreated, snapshot)
+}
+
+// DeleteSnapshot destroys a container snapshot and replies 204
+func DeleteSnapshot(w http.ResponseWriter, r *http.Request) *apiError {
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	unlock, e := locks.lock(r.Context(), "destroy snapshot", lxcpath, name)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	if err := driver.DestroySnapshot(lxcpath, name, mux.Vars(r)["snapshot"]); err != nil {
+		return driverError(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// RestoreContainerSnapshot restores a snapshot, in place or as a new
+// container, and replies with the restored container
+func RestoreContainerSnapshot(w http.ResponseWriter, r *http.Request) *apiError {
+	lxcpath, name, e := containerRequest(r)
+	if e != nil {
+		return e
+	}
+
+	// The whole body is optional
+	var opts RestoreOptions
+
+	err := json.NewDecoder(r.Body).Decode(&opts)
+
+	if err != nil && err != io.EOF {
+		return &apiError{err, err.Error(), 400}
+	}
+
+	if opts.Name == "" {
+		opts.Name = name
+	}
+
+	// Restoring as another container creates or replaces it
+	if opts.Name != name && !principalFromContext(r.Context()).HasScope(scopeContainersWrite) {
+		err := fmt.Errorf("%s scope required to restore as another container", scopeContainersWrite)
+		return &apiError{err, err.Error(), http.StatusForbidden}
+	}
+
+	unlock, e := locks.lock(r.Context(), "restore", lxcpath, name, opts.Name)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	limits, err := containerLimits(lxcpath, name)
+	if err != nil {
+		return driverError(err)
+	}
+
+	if opts.Name != name {
+		if _, err := driver.State(lxcpath, opts.Name); err == nil {
+			if e := checkAccess(r, lxcpath, opts.Name); e != nil {
+				return e
+			}
+		} else {
+			done, e := journal.begin(journalEntry{Op: journalRestore, LXCPath: lxcpath, Name: opts.Name})
+			if e != nil {
+				return e
+			}
+			defer done()
+
+			if e := checkTenants(principalFromContext(r.Context()), opts.Name); e != nil {
+				return e
+			}
+			release, e := quotas.reserve(lxcpath, opts.Name, limits)
+			if e != nil {
+				return e
+			}
+			defer release()
+		}
+	}
+
+	if err := driver.RestoreSnapshot(lxcpath, name, mux.Vars(r)["snapshot"], opts.Name); err != nil {
+		return driverError(err)
+	}
+
+	if opts.Name == name {
+		return writeContainer(w, http.StatusOK, requestRootName(r), lxcpath, name)
+	}
+
+	md := &ContainerMetadata{
+		Owner:     principalFromContext(r.Context()).Name,
+		OwnerID:   principalFromContext(r.Context()).ID,
+		CreatedAt: time.Now().UTC(),
+		DiskBytes: limits.DiskBytes}
+
+	if err := writeMetadata(lxcpath, opts.Name, md); err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	return writeContainer(w, http.StatusCreated, requestRootName(r), lxcpath, opts.Name)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// peerCred holds the credentials of a unix socket client
+type peerCred struct {
+	PID int
+	UID int
+	GID int
+}
+
+type peerCredKey struct{}
+
+func peerCredFromContext(ctx context.Context) *peerCred {
+	c, _ := ctx.Value(peerCredKey{}).(*peerCred)
+	return c
+}
+
+// listenUnix creates the unix socket at path, replacing a stale one left
+// by a previous run, and applies mode and group to it
+func listenUnix(path string, mode os.FileMode, group string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	if group != "" {
+		gid, err := lookupGroupID(group)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+
+		if err := os.Chown(path, -1, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// lookupUserID resolves a user name or numeric uid
+func lookupUserID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGroupID resolves a group name or numeric gid
+func lookupGroupID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// peerPrincipal maps the credentials of a unix socket client to a
+// principal, looking at its uid first, then at its groups. It returns nil
+// when no role is granted to the client.
+func (pol *Policy) peerPrincipal(cred *peerCred) *Principal {
+	name := "uid:" + strconv.Itoa(cred.UID)
+	gids := []int{cred.GID}
+
+	if u, err := user.LookupId(strconv.Itoa(cred.UID)); err == nil {
+		name = u.Username
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if gid, err := strconv.Atoi(id); err == nil {
+					gids = append(gids, gid)
+				}
+			}
+		}
+	}
+
+	if role, ok := pol.unixUsers[cred.UID]; ok {
+		return pol.Principal(unixPrincipal+name, name, role)
+	}
+
+	for _, gid := range gids {
+		if role, ok := pol.unixGroups[gid]; ok {
+			return pol.Principal(unixPrincipal+name, name, role)
+		}
+	}
+
+	return nil
+}
+
+// resolveUnixIDs resolves the users and groups of the unix socket role
+// mapping
+func (pol *Policy) resolveUnixIDs() error {
+	pol.unixUsers = make(map[int]string)
+	for name, role := range pol.UnixUsers {
+		if _, ok := pol.Roles[role]; !ok {
+			return fmt.Errorf("unix user %s: unknown role %s", name, role)
+		}
+
+		uid, err := lookupUserID(name)
+		if err != nil {
+			return fmt.Errorf("unix user %s: %v", name, err)
+		}
+		pol.unixUsers[uid] = role
+	}
+
+	pol.unixGroups = make(map[int]string)
+	for name, role := range pol.UnixGroups {
+		if _, ok := pol.Roles[role]; !ok {
+			return fmt.Errorf("unix group %s: unknown role %s", name, role)
+		}
+
+		gid, err := lookupGroupID(name)
+		if err != nil {
+			return fmt.Errorf("unix group %s: %v", name, err)
+		}
+		pol.unixGroups[gid] = role
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// bootstrapCertLifetime is the validity of the generated self-signed
+// certificate
+const bootstrapCertLifetime = 10 * 365 * 24 * time.Hour
+
+// tlsReloader serves the server certificate and the client CA bundle,
+// both of which can be reloaded from disk while the server is running
+type tlsReloader struct {
+	certFile      string
+	keyFile       string
+	clientCAFile  string
+	requireClient bool
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+func newTLSReloader(certFile, keyFile, clientCAFile string, requireClient bool) (*tlsReloader, error) {
+	if requireClient && clientCAFile == "" {
+		return nil, errors.New("client certificates cannot be required without a client CA bundle")
+	}
+
+	t := &tlsReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		clientCAFile:  clientCAFile,
+		requireClient: requireClient,
+	}
+
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// reload reads the certificate, key and client CA bundle again. On error
+// the previous ones stay in use.
+func (t *tlsReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if t.clientCAFile != "" {
+		data, err := ioutil.ReadFile(t.clientCAFile)
+		if err != nil {
+			return err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s: no certificate found", t.clientCAFile)
+		}
+	}
+
+	t.mu.Lock()
+	t.cert = &cert
+	t.clientCA = pool
+	t.mu.Unlock()
+
+	return nil
+}
+
+// reloadOnSIGHUP reloads certificates each time the process receives
+// SIGHUP. Established connections are kept, new handshakes use the new
+// certificates.
+func (t *tlsReloader) reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if err := t.reload(); err != nil {
+				logger.Error("TLS certificates not reloaded", "error", err)
+				continue
+			}
+			logger.Info("TLS certificates reloaded")
+		}
+	}()
+}
+
+func (t *tlsReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*t.cert},
+	}
+
+	if t.clientCA != nil {
+		config.ClientCAs = t.clientCA
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.requireClient {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
+
+// certificate returns the certificate currently loaded
+func (t *tlsReloader) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.cert, nil
+}
+
+// Config returns the server TLS configuration. GetCertificate is set as
+// well, for ListenAndServeTLS to start without certificate files.
+func (t *tlsReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     t.certificate,
+		GetConfigForClient: t.configForClient,
+	}
+}
+
+// bootstrapCertificate generates a self-signed certificate and its key in
+// dir unless they already exist, and returns their paths
+func bootstrapCertificate(dir string) (string, string, error) {
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+
+	if _, err := os.Stat(certFile); err == nil {
+		return certFile, keyFile, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(bootstrapCertLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname, "localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		return "", "", err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPem, 0644); err != nil {
+		return "", "", err
+	}
+
+	logger.Warn("self-signed TLS certificate generated", "file", certFile)
+
+	return certFile, keyFile, nil
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// lastUsedResolution bounds how often a token last-used timestamp is
+// written back to disk
+const lastUsedResolution = time.Minute
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token expired")
+	errTokenUnknown = errors.New("token not found")
+)
+
+// tokens holds the API tokens of the running server
+var tokens *tokenStore
+
+// Token model
+// swagger:model Token
+type Token struct {
+	// Token identifier
+	// example: 3f9a0c4e5b6d7a81
+	ID string `json:"id"`
+
+	// Name of the principal the token authenticates
+	// example: ci-runner
+	Name string `json:"name"`
+
+	// Scopes granted to the token
+	// example: ["containers:read", "containers:write"]
+	Scopes []string `json:"scopes"`
+
+	// Groups the principal belongs to
+	// example: ["team-a"]
+	Groups []string `json:"groups,omitempty"`
+
+	// Creation date
+	CreatedAt time.Time `json:"created_at"`
+
+	// Expiration date, never expires when empty
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Last time the token authenticated a request
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Tokens model
+// swagger:model Tokens
+type Tokens struct {
+	// List of tokens
+	Tokens []Token `json:"tokens"`
+}
+
+// TokenRequest model
+// swagger:model TokenRequest
+type TokenRequest struct {
+	// Name of the principal the token authenticates
+	// required: true
+	// example: ci-runner
+	Name string `json:"name"`
+
+	// Scopes granted to the token
+	// required: true
+	// example: ["containers:read", "containers:write"]
+	Scopes []string `json:"scopes"`
+
+	// Groups the principal belongs to
+	// example: ["team-a"]
+	Groups []string `json:"groups"`
+
+	// Token lifetime in seconds, never expires when 0
+	// example: 86400
+	TTL int64 `json:"ttl"`
+}
+
+// NewToken model
+// swagger:model NewToken
+type NewToken struct {
+	Token
+
+	// Bearer token secret, only returned once
+	// example: 3f9a0c4e5b6d7a81.Zm9vYmFy
+	Secret string `json:"token"`
+}
+
+type storedToken struct {
+	Token
+	Hash string `json:"hash"`
+
+	// ID of the principal the token authenticates, the token name for
+	// tokens created by admins
+	Principal string `json:"principal,omitempty"`
+}
+
+// principalID returns the ID of the principal t authenticates
+func (t *storedToken) principalID() string {
+	if t.Principal == "" {
+		return tokenPrincipal + t.Name
+	}
+	return t.Principal
+}
+
+// tokenStore keeps API tokens hashed in a JSON file
+type tokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*storedToken
+}
+
+func openTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{
+		path:   path,
+		tokens: make(map[string]*storedToken),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*storedToken
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, t := range list {
+		s.tokens[t.ID] = t
+	}
+
+	return s, nil
+}
+
+// save writes the store to disk, callers must hold s.mu
+func (s *tokenStore) save() error {
+	list := make([]*storedToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// Len returns the number of stored tokens
+func (s *tokenStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.tokens)
+}
+
+// Create generates a new token of principal, called name, and returns it
+// along with its secret. Tokens of an empty principal authenticate a
+// principal of their own.
+func (s *tokenStore) Create(principal string, name string, scopes []string, groups []string, ttl time.Duration) (*NewToken, error) {
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &storedToken{
+		Token: Token{
+			ID:        id,
+			Name:      name,
+			Scopes:    scopes,
+			Groups:    groups,
+			CreatedAt: time.Now().UTC(),
+		},
+		Hash:      hashSecret(secret),
+		Principal: principal,
+	}
+	if ttl > 0 {
+		expires := t.CreatedAt.Add(ttl)
+		t.ExpiresAt = &expires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[id] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, id)
+		return nil, err
+	}
+
+	return &NewToken{Token: t.Token, Secret: id + "." + secret}, nil
+}
+
+// visible reports whether principal p may see and revoke t: admins see
+// every token, other principals their own only
+func (t *storedToken) visible(p *Principal) bool {
+	return p.HasScope(scopeAdmin) || t.principalID() == p.ID
+}
+
+// List returns the tokens p may see, sorted by creation date
+func (s *tokenStore) List(p *Principal) []Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		if t.visible(p) {
+			list = append(list, t.Token)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	return list
+}
+
+// Revoke deletes the token identified by id, for principal p. Tokens p
+// may not see are unknown to it.
+func (s *tokenStore) Revoke(p *Principal, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok || !t.visible(p) {
+		return errTokenUnknown
+	}
+
+	delete(s.tokens, id)
+	if err := s.save(); err != nil {
+		s.tokens[id] = t
+		return err
+	}
+
+	return nil
+}
+
+// Authenticate returns the principal of a bearer token
+func (s *tokenStore) Authenticate(bearer string) (*Principal, error) {
+	parts := strings.SplitN(bearer, ".", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidToken
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[parts[0]]
+	if !ok || subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashSecret(parts[1]))) != 1 {
+		return nil, errInvalidToken
+	}
+
+	now := time.Now().UTC()
+	if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+		return nil, errExpiredToken
+	}
+
+	persist := t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > lastUsedResolution
+	t.LastUsedAt = &now
+	if persist {
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Principal{ID: t.principalID(), Name: t.Name, Groups: t.Groups, Scopes: t.Scopes}, nil
+}
+
+// bootstrap creates an admin token when the store is empty and writes its
+// secret next to the store so that the first real tokens can be created
+func (s *tokenStore) bootstrap() (string, error) {
+	if s.Len() > 0 {
+		return "", nil
+	}
+
+	t, err := s.Create("", "bootstrap", []string{scopeAdmin}, nil, 0)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(filepath.Dir(s.path), "bootstrap-token")
+	if err := ioutil.WriteFile(path, []byte(t.Secret+"\n"), 0600); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
+
+// GetTokens godoc
+// @Summary Get tokens list
+// @Description Return list of API tokens, without their secret
+// @Tags tokens
+// @Produce json
+// @Success 200 {object} Tokens
+// @Failure 500 {object} HTTPClientResp
+// @Router /tokens [get]
+func GetTokens(w http.ResponseWriter, r *http.Request) *apiError {
+	js, err := json.Marshal(&Tokens{Tokens: tokens.List(principalFromContext(r.Context()))})
+
+	if err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+
+	return nil
+}
+
+// CreateToken godoc
+// @Summary Create an API token
+// @Description Create an API token, its secret is only returned once
+// @Accept json
+// @Tags tokens
+// @Produce json
+// @Param token body TokenRequest true "Token parameters"
+// @Success 200 {object} NewToken
+// @Failure 400 {object} HTTPClientResp
+// @Failure 403 {object} HTTPClientResp
+// @Failure 500 {object} HTTPClientResp
+// @Router /tokens [post]
+func CreateToken(w http.ResponseWriter, r *http.Request) *apiError {
+	t, e := createToken(r)
+	if e != nil {
+		return e
+	}
+
+	js, _ := json.Marshal(t)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+
+	return nil
+}
+
+// createToken creates the token requested by the body of r, within the
+// scopes and groups of its principal
+func createToken(r *http.Request) (*NewToken, *apiError) {
+	var req TokenRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		return nil, &apiError{err, err.Error(), 400}
+	}
+
+	if req.Name == "" {
+		err := errors.New("no token name passed")
+		return nil, &apiError{err, err.Error(), 400}
+	}
+
+	if len(req.Scopes) == 0 || req.TTL < 0 {
+		err := errors.New("a token needs at least one scope and a positive ttl")
+		return nil, &apiError{err, err.Error(), 400}
+	}
+
+	// Only admins name tokens after other principals, the tokens of the
+	// others authenticate themselves
+	p := principalFromContext(r.Context())
+	principal := ""
+	if !p.HasScope(scopeAdmin) {
+		if req.Name != p.Name {
+			err := fmt.Errorf("cannot create tokens named %s", req.Name)
+			return nil, &apiError{err, err.Error(), 403}
+		}
+		principal = p.ID
+	}
+
+	for _, scope := range req.Scopes {
+		if !isKnownScope(scope) {
+			err := fmt.Errorf("unknown scope %s", scope)
+			return nil, &apiError{err, err.Error(), 400}
+		}
+
+		// Nobody can hand out more than they hold
+		if !p.HasScope(scope) {
+			err := fmt.Errorf("cannot grant scope %s", scope)
+			return nil, &apiError{err, err.Error(), 403}
+		}
+	}
+
+	for _, group := range req.Groups {
+		if !p.InGroup(group) {
+			err := fmt.Errorf("cannot grant group %s", group)
+			return nil, &apiError{err, err.Error(), 403}
+		}
+	}
+
+	t, err := tokens.Create(principal, req.Name, req.Scopes, req.Groups, time.Duration(req.TTL)*time.Second)
+
+	if err != nil {
+		return nil, &apiError{err, err.Error(), 500}
+	}
+
+	return t, nil
+}
+
+// RevokeToken godoc
+// @Summary Revoke an API token
+// @Description Revoke an API token
+// @Tags tokens
+// @Produce json
+// @Param id path string true "Token identifier"
+// @Success 200 {object} HTTPClientResp
+// @Failure 404 {object} HTTPClientResp
+// @Failure 500 {object} HTTPClientResp
+// @Router /tokens/{id} [delete]
+func RevokeToken(w http.ResponseWriter, r *http.Request) *apiError {
+	if e := revokeToken(r); e != nil {
+		return e
+	}
+
+	jsonResp := &HTTPClientResp{
+		Status:  "success",
+		Message: "token revoked"}
+	js, _ := json.Marshal(jsonResp)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+
+	return nil
+}
+
+// revokeToken revokes the token of the id path variable of r
+func revokeToken(r *http.Request) *apiError {
+	vars := mux.Vars(r)
+
+	err := tokens.Revoke(principalFromContext(r.Context()), vars["id"])
+
+	if err == errTokenUnknown {
+		return &apiError{err, err.Error(), 404}
+	}
+	if err != nil {
+		return &apiError{err, err.Error(), 500}
+	}
+
+	return nil
+}
+
+// PostToken creates an API token, replying 201 with its secret
+func PostToken(w http.ResponseWriter, r *http.Request) *apiError {
+	t, e := createToken(r)
+	if e != nil {
+		return e
+	}
+
+	return writeJSON(w, http.StatusCreated, t)
+}
+
+// DeleteToken revokes an API token, replying 204
+func DeleteToken(w http.ResponseWriter, r *http.Request) *apiError {
+	if e := revokeToken(r); e != nil {
+		return e
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	api := newTestAPI(t)
+
+	req := TokenRequest{
+		Name:   "ci",
+		Scopes: []string{scopeContainersRead, scopeContainersWrite},
+		TTL:    3600,
+	}
+
+	status, body := api.do(t, "POST", "/tokens", api.admin, req)
+	expectStatus(t, status, 200, body)
+
+	var created NewToken
+	decode(t, body, &created)
+	if created.Secret == "" || created.ExpiresAt == nil {
+		t.Fatalf("unexpected token %s", body)
+	}
+
+	// The new token works, within its scopes
+	status, body = api.do(t, "GET", "/containers", created.Secret, nil)
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "GET", "/tokens", created.Secret, nil)
+	expectStatus(t, status, 403, body)
+
+	status, body = api.do(t, "GET", "/tokens", api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	var list Tokens
+	decode(t, body, &list)
+	if len(list.Tokens) != 2 || list.Tokens[1].ID != created.ID || list.Tokens[1].LastUsedAt == nil {
+		t.Errorf("unexpected tokens %s", body)
+	}
+
+	status, body = api.do(t, "DELETE", "/tokens/"+created.ID, api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "GET", "/containers", created.Secret, nil)
+	expectStatus(t, status, 401, body)
+
+	status, body = api.do(t, "DELETE", "/tokens/"+created.ID, api.admin, nil)
+	expectStatus(t, status, 404, body)
+}
+
+func TestCreateTokenErrors(t *testing.T) {
+	api := newTestAPI(t)
+	manager := api.token(t, "manager", []string{scopeTokens, scopeContainersRead}, []string{"team-a"})
+
+	tests := []struct {
+		name   string
+		body   interface{}
+		status int
+	}{
+		{"malformed JSON", `{"name": `, 400},
+		{"missing name", TokenRequest{Scopes: []string{scopeContainersRead}}, 400},
+		{"missing scopes", TokenRequest{Name: "manager"}, 422},
+		{"negative ttl", TokenRequest{Name: "manager", Scopes: []string{scopeContainersRead}, TTL: -1}, 400},
+		{"unknown scope", TokenRequest{Name: "manager", Scopes: []string{"root"}}, 400},
+		{"scope escalation", TokenRequest{Name: "manager", Scopes: []string{scopeExec}}, 403},
+		{"group escalation", TokenRequest{Name: "manager", Scopes: []string{scopeContainersRead}, Groups: []string{"ml"}}, 403},
+		{"other principal", TokenRequest{Name: "alice", Scopes: []string{scopeContainersRead}}, 403},
+		{"own scopes and groups", TokenRequest{Name: "manager", Scopes: []string{scopeContainersRead}, Groups: []string{"team-a"}}, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := api.do(t, "POST", "/tokens", manager, tt.body)
+			expectStatus(t, status, tt.status, body)
+		})
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	api := newTestAPI(t)
+
+	tok, err := tokens.Create("", "short", []string{scopeContainersRead}, nil, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	status, body := api.do(t, "GET", "/containers", tok.Secret, nil)
+	expectStatus(t, status, 401, body)
+}
+
+func TestTokenStorePersistence(t *testing.T) {
+	newTestAPI(t)
+
+	tok, err := tokens.Create("", "persisted", []string{scopeContainersRead}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openTokenStore(config.Auth.TokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := reopened.Authenticate(tok.Secret)
+	if err != nil || p.Name != "persisted" {
+		t.Errorf("principal %+v (%v), want persisted", p, err)
+	}
+
+	for _, st := range reopened.tokens {
+		if st.Hash == "" || st.Hash == tok.Secret {
+			t.Errorf("token %s not stored hashed", st.ID)
+		}
+	}
+}
+
+func TestTokenVisibility(t *testing.T) {
+	api := newTestAPI(t)
+	manager := api.token(t, "manager", []string{scopeTokens, scopeContainersRead}, nil)
+
+	status, body := api.do(t, "POST", "/tokens", manager, TokenRequest{Name: "manager", Scopes: []string{scopeContainersRead}})
+	expectStatus(t, status, 200, body)
+	var own NewToken
+	decode(t, body, &own)
+
+	var all Tokens
+	status, body = api.do(t, "GET", "/tokens", api.admin, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &all)
+	if len(all.Tokens) != 3 {
+		t.Fatalf("unexpected tokens %s", body)
+	}
+
+	// Principals other than admins only see and revoke their own tokens
+	var list Tokens
+	status, body = api.do(t, "GET", "/tokens", manager, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &list)
+	for _, tok := range list.Tokens {
+		if tok.Name != "manager" {
+			t.Errorf("token %s listed to manager", tok.Name)
+		}
+	}
+	if len(list.Tokens) != 2 {
+		t.Errorf("unexpected tokens %s", body)
+	}
+
+	status, body = api.do(t, "DELETE", "/tokens/"+all.Tokens[0].ID, manager, nil)
+	expectError(t, status, 404, body, "not_found")
+
+	status, body = api.do(t, "DELETE", "/tokens/"+own.ID, manager, nil)
+	expectStatus(t, status, 200, body)
+}
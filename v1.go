@@ -0,0 +1,1157 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// registerV1 adds the /v1 resource routes to r
+func registerV1(r *mux.Router) {
+	// swagger:operation GET /v1/version general getVersion
+	//
+	// Return current LXC version
+	// ---
+	// security: []
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// responses:
+	//   '200':
+	//     description: Version response
+	//     schema:
+	//       "$ref": "#/definitions/Version"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/version", apiHandler(GetVersion)).Methods("GET")
+
+	// swagger:operation GET /v1/host general getHost
+	//
+	// Return what the host supports: liblxc version, extensions and
+	// configuration, storage backends, cgroups, kernel and resources
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// responses:
+	//   '200':
+	//     description: Host response
+	//     schema:
+	//       "$ref": "#/definitions/Host"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/host", requireScope(scopeContainersRead, GetHost)).Methods("GET")
+
+	// swagger:operation GET /v1/roots general listRoots
+	//
+	// Return storage roots list
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// responses:
+	//   '200':
+	//     description: Roots response
+	//     schema:
+	//       "$ref": "#/definitions/Roots"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/roots", requireScope(scopeContainersRead, GetRoots)).Methods("GET")
+
+	// swagger:operation GET /v1/containers containers listContainers
+	//
+	// Return containers list
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - name: selector
+	//   in: query
+	//   type: string
+	//   description: Label selector, such as env=prod,team!=ml
+	// responses:
+	//   '200':
+	//     description: Containers response
+	//     schema:
+	//       "$ref": "#/definitions/Containers"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers", requireScope(scopeContainersRead, GetContainers)).Methods("GET")
+
+	// swagger:operation POST /v1/containers containers createContainer
+	//
+	// Create a container
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: template
+	//   in: body
+	//   description: container template
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/ContainerTemplate"
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '201':
+	//     description: Created container
+	//     schema:
+	//       "$ref": "#/definitions/Container"
+	//   '404':
+	//     description: a container of that name exists that the caller cannot access
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: container already defined
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers", requireScope(scopeContainersWrite, PostContainer)).Methods("POST")
+
+	// swagger:operation POST /v1/apply containers applyManifest
+	//
+	// Bring the containers of a storage root to what a manifest describes:
+	// create, configure, start or stop them, delete their older snapshots,
+	// and destroy the ones it does not list when pruning. Actions are
+	// reported with their status, those following a failed one on the
+	// same container are skipped.
+	// ---
+	// consumes:
+	// - application/json
+	// - application/yaml
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: manifest
+	//   in: body
+	//   description: containers wanted
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/Manifest"
+	// - name: dry_run
+	//   in: query
+	//   type: boolean
+	//   description: Only plan the actions
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: Actions planned, or run
+	//     schema:
+	//       "$ref": "#/definitions/Plan"
+	//   '400':
+	//     description: invalid manifest, or unknown profile
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '403':
+	//     description: snapshots would be deleted without the snapshots scope
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '422':
+	//     description: configuration items the access policy does not allow
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/apply", requireScope(scopeContainersWrite, PostApply)).Methods("POST")
+
+	// swagger:operation POST /v1/containers:batch containers batchContainers
+	//
+	// Run an action on several containers, given by name or selected. The
+	// results of each are replied, or the operation running the action
+	// when it concerns 20 containers or more.
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: batch
+	//   in: body
+	//   description: action and containers
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/Batch"
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: Result for each container
+	//     schema:
+	//       "$ref": "#/definitions/BatchResults"
+	//   '202':
+	//     description: Operation running the action
+	//     schema:
+	//       "$ref": "#/definitions/Operation"
+	//   '400':
+	//     description: invalid batch
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '403':
+	//     description: snapshots taken without the snapshots scope
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers:batch", requireScope(scopeContainersWrite, PostContainersBatch)).Methods("POST")
+
+	// swagger:operation GET /v1/operations/{id} containers getOperation
+	//
+	// Return an operation started by the principal, with the results it
+	// has so far. Operations are kept for an hour once done.
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: id
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Operation identifier
+	// responses:
+	//   '200':
+	//     description: Operation response
+	//     schema:
+	//       "$ref": "#/definitions/Operation"
+	//   '404':
+	//     description: no such operation, or started by another principal
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/operations/{id}", requireScope(scopeContainersRead, GetOperation)).Methods("GET")
+
+	// swagger:operation GET /v1/containers/{name} containers getContainer
+	//
+	// Return a container
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// responses:
+	//   '200':
+	//     description: Container response
+	//     schema:
+	//       "$ref": "#/definitions/Container"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}", requireScope(scopeContainersRead, GetContainer)).Methods("GET")
+
+	// swagger:operation DELETE /v1/containers/{name} containers destroyContainer
+	//
+	// Destroy a container
+	// ---
+	// produces:
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: force
+	//   in: query
+	//   type: boolean
+	//   description: Stop the container first when it is running
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '204':
+	//     description: Container destroyed
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: container is running, and force is not set
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}", requireScope(scopeContainersWrite, DeleteContainer)).Methods("DELETE")
+
+	// swagger:operation PATCH /v1/containers/{name} containers patchContainer
+	//
+	// Set or remove labels and annotations of a container, the others
+	// being left as they are
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: patch
+	//   in: body
+	//   description: labels and annotations changed
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/ContainerPatch"
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: Patched container
+	//     schema:
+	//       "$ref": "#/definitions/Container"
+	//   '400':
+	//     description: invalid label or annotation
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}", requireScope(scopeContainersWrite, PatchContainer)).Methods("PATCH")
+
+	// swagger:operation POST /v1/containers/{name}/start containers startContainer
+	//
+	// Start a container
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: Started container
+	//     schema:
+	//       "$ref": "#/definitions/Container"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: container is already running
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}/start", requireScope(scopeContainersWrite, StartContainer)).Methods("POST")
+
+	// swagger:operation POST /v1/containers/{name}/stop containers stopContainer
+	//
+	// Stop a container
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: Stopped container
+	//     schema:
+	//       "$ref": "#/definitions/Container"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: container is not running
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}/stop", requireScope(scopeContainersWrite, StopContainer)).Methods("POST")
+
+	// swagger:operation POST /v1/containers/{name}/clone containers cloneContainer
+	//
+	// Clone a stopped container, possibly to another storage root
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: options
+	//   in: body
+	//   description: clone parameters
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/CloneOptions"
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '201':
+	//     description: Clone
+	//     schema:
+	//       "$ref": "#/definitions/Container"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: container is running, or the clone already exists
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}/clone", requireScope(scopeContainersWrite, PostContainerClone)).Methods("POST")
+
+	// swagger:operation POST /v1/containers/{name}/exec containers execContainer
+	//
+	// Run a command in a running container and wait for it
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: command
+	//   in: body
+	//   description: command to run
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/ExecCommand"
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: Command result
+	//     schema:
+	//       "$ref": "#/definitions/ExecResult"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: container is not running
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}/exec", requireScope(scopeExec, ExecContainer)).Methods("POST")
+
+	// swagger:operation GET /v1/containers/{name}/metrics containers getContainerMetrics
+	//
+	// Return the resource usage of a running container
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// responses:
+	//   '200':
+	//     description: Metrics response
+	//     schema:
+	//       "$ref": "#/definitions/Metrics"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: container is not running
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}/metrics", requireScope(scopeContainersRead, GetContainerMetrics)).Methods("GET")
+
+	// swagger:operation GET /v1/containers/{name}/limits containers getContainerLimits
+	//
+	// Return the resource limits of a container
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// responses:
+	//   '200':
+	//     description: Limits response
+	//     schema:
+	//       "$ref": "#/definitions/ContainerLimits"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}/limits", requireScope(scopeContainersRead, GetContainerLimits)).Methods("GET")
+
+	// swagger:operation PUT /v1/containers/{name}/limits containers setContainerLimits
+	//
+	// Replace the resource limits of a container, within the quotas of its
+	// tenants. Running containers get them on their next start.
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: limits
+	//   in: body
+	//   description: limits, 0 for none
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/ContainerLimits"
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: Limits response
+	//     schema:
+	//       "$ref": "#/definitions/ContainerLimits"
+	//   '403':
+	//     description: the limits exceed a quota
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}/limits", requireScope(scopeContainersWrite, PutContainerLimits)).Methods("PUT")
+
+	// swagger:operation GET /v1/quotas/{tenant} quotas getQuota
+	//
+	// Return the quota of a tenant, with what its containers use
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: tenant
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Tenant, a group of the access policy
+	// responses:
+	//   '200':
+	//     description: Quota response
+	//     schema:
+	//       "$ref": "#/definitions/QuotaUsage"
+	//   '404':
+	//     description: no quota for the tenant, or not a group of the principal
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/quotas/{tenant}", requireScope(scopeContainersRead, GetQuota)).Methods("GET")
+
+	// swagger:operation GET /v1/containers/{name}/snapshots snapshots listSnapshots
+	//
+	// Return the snapshots of a container
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// responses:
+	//   '200':
+	//     description: Snapshots response
+	//     schema:
+	//       "$ref": "#/definitions/Snapshots"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}/snapshots", requireScope(scopeSnapshots, GetSnapshots)).Methods("GET")
+
+	// swagger:operation POST /v1/containers/{name}/snapshots snapshots createSnapshot
+	//
+	// Snapshot a stopped container
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '201':
+	//     description: Created snapshot
+	//     schema:
+	//       "$ref": "#/definitions/Snapshot"
+	//   '404':
+	//     description: container not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: container is running
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}/snapshots", requireScope(scopeSnapshots, PostSnapshot)).Methods("POST")
+
+	// swagger:operation DELETE /v1/containers/{name}/snapshots/{snapshot} snapshots destroySnapshot
+	//
+	// Destroy a container snapshot
+	// ---
+	// produces:
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: snapshot
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Snapshot name
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '204':
+	//     description: Snapshot destroyed
+	//   '404':
+	//     description: container or snapshot not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}/snapshots/{snapshot}", requireScope(scopeSnapshots, DeleteSnapshot)).Methods("DELETE")
+
+	// swagger:operation POST /v1/containers/{name}/snapshots/{snapshot}/restore snapshots restoreSnapshot
+	//
+	// Restore a container snapshot, in place or as a new container
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: name
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Container name
+	// - name: snapshot
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Snapshot name
+	// - name: options
+	//   in: body
+	//   description: restore parameters
+	//   schema:
+	//     "$ref": "#/definitions/RestoreOptions"
+	// - name: root
+	//   in: query
+	//   type: string
+	//   description: Storage root, the default one when empty
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: Container restored in place
+	//     schema:
+	//       "$ref": "#/definitions/Container"
+	//   '201':
+	//     description: Container restored as a new container
+	//     schema:
+	//       "$ref": "#/definitions/Container"
+	//   '403':
+	//     description: restoring as another container without the containers:write scope
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '404':
+	//     description: container or snapshot not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '409':
+	//     description: the new container already exists
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/containers/{name}/snapshots/{snapshot}/restore", requireScope(scopeSnapshots, RestoreContainerSnapshot)).Methods("POST")
+
+	// swagger:operation GET /v1/profiles profiles listProfiles
+	//
+	// Return the container profiles
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// responses:
+	//   '200':
+	//     description: Profiles response
+	//     schema:
+	//       "$ref": "#/definitions/Profiles"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/profiles", requireScope(scopeContainersRead, GetProfiles)).Methods("GET")
+
+	// swagger:operation POST /v1/profiles profiles createProfile
+	//
+	// Create a container profile
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: profile
+	//   in: body
+	//   description: profile
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/Profile"
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '201':
+	//     description: Created profile
+	//     schema:
+	//       "$ref": "#/definitions/Profile"
+	//   '409':
+	//     description: the profile already exists
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '422':
+	//     description: configuration items or devices the access policy does not allow
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/profiles", requireScope(scopeProfiles, PostProfile)).Methods("POST")
+
+	// swagger:operation GET /v1/profiles/{profile} profiles getProfile
+	//
+	// Return a container profile
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: profile
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Profile name
+	// responses:
+	//   '200':
+	//     description: Profile response
+	//     schema:
+	//       "$ref": "#/definitions/Profile"
+	//   '404':
+	//     description: profile not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/profiles/{profile}", requireScope(scopeContainersRead, GetProfile)).Methods("GET")
+
+	// swagger:operation PUT /v1/profiles/{profile} profiles replaceProfile
+	//
+	// Replace a container profile. Containers created with it keep the
+	// configuration it had.
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: profile
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Profile name
+	// - name: definition
+	//   in: body
+	//   description: profile, named as in the path
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/Profile"
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: Profile response
+	//     schema:
+	//       "$ref": "#/definitions/Profile"
+	//   '404':
+	//     description: profile not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   '422':
+	//     description: configuration items or devices the access policy does not allow
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/profiles/{profile}", requireScope(scopeProfiles, PutProfile)).Methods("PUT")
+
+	// swagger:operation DELETE /v1/profiles/{profile} profiles deleteProfile
+	//
+	// Delete a container profile. Containers created with it keep the
+	// configuration it had.
+	// ---
+	// produces:
+	// - application/problem+json
+	// parameters:
+	// - name: profile
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Profile name
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '204':
+	//     description: Profile deleted
+	//   '404':
+	//     description: profile not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/profiles/{profile}", requireScope(scopeProfiles, DeleteProfile)).Methods("DELETE")
+
+	// swagger:operation GET /v1/tokens tokens getTokens
+	//
+	// Return API tokens list, without their secret
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// responses:
+	//   '200':
+	//     description: Tokens response
+	//     schema:
+	//       "$ref": "#/definitions/Tokens"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/tokens", requireScope(scopeTokens, GetTokens)).Methods("GET")
+
+	// swagger:operation POST /v1/tokens tokens issueToken
+	//
+	// Create an API token, its secret is only returned once
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: token
+	//   in: body
+	//   description: token parameters
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/TokenRequest"
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '201':
+	//     description: New token response
+	//     schema:
+	//       "$ref": "#/definitions/NewToken"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/tokens", requireScope(scopeTokens, PostToken)).Methods("POST")
+
+	// swagger:operation DELETE /v1/tokens/{id} tokens deleteToken
+	//
+	// Revoke an API token
+	// ---
+	// produces:
+	// - application/problem+json
+	// parameters:
+	// - name: id
+	//   in: path
+	//   type: string
+	//   required: true
+	//   description: Token identifier
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '204':
+	//     description: Token revoked
+	//   '404':
+	//     description: token not found
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/tokens/{id}", requireScope(scopeTokens, DeleteToken)).Methods("DELETE")
+
+	// swagger:operation GET /v1/debug/locks debug getLocks
+	//
+	// Return the locks of containers having operations in progress, and
+	// contention counters
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// responses:
+	//   '200':
+	//     description: Locks response
+	//     schema:
+	//       "$ref": "#/definitions/LockStats"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/debug/locks", requireScope(scopeAdmin, GetLocks)).Methods("GET")
+
+	// swagger:operation GET /v1/admin/log-level admin getLogLevel
+	//
+	// Return the log level
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// responses:
+	//   '200':
+	//     description: Log level response
+	//     schema:
+	//       "$ref": "#/definitions/LogLevel"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/admin/log-level", requireScope(scopeAdmin, GetLogLevel)).Methods("GET")
+
+	// swagger:operation PUT /v1/admin/log-level admin setLogLevel
+	//
+	// Change the log level, until the server restarts
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: level
+	//   in: body
+	//   description: new log level
+	//   required: true
+	//   schema:
+	//     "$ref": "#/definitions/LogLevel"
+	// - "$ref": "#/parameters/IdempotencyKey"
+	// responses:
+	//   '200':
+	//     description: Log level response
+	//     schema:
+	//       "$ref": "#/definitions/LogLevel"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/admin/log-level", requireScope(scopeAdmin, PutLogLevel)).Methods("PUT")
+
+	// swagger:operation GET /v1/audit audit getAudit
+	//
+	// Return the audit records of mutating requests, the most recent ones
+	// when more match than limit
+	// ---
+	// produces:
+	// - application/json
+	// - application/problem+json
+	// parameters:
+	// - name: since
+	//   in: query
+	//   type: string
+	//   format: date-time
+	//   description: Records from this time on
+	// - name: until
+	//   in: query
+	//   type: string
+	//   format: date-time
+	//   description: Records before this time
+	// - name: container
+	//   in: query
+	//   type: string
+	//   description: Records of this container
+	// - name: principal
+	//   in: query
+	//   type: string
+	//   description: Records of this principal
+	// - name: limit
+	//   in: query
+	//   type: integer
+	//   minimum: 1
+	//   maximum: 1000
+	//   default: 100
+	//   description: Number of records returned at most
+	// responses:
+	//   '200':
+	//     description: Audit records response
+	//     schema:
+	//       "$ref": "#/definitions/AuditRecords"
+	//   '404':
+	//     description: audit log disabled
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	//   default:
+	//     description: unexpected error
+	//     schema:
+	//       "$ref": "#/definitions/Problem"
+	r.Handle("/v1/audit", requireScope(scopeAudit, GetAudit)).Methods("GET")
+}
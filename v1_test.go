@@ -0,0 +1,266 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestV1Version(t *testing.T) {
+	api := newTestAPI(t)
+
+	resp, body := api.send(t, "GET", "/v1/version", "", nil)
+	expectStatus(t, resp.StatusCode, 200, body)
+
+	if resp.Header.Get("Deprecation") != "" {
+		t.Errorf("v1 route announces a deprecation")
+	}
+}
+
+func TestV1Roots(t *testing.T) {
+	api := newTestAPI(t)
+
+	status, body := api.do(t, "GET", "/v1/roots", api.admin, nil)
+	expectStatus(t, status, 200, body)
+}
+
+func TestV1ContainerLifecycle(t *testing.T) {
+	api := newTestAPI(t)
+
+	resp, body := api.send(t, "POST", "/v1/containers?root=fast", api.admin, ContainerTemplate{Name: "c1"})
+	expectStatus(t, resp.StatusCode, 201, body)
+
+	if location := resp.Header.Get("Location"); location != "/v1/containers/c1?root=fast" {
+		t.Errorf("location %q", location)
+	}
+
+	var c Container
+	decode(t, body, &c)
+	if c.Name != "c1" || c.Root != "fast" || c.State != "STOPPED" || c.Owner != "admin" || c.CreatedAt == nil {
+		t.Errorf("unexpected container %s", body)
+	}
+
+	status, body := api.do(t, "GET", "/v1/containers?root=fast", api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "GET", "/v1/containers/c1?root=fast", api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "GET", "/v1/containers/c1", api.admin, nil)
+	expectError(t, status, 404, body, "not_defined")
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/start?root=fast", api.admin, nil)
+	expectStatus(t, status, 200, body)
+	decode(t, body, &c)
+	if c.State != "RUNNING" {
+		t.Errorf("state %s, want RUNNING", c.State)
+	}
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/start?root=fast", api.admin, nil)
+	expectError(t, status, 409, body, "already_running")
+
+	status, body = api.do(t, "DELETE", "/v1/containers/c1?root=fast", api.admin, nil)
+	expectError(t, status, 409, body, "already_running")
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/stop?root=fast", api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/stop?root=fast", api.admin, nil)
+	expectError(t, status, 409, body, "not_running")
+
+	status, body = api.do(t, "DELETE", "/v1/containers/c1?root=fast", api.admin, nil)
+	expectStatus(t, status, 204, body)
+
+	status, body = api.do(t, "DELETE", "/v1/containers/c1?root=fast", api.admin, nil)
+	expectError(t, status, 404, body, "not_defined")
+}
+
+func TestV1DeleteForce(t *testing.T) {
+	api := newTestAPI(t)
+
+	api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c1", Started: true})
+
+	status, body := api.do(t, "DELETE", "/v1/containers/c1?force=maybe", api.admin, nil)
+	expectError(t, status, 422, body, "validation_failed")
+
+	status, body = api.do(t, "DELETE", "/v1/containers/c1?force=true", api.admin, nil)
+	expectStatus(t, status, 204, body)
+}
+
+func TestV1Clone(t *testing.T) {
+	api := newTestAPI(t)
+
+	api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "base"})
+
+	resp, body := api.send(t, "POST", "/v1/containers/base/clone", api.admin, CloneOptions{Name: "copy", Root: "fast"})
+	expectStatus(t, resp.StatusCode, 201, body)
+
+	var c Container
+	decode(t, body, &c)
+	if c.Name != "copy" || c.Root != "fast" || resp.Header.Get("Location") != "/v1/containers/copy?root=fast" {
+		t.Errorf("unexpected clone %s at %s", body, resp.Header.Get("Location"))
+	}
+
+	status, body := api.do(t, "POST", "/v1/containers/base/clone", api.admin, CloneOptions{Name: "copy", Root: "fast"})
+	expectError(t, status, 409, body, "already_defined")
+}
+
+func TestV1ExecAndMetrics(t *testing.T) {
+	api := newTestAPI(t)
+	reader := api.token(t, "reader", []string{scopeContainersRead, scopeContainersWrite}, nil)
+
+	api.do(t, "POST", "/v1/containers", reader, ContainerTemplate{Name: "c1"})
+
+	status, body := api.do(t, "POST", "/v1/containers/c1/exec", api.admin, ExecCommand{Args: []string{"true"}})
+	expectError(t, status, 409, body, "not_running")
+
+	status, body = api.do(t, "GET", "/v1/containers/c1/metrics", reader, nil)
+	expectError(t, status, 409, body, "not_running")
+
+	api.do(t, "POST", "/v1/containers/c1/start", reader, nil)
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/exec", reader, ExecCommand{Args: []string{"true"}})
+	expectError(t, status, 403, body, "forbidden")
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/exec", api.admin, ExecCommand{})
+	expectError(t, status, 422, body, "validation_failed")
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/exec", api.admin, ExecCommand{Args: []string{"echo", "hello"}})
+	expectStatus(t, status, 200, body)
+
+	var result ExecResult
+	decode(t, body, &result)
+	if result.Stdout != "hello\n" || result.ExitCode != 0 {
+		t.Errorf("unexpected result %s", body)
+	}
+
+	status, body = api.do(t, "GET", "/v1/containers/c1/metrics", reader, nil)
+	expectStatus(t, status, 200, body)
+}
+
+func TestV1Snapshots(t *testing.T) {
+	api := newTestAPI(t)
+
+	api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c1"})
+
+	status, body := api.do(t, "GET", "/v1/containers/c1/snapshots", api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	var list Snapshots
+	decode(t, body, &list)
+	if list.Snapshots == nil || len(list.Snapshots) != 0 {
+		t.Errorf("unexpected snapshots %s", body)
+	}
+
+	resp, body := api.send(t, "POST", "/v1/containers/c1/snapshots", api.admin, nil)
+	expectStatus(t, resp.StatusCode, 201, body)
+
+	var s Snapshot
+	decode(t, body, &s)
+	if s.Name != "snap0" || resp.Header.Get("Location") != "/v1/containers/c1/snapshots/snap0" {
+		t.Errorf("unexpected snapshot %s at %s", body, resp.Header.Get("Location"))
+	}
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/snapshots/snap0/restore", api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/snapshots/snap0/restore", api.admin, RestoreOptions{Name: "c2"})
+	expectStatus(t, status, 201, body)
+
+	var c Container
+	decode(t, body, &c)
+	if c.Name != "c2" || c.Owner != "admin" {
+		t.Errorf("unexpected restored container %s", body)
+	}
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/snapshots/snap0/restore", api.admin, RestoreOptions{Name: "c2"})
+	expectError(t, status, 409, body, "already_defined")
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/snapshots/snap0/restore", api.admin, `{`)
+	expectError(t, status, 400, body, "bad_request")
+
+	status, body = api.do(t, "DELETE", "/v1/containers/c1/snapshots/snap0", api.admin, nil)
+	expectStatus(t, status, 204, body)
+
+	status, body = api.do(t, "DELETE", "/v1/containers/c1/snapshots/snap0", api.admin, nil)
+	expectError(t, status, 404, body, "no_snapshot")
+
+	status, body = api.do(t, "POST", "/v1/containers/c1/snapshots/snap0/restore", api.admin, nil)
+	expectError(t, status, 404, body, "no_snapshot")
+}
+
+func TestV1SnapshotsAccess(t *testing.T) {
+	api := newTestAPI(t)
+	other := api.token(t, "other", []string{scopeSnapshots}, nil)
+
+	api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c1"})
+
+	status, body := api.do(t, "POST", "/v1/containers/c1/snapshots", other, nil)
+	expectError(t, status, 404, body, "not_defined")
+
+	// Restoring as another container takes the containers:write scope
+	backup := api.token(t, "backup", []string{scopeSnapshots}, []string{"team-a"})
+	api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "a-1"})
+
+	status, body = api.do(t, "POST", "/v1/containers/a-1/snapshots", backup, nil)
+	expectStatus(t, status, 201, body)
+
+	status, body = api.do(t, "POST", "/v1/containers/a-1/snapshots/snap0/restore", backup, nil)
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "POST", "/v1/containers/a-1/snapshots/snap0/restore", backup, RestoreOptions{Name: "a-2"})
+	expectError(t, status, 403, body, "forbidden")
+	if _, err := driver.State(config.LXCPath, "a-2"); err == nil {
+		t.Error("a-2 restored without the containers:write scope")
+	}
+}
+
+func TestV1Tokens(t *testing.T) {
+	api := newTestAPI(t)
+
+	status, body := api.do(t, "POST", "/v1/tokens", api.admin, TokenRequest{Name: "ci", Scopes: []string{scopeContainersRead}})
+	expectStatus(t, status, 201, body)
+
+	var created NewToken
+	decode(t, body, &created)
+
+	status, body = api.do(t, "GET", "/v1/tokens", api.admin, nil)
+	expectStatus(t, status, 200, body)
+
+	status, body = api.do(t, "DELETE", "/v1/tokens/"+created.ID, api.admin, nil)
+	expectStatus(t, status, 204, body)
+
+	status, body = api.do(t, "DELETE", "/v1/tokens/"+created.ID, api.admin, nil)
+	expectError(t, status, 404, body, "not_found")
+}
+
+func TestLegacyRoutesDeprecated(t *testing.T) {
+	api := newTestAPI(t)
+
+	api.do(t, "POST", "/v1/containers", api.admin, ContainerTemplate{Name: "c1"})
+
+	tests := []struct {
+		method string
+		path   string
+		body   interface{}
+		link   string
+	}{
+		{"GET", "/version", nil, "</v1/version>"},
+		{"GET", "/containers", nil, "</v1/containers>"},
+		{"POST", "/clone/c1", CloneOptions{Name: "c2"}, "</v1/containers/c1/clone>"},
+		{"DELETE", "/destroy/c2", DestroyOptions{}, "</v1/containers/c2>"},
+	}
+
+	for _, tt := range tests {
+		resp, body := api.send(t, tt.method, tt.path, api.admin, tt.body)
+		expectStatus(t, resp.StatusCode, 200, body)
+
+		if got := resp.Header.Get("Deprecation"); got != "@1792368000" {
+			t.Errorf("%s %s: Deprecation %q", tt.method, tt.path, got)
+		}
+		if got := resp.Header.Get("Sunset"); got != "Mon, 19 Apr 2027 00:00:00 GMT" {
+			t.Errorf("%s %s: Sunset %q", tt.method, tt.path, got)
+		}
+		if got, want := resp.Header.Get("Link"), tt.link+`; rel="successor-version"`; got != want {
+			t.Errorf("%s %s: Link %q, want %q", tt.method, tt.path, got, want)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	oaerrors "github.com/go-openapi/errors"
+	"github.com/go-openapi/loads"
+	"github.com/go-openapi/spec"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/validate"
+	"github.com/gorilla/mux"
+)
+
+// maxBodySize bounds the request bodies read for validation
+const maxBodySize = 1 << 20
+
+// validator checks requests against the API documentation, nil when
+// validation is disabled
+var validator *specValidator
+
+// FieldError model
+// swagger:model FieldError
+type FieldError struct {
+	// Where the field is, body or query
+	// example: body
+	In string `json:"in"`
+
+	// Field path, empty for the whole body
+	// example: template.Backend
+	Field string `json:"field,omitempty"`
+
+	// What is wrong with the field
+	// example: template.Backend in body must be of type integer: "string"
+	Message string `json:"message"`
+}
+
+// validationError is the error of requests which do not match the API
+// documentation
+type validationError struct {
+	fields []FieldError
+}
+
+func (e *validationError) Error() string {
+	msgs := make([]string, 0, len(e.fields))
+	for _, f := range e.fields {
+		msgs = append(msgs, f.Message)
+	}
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+// specValidator holds the documented operations, by method and path
+// template
+type specValidator struct {
+	doc        *loads.Document
+	operations map[string]*specOperation
+}
+
+// specOperation is a documented operation, with what requests are checked
+// against
+type specOperation struct {
+	*spec.Operation
+
+	// Whether the operation needs an authenticated principal
+	secured bool
+
+	query []spec.Parameter
+
+	// Body parameter, nil when the operation has none, and its schema
+	// rejecting unknown fields
+	body       *spec.Parameter
+	bodySchema *spec.Schema
+}
+
+// loadSpecValidator reads the API documentation of path
+func loadSpecValidator(path string) (*specValidator, error) {
+	doc, err := loads.Spec(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc, err = doc.Expanded(); err != nil {
+		return nil, err
+	}
+
+	v := &specValidator{doc: doc, operations: make(map[string]*specOperation)}
+	secured := len(doc.Spec().Security) > 0
+
+	for tmpl, item := range doc.Spec().Paths.Paths {
+		for method, op := range map[string]*spec.Operation{
+			http.MethodGet:    item.Get,
+			http.MethodPost:   item.Post,
+			http.MethodPut:    item.Put,
+			http.MethodPatch:  item.Patch,
+			http.MethodDelete: item.Delete,
+		} {
+			if op == nil {
+				continue
+			}
+
+			o := &specOperation{Operation: op, secured: secured}
+			if op.Security != nil {
+				o.secured = len(op.Security) > 0
+			}
+
+			for i, param := range op.Parameters {
+				switch param.In {
+				case "query":
+					o.query = append(o.query, param)
+				case "body":
+					o.body = &op.Parameters[i]
+					if o.bodySchema, err = strictSchema(param.Schema); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			v.operations[method+" "+tmpl] = o
+		}
+	}
+
+	return v, nil
+}
+
+// strictSchema returns a copy of s rejecting properties it does not
+// define. Optional properties may be null, as Go clients send nil slices,
+// and so may map entries, which patches remove that way.
+func strictSchema(s *spec.Schema) (*spec.Schema, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var strict spec.Schema
+	if err := json.Unmarshal(data, &strict); err != nil {
+		return nil, err
+	}
+	forbidUnknownProperties(&strict)
+
+	return &strict, nil
+}
+
+func forbidUnknownProperties(s *spec.Schema) {
+	if len(s.Properties) > 0 && s.AdditionalProperties == nil {
+		s.AdditionalProperties = &spec.SchemaOrBool{Allows: false}
+	}
+
+	required := make(map[string]bool, len(s.Required))
+	for _, name := range s.Required {
+		required[name] = true
+	}
+
+	for name, prop := range s.Properties {
+		forbidUnknownProperties(&prop)
+		prop.Nullable = !required[name]
+		s.Properties[name] = prop
+	}
+
+	if s.Items != nil && s.Items.Schema != nil {
+		forbidUnknownProperties(s.Items.Schema)
+	}
+
+	if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		s.AdditionalProperties.Schema.Nullable = true
+	}
+}
+
+// operation returns the documented operation of the route r matched, nil
+// when it is not documented
+func (v *specValidator) operation(r *http.Request) *specOperation {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return nil
+	}
+
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+
+	return v.operations[r.Method+" "+tmpl]
+}
+
+// validateRequests rejects requests which do not match the documented
+// operation of their route. Requests lacking the authentication an
+// operation needs are left to requireScope, so that they are told so
+// first.
+func (v *specValidator) validateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := v.operation(r)
+		if op == nil || (op.secured && principalFromContext(r.Context()) == nil) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if e := op.validateRequest(w, r); e != nil {
+			writeError(w, r, e)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateRequest checks the query parameters and body of r. The body is
+// read, and replaced for handlers to decode it.
+func (op *specOperation) validateRequest(w http.ResponseWriter, r *http.Request) *apiError {
+	var fields []FieldError
+
+	query := r.URL.Query()
+	for _, param := range op.query {
+		value := query.Get(param.Name)
+		if value == "" {
+			if param.Required {
+				fields = append(fields, FieldError{"query", param.Name, param.Name + " in query is required"})
+			}
+			continue
+		}
+
+		var err error
+		switch param.Type {
+		case "boolean":
+			_, err = strconv.ParseBool(value)
+		case "integer":
+			_, err = strconv.ParseInt(value, 10, 64)
+		}
+		if err != nil {
+			msg := fmt.Sprintf("%s in query must be of type %s: %q", param.Name, param.Type, value)
+			fields = append(fields, FieldError{"query", param.Name, msg})
+		}
+	}
+
+	if op.body != nil {
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			return &apiError{err, err.Error(), http.StatusRequestEntityTooLarge}
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+		if len(bytes.TrimSpace(data)) == 0 {
+			if op.body.Required {
+				fields = append(fields, FieldError{"body", "", "body is required"})
+			}
+		} else {
+			// YAML bodies are checked as the JSON they decode to
+			if isYAML(r) {
+				if data, err = yamlToJSON(data); err != nil {
+					return &apiError{err, err.Error(), http.StatusBadRequest}
+				}
+			}
+
+			var body interface{}
+			if err := json.Unmarshal(data, &body); err != nil {
+				return &apiError{err, err.Error(), http.StatusBadRequest}
+			}
+
+			fields = append(fields, schemaErrors(validate.AgainstSchema(op.bodySchema, body, strfmt.Default))...)
+		}
+	}
+
+	if len(fields) > 0 {
+		err := &validationError{fields}
+		return &apiError{err, err.Error(), http.StatusUnprocessableEntity}
+	}
+
+	return nil
+}
+
+// schemaErrors turns the result of a body validation into field errors
+func schemaErrors(err error) []FieldError {
+	if err == nil {
+		return nil
+	}
+
+	composite, ok := err.(*oaerrors.CompositeError)
+	if !ok {
+		return []FieldError{{"body", "", err.Error()}}
+	}
+
+	var fields []FieldError
+	for _, err := range composite.Errors {
+		if nested, ok := err.(*oaerrors.CompositeError); ok {
+			fields = append(fields, schemaErrors(nested)...)
+			continue
+		}
+
+		field := FieldError{In: "body", Message: strings.TrimPrefix(err.Error(), ".")}
+		if v, ok := err.(*oaerrors.Validation); ok {
+			field.Field = v.Name
+
+			// Unknown fields are reported on their parent
+			if v.Code() == oaerrors.UnallowedPropertyCode {
+				field.Field += "." + fmt.Sprint(v.Value)
+			}
+
+			// Fields of the body itself are named from an empty root, as
+			// in their message
+			field.Field = strings.TrimPrefix(field.Field, ".")
+		}
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// responseRecorder copies the response written by a handler
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// validateResponses logs the responses which do not match the documented
+// operation of their route, to be used while debugging
+func (v *specValidator) validateResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := v.operation(r)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if err := v.validateResponse(op, rec); err != nil {
+			logger.Warn("response does not match the API documentation",
+				"method", r.Method, "path", r.URL.Path, "status", rec.status, "error", err,
+				"request_id", requestIDFromContext(r.Context()))
+		}
+	})
+}
+
+func (v *specValidator) validateResponse(op *specOperation, rec *responseRecorder) error {
+	response, ok := op.Responses.StatusCodeResponses[rec.status]
+	if !ok {
+		if op.Responses.Default == nil {
+			return fmt.Errorf("status %d is not documented", rec.status)
+		}
+		response = *op.Responses.Default
+	}
+
+	schema := response.Schema
+
+	// Errors negotiated to the legacy shape
+	if rec.status >= 400 && rec.Header().Get("Content-Type") == jsonMediaType {
+		legacy := v.doc.Spec().Definitions["HTTPClientResp"]
+		schema = &legacy
+	}
+
+	if schema == nil {
+		if rec.body.Len() > 0 {
+			return fmt.Errorf("unexpected body")
+		}
+		return nil
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(rec.body.Bytes(), &body); err != nil {
+		return err
+	}
+
+	return validate.AgainstSchema(schema, body, strfmt.Default)
+}
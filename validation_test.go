@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequestValidation(t *testing.T) {
+	api := newTestAPI(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		field  FieldError
+	}{
+		{"unknown field", "POST", "/v1/containers",
+			`{"name": "c1", "template": {}, "colour": "red"}`,
+			FieldError{"body", "colour", ""}},
+		{"unknown nested field", "POST", "/v1/containers",
+			`{"name": "c1", "template": {"Distro": "alpine", "Flavour": "edge"}}`,
+			FieldError{"body", "template.Flavour", ""}},
+		{"wrong type", "POST", "/v1/containers",
+			`{"name": 1, "template": {}}`,
+			FieldError{"body", "name", ""}},
+		{"missing field", "POST", "/v1/containers",
+			`{"template": {}}`,
+			FieldError{"body", "name", ""}},
+		{"empty field", "POST", "/v1/containers",
+			`{"name": "", "template": {}}`,
+			FieldError{"body", "name", ""}},
+		{"missing body", "POST", "/v1/containers", nil,
+			FieldError{"body", "", ""}},
+		{"legacy route", "POST", "/create",
+			`{"name": "c1", "template": {}, "colour": "red"}`,
+			FieldError{"body", "colour", ""}},
+		{"query parameter", "DELETE", "/v1/containers/c1?force=maybe", nil,
+			FieldError{"query", "force", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := api.do(t, tt.method, tt.path, api.admin, tt.body)
+			expectError(t, status, 422, body, "validation_failed")
+
+			var p Problem
+			decode(t, body, &p)
+			for _, f := range p.Errors {
+				if f.In == tt.field.In && f.Field == tt.field.Field && f.Message != "" {
+					return
+				}
+			}
+			t.Errorf("no error on %s %q: %s", tt.field.In, tt.field.Field, body)
+		})
+	}
+
+	if _, err := driver.State(config.LXCPath, "c1"); err == nil {
+		t.Error("invalid request reached the driver")
+	}
+}
+
+func TestRequestValidationDisabled(t *testing.T) {
+	api := newTestAPI(t)
+	validator = nil
+	api.router = newRouter()
+	api.server.Config.Handler = api.router
+
+	status, body := api.do(t, "DELETE", "/v1/containers/c1?force=maybe", api.admin, nil)
+	expectError(t, status, 400, body, "bad_request")
+}
+
+func TestResponseValidation(t *testing.T) {
+	var buf bytes.Buffer
+	defer logger.SetOutput(logger.Writer())
+	logger.SetOutput(&buf)
+
+	invalid := func(w http.ResponseWriter, r *http.Request) *apiError {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`["1.0.0"]`))
+		return nil
+	}
+
+	router := mux.NewRouter()
+	router.Use(specValidatorCache.validateResponses)
+	router.Handle("/v1/version", apiHandler(invalid)).Methods("GET")
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/version", nil))
+
+	if !strings.Contains(buf.String(), `"msg":"response does not match the API documentation","method":"GET","path":"/v1/version","status":200`) {
+		t.Errorf("invalid response not logged: %q", buf.String())
+	}
+
+	api := newTestAPI(t)
+	buf.Reset()
+
+	status, body := api.do(t, "GET", "/v1/version", "", nil)
+	expectStatus(t, status, 200, body)
+
+	if strings.Contains(buf.String(), "does not match") {
+		t.Errorf("valid response logged: %q", buf.String())
+	}
+}